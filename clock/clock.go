@@ -0,0 +1,48 @@
+// Package clock lets the viewservice, pbservice and Clerks tell time,
+// wait, and start goroutines through a Clock, so that a simulator (see
+// package sim) can stand in for the real thing: it runs a cluster in
+// virtual time, one goroutine at a time, in an order set by its seed.
+//
+// Code that takes a Clock must do all of its waiting with Sleep, and
+// start every goroutine that waits with Go; a goroutine that only does
+// work and returns may be started as usual.
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is a source of time, and a way to wait for it to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep waits for d, or until ctx ends, whichever is sooner.
+	Sleep(ctx context.Context, d time.Duration)
+
+	// Go runs f in a goroutine of its own.
+	Go(f func())
+}
+
+// Real is the clock on the wall, and the Go statement.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+func (realClock) Go(f func()) {
+	go f()
+}
@@ -0,0 +1,27 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReal(t *testing.T) {
+	start := Real.Now()
+	Real.Sleep(context.Background(), 20*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("slept %v, expected 20ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = Real.Now()
+	Real.Sleep(ctx, time.Hour)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("slept %v past a cancelled context", elapsed)
+	}
+
+	done := make(chan bool)
+	Real.Go(func() { done <- true })
+	<-done
+}
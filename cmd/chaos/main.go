@@ -0,0 +1,108 @@
+// Command chaos runs a viewservice and pbservice servers in this process,
+// on a nemesis network, with clients appending to and reading a key while
+// a nemesis partitions, kills and restarts the servers and mistreats
+// their messages at random; then it checks that what the clients saw was
+// linearizable, and exits with status 1 if it wasn't.
+//
+//	chaos -servers 3 -clients 3 -duration 30s -seed 7
+//
+// By default the faults stay within what primary/backup can survive;
+// -vs also partitions the viewservice off, and -pause pauses nodes,
+// either of which can take out a primary and its backups at once.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"usc.edu/csci499/proj2/linearizability"
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/nemesis"
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+// the viewservice's name on the network.
+const vsName = "vs"
+
+func main() {
+	nservers := flag.Int("servers", 3, "how many pbservice servers to run")
+	nclients := flag.Int("clients", 3, "how many clients to run")
+	duration := flag.Duration("duration", 30*time.Second, "how long to inflict faults for")
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	interval := flag.Duration("interval", deadtime*3, "how long each fault lasts, and the calm after it")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "the seed to choose faults with")
+	drop := flag.Float64("drop", 0.1, "the chance of a message being lost, while messages are mistreated")
+	dup := flag.Float64("dup", 0.1, "the chance of a request being duplicated, while messages are mistreated")
+	delay := flag.Duration("delay", 0, "how long each message is delayed, while messages are mistreated")
+	jitter := flag.Duration("jitter", 5*time.Millisecond, "up to how much longer, at random")
+	withVS := flag.Bool("vs", false, "partition the viewservice off too")
+	pause := flag.Bool("pause", false, "pause nodes")
+	level := flag.String("log", "error", "the level to log the cluster at")
+	flag.Parse()
+
+	lvl, err := logging.ParseLevel(*level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := logging.New(os.Stderr, lvl)
+
+	net := nemesis.NewNetwork(*seed)
+	vsnode := net.Node(vsName)
+	vs := viewservice.StartServer(vsName,
+		viewservice.WithNetwork(vsnode), viewservice.WithClock(vsnode.Clock()), viewservice.WithLogger(logger))
+	var names []string
+	for i := 0; i < *nservers; i++ {
+		names = append(names, "pb-"+strconv.Itoa(i))
+	}
+	c := nemesis.NewCluster(net, func(name string, node *nemesis.Node) func() {
+		pb := pbservice.StartServer(vsName, name,
+			pbservice.WithNetwork(node), pbservice.WithClock(node.Clock()), pbservice.WithLogger(logger))
+		return pb.Kill
+	}, names...)
+	time.Sleep(deadtime * 2)
+
+	w := nemesis.StartWorkload(net, *nclients, func(node *nemesis.Node) linearizability.KV {
+		return pbservice.MakeClerk(vsName, "", pbservice.WithClerkTransport(node))
+	})
+
+	plan := nemesis.ServerPlan(names, nemesis.Faults{Drop: *drop, Duplicate: *dup, Delay: *delay, Jitter: *jitter}, *interval)
+	if *withVS {
+		plan.Nodes = append([]string{vsName}, names...)
+	}
+	if *pause {
+		plan.Pausable = plan.Nodes
+	}
+	fmt.Printf("seed %v\n", *seed)
+	n := nemesis.New(net, c, nemesis.WithLogger(logger))
+	n.Run(context.Background(), nemesis.Random(*seed, plan, *duration))
+	n.Recover()
+	time.Sleep(deadtime * 3)
+
+	ops, err := w.Stop(10 * time.Second)
+	fmt.Println(n.Log())
+	pending := 0
+	for _, op := range ops {
+		if op.Pending() {
+			pending++
+		}
+	}
+	fmt.Printf("%v requests, %v of them unfinished\n", len(ops), pending)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("linearizable\n")
+	}
+
+	c.KillAll()
+	vs.Kill()
+	if err != nil {
+		fmt.Printf("FAIL: rerun with -seed %v\n", *seed)
+		os.Exit(1)
+	}
+}
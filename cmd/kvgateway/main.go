@@ -0,0 +1,37 @@
+// Command kvgateway serves the key/value service over HTTP.
+//
+//	kvgateway -vs /var/tmp/824-1000/vs -addr :8080
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"usc.edu/csci499/proj2/gateway"
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/trace"
+)
+
+func main() {
+	vshost := flag.String("vs", "", "the viewservice's address")
+	addr := flag.String("addr", ":8080", "the address to serve HTTP on")
+	timeout := flag.Duration("timeout", gateway.DefaultTimeout, "how long a request may take")
+	traceFile := flag.String("trace", "", "a file to write traces of requests to, in OTLP JSON")
+	flag.Parse()
+	if *vshost == "" {
+		log.Fatal("kvgateway: -vs is required")
+	}
+
+	var opts []pbservice.ClerkOption
+	if *traceFile != "" {
+		exporter, err := trace.CreateFile(*traceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, pbservice.WithClerkTracer(trace.NewTracer("kvgateway", exporter)))
+	}
+
+	ck := pbservice.MakeClerk(*vshost, "", opts...)
+	log.Fatal(http.ListenAndServe(*addr, gateway.New(ck, gateway.WithTimeout(*timeout))))
+}
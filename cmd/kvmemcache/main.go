@@ -0,0 +1,41 @@
+// Command kvmemcache serves the key/value service in the memcached text protocol.
+//
+//	kvmemcache -vs /var/tmp/824-1000/vs -addr :11211
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"usc.edu/csci499/proj2/memcache"
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/trace"
+)
+
+func main() {
+	vshost := flag.String("vs", "", "the viewservice's address")
+	addr := flag.String("addr", ":11211", "the address to serve memcached on")
+	timeout := flag.Duration("timeout", memcache.DefaultTimeout, "how long a command may take")
+	traceFile := flag.String("trace", "", "a file to write traces of requests to, in OTLP JSON")
+	flag.Parse()
+	if *vshost == "" {
+		log.Fatal("kvmemcache: -vs is required")
+	}
+
+	var opts []pbservice.ClerkOption
+	if *traceFile != "" {
+		exporter, err := trace.CreateFile(*traceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, pbservice.WithClerkTracer(trace.NewTracer("kvmemcache", exporter)))
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ck := pbservice.MakeClerk(*vshost, "", opts...)
+	log.Fatal(memcache.New(ck, memcache.WithTimeout(*timeout)).Serve(l))
+}
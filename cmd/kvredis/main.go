@@ -0,0 +1,41 @@
+// Command kvredis serves the key/value service in the Redis protocol.
+//
+//	kvredis -vs /var/tmp/824-1000/vs -addr :6379
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/resp"
+	"usc.edu/csci499/proj2/trace"
+)
+
+func main() {
+	vshost := flag.String("vs", "", "the viewservice's address")
+	addr := flag.String("addr", ":6379", "the address to serve RESP on")
+	timeout := flag.Duration("timeout", resp.DefaultTimeout, "how long a command may take")
+	traceFile := flag.String("trace", "", "a file to write traces of requests to, in OTLP JSON")
+	flag.Parse()
+	if *vshost == "" {
+		log.Fatal("kvredis: -vs is required")
+	}
+
+	var opts []pbservice.ClerkOption
+	if *traceFile != "" {
+		exporter, err := trace.CreateFile(*traceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, pbservice.WithClerkTracer(trace.NewTracer("kvredis", exporter)))
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ck := pbservice.MakeClerk(*vshost, "", opts...)
+	log.Fatal(resp.New(ck, resp.WithTimeout(*timeout)).Serve(l))
+}
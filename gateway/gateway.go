@@ -0,0 +1,182 @@
+// Package gateway serves the key/value service over HTTP, for clients
+// that can't use a pbservice.Clerk:
+//
+//	GET    /kv/{key}   the key's value, or 404 if it has none
+//	PUT    /kv/{key}   puts the request body as the key's value
+//	POST   /kv/{key}   appends the request body to the key's value
+//	DELETE /kv/{key}   removes the key
+//	GET    /view       the current view, as JSON
+//
+// Requests go through a Clerk, which finds the primary and retries as
+// usual, until the gateway's timeout passes (504), or the client hangs
+// up. If there is no primary to send a request to, the answer is 503.
+// A timed-out PUT, POST or DELETE may or may not have happened.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"usc.edu/csci499/proj2/pbservice"
+)
+
+// DefaultTimeout is how long a request may take, unless WithTimeout says otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// the longest request body the gateway accepts.
+const maxValue = 64 << 20
+
+// Gateway is an http.Handler that serves the key/value service.
+type Gateway struct {
+	ck      *pbservice.Clerk
+	timeout time.Duration
+}
+
+// an Option configures a Gateway when it is made.
+type Option func(g *Gateway)
+
+// WithTimeout sets how long the gateway keeps retrying a request
+// before it answers 504 Gateway Timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.timeout = d
+	}
+}
+
+// New returns a gateway that sends requests through ck.
+func New(ck *pbservice.Clerk, opts ...Option) *Gateway {
+	g := &Gateway{ck: ck, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/kv/") && len(r.URL.Path) > len("/kv/"):
+		g.serveKey(w, r, strings.TrimPrefix(r.URL.Path, "/kv/"))
+	case r.URL.Path == "/view":
+		g.serveView(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func (g *Gateway) serveKey(w http.ResponseWriter, r *http.Request, key string) {
+	ctx, cancel := context.WithTimeout(r.Context(), g.timeout)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value, exists, err := g.ck.LookupContext(ctx, key)
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, string(pbservice.ErrNoKey))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write([]byte(value))
+		}
+
+	case http.MethodPut, http.MethodPost:
+		value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValue))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "value too large")
+			return
+		}
+		if r.Method == http.MethodPut {
+			err = g.ck.PutBytesContext(ctx, key, value)
+		} else {
+			err = g.ck.AppendBytesContext(ctx, key, value)
+		}
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := g.ck.DeleteContext(ctx, key); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// the view, as the gateway shows it.
+type view struct {
+	Viewnum  uint     `json:"viewnum"`
+	Primary  string   `json:"primary"`
+	Backups  []string `json:"backups"`
+	Chain    bool     `json:"chain"`
+	Learners []string `json:"learners"`
+}
+
+func (g *Gateway) serveView(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	v, ok := g.ck.View()
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "viewservice unreachable")
+		return
+	}
+	writeJSON(w, http.StatusOK, view{
+		Viewnum:  v.Viewnum,
+		Primary:  v.Primary,
+		Backups:  nonNil(v.Backups),
+		Chain:    v.Chain,
+		Learners: nonNil(v.Learners),
+	})
+}
+
+// nonNil makes a list that is empty show up in JSON as [] rather than null.
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// writeRequestError answers for a request the Clerk gave up on.
+func writeRequestError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, pbservice.ErrNoPrimary):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, pbservice.ErrTimeout):
+		writeError(w, http.StatusGatewayTimeout, err.Error())
+	default:
+		// the client hung up; it won't see this
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "gw-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+func do(t *testing.T, ts *httptest.Server, method string, path string, body string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v %v: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestGateway(t *testing.T) {
+	vshost := port("v", 1)
+	vs := viewservice.StartServer(vshost)
+	defer vs.Kill()
+	time.Sleep(time.Second)
+
+	s1 := pbservice.StartServer(vshost, port("s", 1))
+	defer s1.Kill()
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings * 2)
+
+	ts := httptest.NewServer(New(pbservice.MakeClerk(vshost, ""), WithTimeout(2*time.Second)))
+	defer ts.Close()
+
+	if status, _ := do(t, ts, "GET", "/kv/a", ""); status != http.StatusNotFound {
+		t.Fatalf("GET of a missing key: status %v, expected 404", status)
+	}
+	if status, _ := do(t, ts, "PUT", "/kv/a", "x"); status != http.StatusNoContent {
+		t.Fatalf("PUT: status %v", status)
+	}
+	if status, _ := do(t, ts, "POST", "/kv/a", "y"); status != http.StatusNoContent {
+		t.Fatalf("POST: status %v", status)
+	}
+	if status, body := do(t, ts, "GET", "/kv/a", ""); status != http.StatusOK || body != "xy" {
+		t.Fatalf("GET: status %v, body %q, expected 200 and xy", status, body)
+	}
+	if status, _ := do(t, ts, "PUT", "/kv/dir/b", "\x00\xff"); status != http.StatusNoContent {
+		t.Fatalf("PUT with a slash in the key: status %v", status)
+	}
+	if status, body := do(t, ts, "GET", "/kv/dir/b", ""); status != http.StatusOK || body != "\x00\xff" {
+		t.Fatalf("GET of binary value: status %v, body %q", status, body)
+	}
+	if status, _ := do(t, ts, "DELETE", "/kv/a", ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE: status %v", status)
+	}
+	if status, _ := do(t, ts, "GET", "/kv/a", ""); status != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: status %v, expected 404", status)
+	}
+	if status, _ := do(t, ts, "PATCH", "/kv/a", ""); status != http.StatusMethodNotAllowed {
+		t.Fatalf("PATCH: status %v, expected 405", status)
+	}
+
+	status, body := do(t, ts, "GET", "/view", "")
+	var v struct {
+		Viewnum uint
+		Primary string
+		Backups []string
+	}
+	if err := json.Unmarshal([]byte(body), &v); status != http.StatusOK || err != nil {
+		t.Fatalf("GET /view: status %v, body %q, err %v", status, body, err)
+	}
+	if v.Primary != port("s", 1) || v.Backups == nil || v.Viewnum == 0 {
+		t.Fatalf("GET /view: got %+v", v)
+	}
+
+	// with the only server dead, the primary never answers
+	s1.Kill()
+	start := time.Now()
+	if status, _ := do(t, ts, "GET", "/kv/dir/b", ""); status != http.StatusGatewayTimeout {
+		t.Fatalf("GET with the primary dead: status %v, expected 504", status)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Fatalf("GET took %v to time out", time.Since(start))
+	}
+}
+
+func TestNoPrimary(t *testing.T) {
+	vshost := port("nv", 1)
+	vs := viewservice.StartServer(vshost)
+	defer vs.Kill()
+	time.Sleep(time.Second)
+
+	ts := httptest.NewServer(New(pbservice.MakeClerk(vshost, ""), WithTimeout(500*time.Millisecond)))
+	defer ts.Close()
+
+	if status, _ := do(t, ts, "PUT", "/kv/a", "x"); status != http.StatusServiceUnavailable {
+		t.Fatalf("PUT with no primary: status %v, expected 503", status)
+	}
+}
@@ -0,0 +1,283 @@
+package linearizability
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Error describes a key whose history isn't linearizable.
+type Error struct {
+	Key        string
+	Operations []Operation // on the key, in the order they were called
+
+	// the most operations the checker could put in order, and the rest,
+	// none of which could come next.
+	Linearized int
+	Unplaced   []Operation
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "linearizability: the history of %q isn't linearizable: "+
+		"at most %d of its %d operations could be put in order, and then none of", e.Key, e.Linearized, len(e.Operations))
+	const max = 8
+	for i, op := range e.Unplaced {
+		if i == max {
+			fmt.Fprintf(&b, "\n  ... and %d more", len(e.Unplaced)-max)
+			break
+		}
+		fmt.Fprintf(&b, "\n  %v", op)
+	}
+	return b.String()
+}
+
+// Check returns nil if the history ops is linearizable, and otherwise an
+// *Error describing the first key, in order, whose history isn't.
+//
+// Checking is NP-complete, and the search can take time exponential in
+// the number of operations that overlap. It copes with many clients
+// appending to the same key so long as they, or someone, Get it now and
+// then: each Get narrows down the order the Appends came in.
+func Check(ops []Operation) error {
+	byKey := make(map[string][]Operation)
+	for _, op := range ops {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := checkKey(key, byKey[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// an entry is an operation's call or return, in a list of them in the
+// order they happened, from which operations are taken out ("lifted")
+// as they are linearized, and put back when the search backtracks.
+type entry struct {
+	id    int   // the operation's index
+	call  bool  // whether this is the call, rather than the return
+	at    int64 // the event's number
+	match *entry
+	prev  *entry
+	next  *entry
+}
+
+// lift takes a call, and its return, out of the list.
+func lift(call *entry) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// unlift puts them back.
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
+
+// search is the state of checking one key.
+type search struct {
+	ops        []Operation
+	head       *entry // before the first entry
+	gets       []int  // the completed Gets, soonest returned first
+	puts       []int  // the Puts, soonest called first
+	linearized bitset
+	seen       cache
+}
+
+func checkKey(key string, ops []Operation) error {
+	s := &search{
+		ops:        ops,
+		head:       &entry{},
+		linearized: newBitset(len(ops)),
+		seen:       make(cache),
+	}
+	entries := make([]*entry, 0, 2*len(ops))
+	for i, op := range ops {
+		ret := &entry{id: i, at: op.Return}
+		if op.Pending() {
+			ret.at = math.MaxInt64
+		}
+		entries = append(entries, &entry{id: i, call: true, at: op.Call, match: ret}, ret)
+		switch {
+		case op.Kind == Get && !op.Pending():
+			s.gets = append(s.gets, i)
+		case op.Kind == Put:
+			s.puts = append(s.puts, i)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].at < entries[j].at })
+	prev := s.head
+	for _, e := range entries {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+	sort.Slice(s.gets, func(i, j int) bool { return ops[s.gets[i]].Return < ops[s.gets[j]].Return })
+	sort.Slice(s.puts, func(i, j int) bool { return ops[s.puts[i]].Call < ops[s.puts[j]].Call })
+
+	ok, best := s.run()
+	if ok {
+		return nil
+	}
+	err := &Error{Key: key, Operations: ops, Linearized: best.count()}
+	for i, op := range ops {
+		if !best.get(i) && !op.Pending() {
+			err.Unplaced = append(err.Unplaced, op)
+		}
+	}
+	return err
+}
+
+// a state of the key: its value, and the value's hash, which is what the
+// cache remembers it by. the value is appended to in place, and cut back
+// when the search backtracks, since copying it for every Append of a long
+// history would take time and space quadratic in its length.
+type state struct {
+	value []byte
+	hash  uint64
+}
+
+// the FNV-1a hash.
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+func fold(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime
+	}
+	return h
+}
+
+// step applies op to st, the model of a single copy of the key, and
+// reports whether it returns what op says it did. an operation that's
+// pending returns nothing to go by.
+func step(st state, op Operation) (state, bool) {
+	switch op.Kind {
+	case Put:
+		return state{[]byte(op.Value), fold(fnvOffset, op.Value)}, true
+	case Append:
+		return state{append(st.value, op.Value...), fold(st.hash, op.Value)}, true
+	}
+	return st, op.Pending() || op.Value == string(st.value)
+}
+
+// viable reports whether a value could yet be read by the next Get to be
+// linearized, with the operations in lin done. if nothing but Appends can
+// come before that Get, it must see value, and then some; without this,
+// a history in which many clients append, with a Get only at the end,
+// would have the search try each order of the Appends in turn.
+func (s *search) viable(lin bitset, value []byte) bool {
+	for _, g := range s.gets {
+		if lin.get(g) {
+			continue
+		}
+		read := s.ops[g]
+		for _, p := range s.puts {
+			if s.ops[p].Call > read.Return {
+				break
+			}
+			if !lin.get(p) {
+				return true
+			}
+		}
+		return len(value) <= len(read.Value) && string(value) == read.Value[:len(value)]
+	}
+	return true
+}
+
+// run searches for a linearization, depth first, trying each operation
+// that could come next, and backtracking when the first of those left has
+// returned; it returns whether it found one, and the longest it got.
+func (s *search) run() (bool, bitset) {
+	type frame struct {
+		call *entry
+		prev state
+	}
+	var stack []frame
+	st := state{hash: fnvOffset}
+	best := s.linearized.clone()
+
+	e := s.head.next
+	for e != nil {
+		op := s.ops[e.id]
+		if !e.call {
+			if op.Pending() {
+				// everything that returned is linearized; what's pending
+				// and isn't simply never took effect
+				return true, s.linearized
+			}
+			if len(stack) == 0 {
+				return false, best
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			st = f.prev
+			s.linearized.clear(f.call.id)
+			unlift(f.call)
+			e = f.call.next
+			continue
+		}
+
+		next, ok := step(st, op)
+		if ok {
+			s.linearized.set(e.id)
+			if s.seen.add(s.linearized, len(next.value), next.hash) && s.viable(s.linearized, next.value) {
+				stack = append(stack, frame{e, st})
+				st = next
+				lift(e)
+				if len(stack) > best.count() {
+					best = s.linearized.clone()
+				}
+				e = s.head.next
+				continue
+			}
+			s.linearized.clear(e.id)
+		}
+		e = e.next
+	}
+	return true, s.linearized
+}
+
+// cache remembers the states the search has been in: which operations
+// were linearized, and what value that left, by its length and hash.
+// reaching one again can't lead anywhere new.
+type cache map[uint64][]cached
+
+type cached struct {
+	lin    bitset
+	length int
+	hash   uint64
+}
+
+// add adds a state to the cache, reporting whether it was new.
+func (c cache) add(lin bitset, length int, hash uint64) bool {
+	key := lin.hash() ^ hash
+	for _, s := range c[key] {
+		if s.length == length && s.hash == hash && s.lin.equal(lin) {
+			return false
+		}
+	}
+	c[key] = append(c[key], cached{lin.clone(), length, hash})
+	return true
+}
@@ -0,0 +1,184 @@
+// Package linearizability records what clients of a key/value service
+// asked for and were told, and checks that the history is linearizable:
+// that every operation can be given a point, between when it was called
+// and when it returned, at which it took effect, such that the values the
+// Gets returned are the ones a single copy of the data, updated in that
+// order, would have had.
+//
+// The checker is the Wing & Gong search with Lowe's cache of states it has
+// already explored, as in Porcupine; it checks each key on its own, since a
+// history is linearizable if and only if each key's is.
+package linearizability
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"usc.edu/csci499/proj2/clock"
+)
+
+// Kind is what an Operation did.
+type Kind int
+
+const (
+	Get Kind = iota
+	Put
+	Append
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Get:
+		return "Get"
+	case Put:
+		return "Put"
+	case Append:
+		return "Append"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Operation is one request, as its client saw it.
+type Operation struct {
+	Client int
+	Kind   Kind
+	Key    string
+	Value  string // that was put or appended, or that Get returned
+
+	// Call and Return number the events of the history in the order they
+	// happened, so that an operation precedes another if and only if it
+	// returned before the other was called. Return is 0 for an operation
+	// that is still pending, which may or may not ever take effect.
+	Call   int64
+	Return int64
+
+	CallTime   time.Time
+	ReturnTime time.Time // zero while pending
+}
+
+// Pending reports whether the operation hasn't returned.
+func (op Operation) Pending() bool {
+	return op.Return == 0
+}
+
+func (op Operation) String() string {
+	s := fmt.Sprintf("client %d: %v(%q", op.Client, op.Kind, op.Key)
+	switch {
+	case op.Kind != Get:
+		s += fmt.Sprintf(", %q)", abbreviate(op.Value))
+	case op.Pending():
+		s += ")"
+	default:
+		s += fmt.Sprintf(") = %q", abbreviate(op.Value))
+	}
+	if op.Pending() {
+		return s + fmt.Sprintf(" [%d, pending]", op.Call)
+	}
+	return s + fmt.Sprintf(" [%d, %d]", op.Call, op.Return)
+}
+
+// abbreviate shortens long values, which Appends make plenty of.
+func abbreviate(v string) string {
+	const max = 40
+	if len(v) <= max {
+		return v
+	}
+	return v[:max/2] + "..." + v[len(v)-max/2:]
+}
+
+// KV is the part of a Clerk that a History records.
+type KV interface {
+	Get(key string) string
+	Put(key string, value string)
+	Append(key string, value string)
+}
+
+// History records the operations of its Clients.
+type History struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	events  int64
+	ops     []Operation
+	clients int
+}
+
+// NewHistory returns an empty history whose operations are timed by c,
+// or by the real clock if c is nil.
+func NewHistory(c clock.Clock) *History {
+	if c == nil {
+		c = clock.Real
+	}
+	return &History{clock: c}
+}
+
+// Client returns kv, recording into the history every request made
+// through it. A Client may be used by many goroutines at once, as a Clerk
+// may.
+func (h *History) Client(kv KV) *Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients++
+	return &Client{h: h, id: h.clients, kv: kv}
+}
+
+// Operations returns the operations so far, in the order they were called,
+// including the pending ones.
+func (h *History) Operations() []Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Operation(nil), h.ops...)
+}
+
+// call records that an operation was called, and returns its index.
+func (h *History) call(op Operation) int {
+	now := h.clock.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events++
+	op.Call = h.events
+	op.CallTime = now
+	h.ops = append(h.ops, op)
+	return len(h.ops) - 1
+}
+
+// returned records that operation i returned, with value if it was a Get.
+func (h *History) returned(i int, value string) {
+	now := h.clock.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events++
+	op := &h.ops[i]
+	op.Return = h.events
+	op.ReturnTime = now
+	if op.Kind == Get {
+		op.Value = value
+	}
+}
+
+// Client is a KV whose requests are recorded in a History.
+type Client struct {
+	h  *History
+	id int
+	kv KV
+}
+
+func (c *Client) Get(key string) string {
+	i := c.h.call(Operation{Client: c.id, Kind: Get, Key: key})
+	v := c.kv.Get(key)
+	c.h.returned(i, v)
+	return v
+}
+
+func (c *Client) Put(key string, value string) {
+	i := c.h.call(Operation{Client: c.id, Kind: Put, Key: key, Value: value})
+	c.kv.Put(key, value)
+	c.h.returned(i, "")
+}
+
+func (c *Client) Append(key string, value string) {
+	i := c.h.call(Operation{Client: c.id, Kind: Append, Key: key, Value: value})
+	c.kv.Append(key, value)
+	c.h.returned(i, "")
+}
@@ -0,0 +1,270 @@
+package linearizability
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func get(client int, key string, value string, call int64, ret int64) Operation {
+	return Operation{Client: client, Kind: Get, Key: key, Value: value, Call: call, Return: ret}
+}
+
+func put(client int, key string, value string, call int64, ret int64) Operation {
+	return Operation{Client: client, Kind: Put, Key: key, Value: value, Call: call, Return: ret}
+}
+
+func appendOp(client int, key string, value string, call int64, ret int64) Operation {
+	return Operation{Client: client, Kind: Append, Key: key, Value: value, Call: call, Return: ret}
+}
+
+func TestCheck(t *testing.T) {
+	fmt.Printf("Test: Linearizability of small histories ...\n")
+
+	histories := []struct {
+		name string
+		ops  []Operation
+		ok   bool
+	}{
+		{"empty", nil, true},
+		{"sequential", []Operation{
+			put(1, "a", "x", 1, 2),
+			appendOp(1, "a", "y", 3, 4),
+			get(1, "a", "xy", 5, 6),
+			get(1, "b", "", 7, 8),
+		}, true},
+		{"stale read", []Operation{
+			put(1, "a", "x", 1, 2),
+			put(1, "a", "y", 3, 4),
+			get(2, "a", "x", 5, 6),
+		}, false},
+		{"read of an overlapping put", []Operation{
+			put(1, "a", "x", 1, 2),
+			put(1, "a", "y", 3, 6),
+			get(2, "a", "y", 4, 5),
+			get(2, "a", "y", 7, 8),
+		}, true},
+		{"reads disagree on order", []Operation{
+			put(1, "a", "x", 1, 7),
+			put(2, "a", "y", 2, 8),
+			get(3, "a", "x", 3, 4),
+			get(4, "a", "y", 5, 6),
+			get(3, "a", "x", 9, 10),
+		}, false},
+		{"concurrent appends", []Operation{
+			appendOp(1, "a", "1", 1, 4),
+			appendOp(2, "a", "2", 2, 5),
+			get(3, "a", "2", 3, 6),
+			get(3, "a", "21", 7, 8),
+		}, true},
+		{"append applied twice", []Operation{
+			appendOp(1, "a", "1", 1, 2),
+			appendOp(1, "a", "2", 3, 4),
+			get(2, "a", "122", 5, 6),
+		}, false},
+		{"appends out of order", []Operation{
+			appendOp(1, "a", "1", 1, 2),
+			appendOp(1, "a", "2", 3, 4),
+			get(2, "a", "21", 5, 6),
+		}, false},
+		{"pending append taken effect", []Operation{
+			appendOp(1, "a", "1", 1, 0),
+			get(2, "a", "1", 2, 3),
+		}, true},
+		{"pending append not taken effect", []Operation{
+			appendOp(1, "a", "1", 1, 0),
+			get(2, "a", "", 2, 3),
+		}, true},
+		{"pending append taken effect, then not", []Operation{
+			appendOp(1, "a", "1", 1, 0),
+			get(2, "a", "1", 2, 3),
+			get(2, "a", "", 4, 5),
+		}, false},
+		{"put resets appends", []Operation{
+			appendOp(1, "a", "1", 1, 2),
+			put(2, "a", "x", 3, 5),
+			appendOp(1, "a", "2", 4, 6),
+			get(3, "a", "12", 7, 8),
+		}, false},
+		{"put between appends", []Operation{
+			appendOp(1, "a", "1", 1, 2),
+			put(2, "a", "x", 3, 6),
+			appendOp(1, "a", "2", 4, 7),
+			get(3, "a", "x2", 8, 9),
+		}, true},
+	}
+	for _, h := range histories {
+		err := Check(h.ops)
+		if (err == nil) != h.ok {
+			t.Fatalf("%v: Check() = %v, expected linearizable %v", h.name, err, h.ok)
+		}
+		if err == nil {
+			continue
+		}
+		e, isError := err.(*Error)
+		if !isError || e.Key != "a" || len(e.Unplaced) == 0 {
+			t.Fatalf("%v: Check() = %#v, expected an *Error about key a", h.name, err)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// store is a KV that is linearizable, or, if lossy, loses every other
+// Append.
+type store struct {
+	mu    sync.Mutex
+	data  map[string]string
+	lossy bool
+	n     int
+}
+
+func (s *store) Get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key]
+}
+
+func (s *store) Put(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+}
+
+func (s *store) Append(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	if !s.lossy || s.n%2 == 0 {
+		s.data[key] += value
+	}
+}
+
+// run has nclients append to one key, and now and then read it, through
+// a History.
+func run(kv KV, nclients int, nops int) *History {
+	h := NewHistory(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		ck := h.Client(kv)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < nops; n++ {
+				ck.Append("k", "x "+strconv.Itoa(i)+" "+strconv.Itoa(n)+" y")
+				if n%10 == 0 {
+					ck.Get("k")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	h.Client(kv).Get("k")
+	return h
+}
+
+func TestHistory(t *testing.T) {
+	fmt.Printf("Test: Recorded histories ...\n")
+
+	start := time.Now()
+	h := run(&store{data: make(map[string]string)}, 8, 200)
+	ops := h.Operations()
+	if len(ops) != 8*(200+20)+1 {
+		t.Fatalf("recorded %v operations, expected %v", len(ops), 8*(200+20)+1)
+	}
+	for i, op := range ops {
+		if op.Pending() || op.Call >= op.Return || op.ReturnTime.Before(op.CallTime) {
+			t.Fatalf("bad operation %v", op)
+		}
+		if i > 0 && op.Call <= ops[i-1].Call {
+			t.Fatalf("operations out of order: %v then %v", ops[i-1], op)
+		}
+	}
+	if err := Check(ops); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Check(run(&store{data: make(map[string]string), lossy: true}, 8, 200).Operations())
+	if err == nil || !strings.Contains(err.Error(), `history of "k" isn't linearizable`) {
+		t.Fatalf("a store that loses Appends passed as linearizable: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("checking took %v", elapsed)
+	}
+
+	// a Get that hasn't returned yet is pending
+	block := make(chan struct{})
+	h = NewHistory(nil)
+	ck := h.Client(blocking{block})
+	go ck.Get("k")
+	for len(h.Operations()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if op := h.Operations()[0]; !op.Pending() || !strings.Contains(op.String(), "pending") {
+		t.Fatalf("an unfinished Get was recorded as %v", op)
+	}
+	close(block)
+	fmt.Printf("  ... Passed\n")
+}
+
+// blocking is a KV whose requests wait for a channel to close.
+type blocking struct {
+	c chan struct{}
+}
+
+func (b blocking) Get(key string) string {
+	<-b.c
+	return ""
+}
+
+func (b blocking) Put(key string, value string) {
+	<-b.c
+}
+
+func (b blocking) Append(key string, value string) {
+	<-b.c
+}
+
+// many clients appending, with a Get only at the end, is the hardest case
+// for the search; it has to finish quickly anyway.
+func TestOnlyFinalGet(t *testing.T) {
+	fmt.Printf("Test: Concurrent Appends, read once ...\n")
+
+	rr := rand.New(rand.NewSource(1))
+	const nclients = 10
+	var ops []Operation
+	var value string
+	var event int64
+	// each round, every client calls an Append, and they take effect and
+	// return in a random order
+	for round := 0; round < 100; round++ {
+		for _, i := range rr.Perm(nclients) {
+			event++
+			ops = append(ops, appendOp(i, "k", strconv.Itoa(rr.Intn(3)), event, 0))
+		}
+		for _, i := range rr.Perm(nclients) {
+			op := &ops[len(ops)-nclients+i]
+			value += op.Value
+			event++
+			op.Return = event
+		}
+	}
+	event++
+	ops = append(ops, get(0, "k", value, event, event+1))
+
+	start := time.Now()
+	if err := Check(ops); err != nil {
+		t.Fatal(err)
+	}
+	ops[len(ops)-1].Value = value + "0"
+	if Check(ops) == nil {
+		t.Fatalf("a Get of more than was appended passed")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("checking took %v", elapsed)
+	}
+	fmt.Printf("  ... Passed\n")
+}
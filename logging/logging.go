@@ -0,0 +1,194 @@
+// Package logging is a small structured, leveled logger. Each line is a
+// set of key=value fields (logfmt), so that logs can be searched by
+// server, role, view and client rather than grepped for phrases:
+//
+//	time=2026-01-02T15:04:05.000Z level=info msg="view changed" component=pbservice server=/var/tmp/pb-1 viewnum=3
+//
+// Loggers made from one another with With share their output and level,
+// and the level can be changed while the servers are running, with
+// SetLevel or over HTTP with LevelHandler.
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Level is how important a message is.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name, such as "info".
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("logging: unknown level %q", name)
+}
+
+// Logger writes messages at or above its level, with its fields.
+type Logger struct {
+	out    *output
+	fields []byte // already formatted, with a leading space
+}
+
+// what all the loggers made from one another share.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int32 // a Level
+}
+
+// New returns a logger that writes messages at level or above to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: int32(level)}}
+}
+
+// Discard returns a logger that writes nothing.
+func Discard() *Logger {
+	return New(ioutil.Discard, Error+1)
+}
+
+// With returns a logger that adds the given fields, alternating keys
+// and values, to every message. It shares l's output and level.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	var b bytes.Buffer
+	b.Write(l.fields)
+	appendFields(&b, kv)
+	return &Logger{out: l.out, fields: b.Bytes()}
+}
+
+// SetLevel changes the level of l and of every logger it shares its level with.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// Level returns l's level.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.out.level))
+}
+
+// Enabled reports whether messages at level would be written, for
+// skipping the work of making fields that wouldn't be.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// Debug logs a message for developers, with fields alternating keys and values.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(Debug, msg, kv)
+}
+
+// Info logs a message about the normal course of events.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(Info, msg, kv)
+}
+
+// Warn logs a message about something that went wrong, and was handled.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(Warn, msg, kv)
+}
+
+// Error logs a message about something that went wrong, and wasn't.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(Error, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString("time=")
+	b.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteString(" level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	writeValue(&b, msg)
+	b.Write(l.fields)
+	appendFields(&b, kv)
+	b.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(b.Bytes())
+}
+
+// appendFields formats kv as " key=value" pairs. a key without a value
+// is logged with the value "(missing)".
+func appendFields(b *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		if i+1 < len(kv) {
+			writeValue(b, fmt.Sprint(kv[i+1]))
+		} else {
+			b.WriteString("(missing)")
+		}
+	}
+}
+
+// writeValue writes s, quoted if it has to be to be read back.
+func writeValue(b *bytes.Buffer, s string) {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == unicode.ReplacementChar || !unicode.IsPrint(r)
+	}) >= 0 {
+		b.WriteString(strconv.Quote(s))
+	} else {
+		b.WriteString(s)
+	}
+}
+
+// LevelHandler serves l's level: GET returns it, and PUT sets it to the
+// level named in the request body.
+func LevelHandler(l *Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			level, err := ParseLevel(strings.TrimSpace(string(body)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l.SetLevel(level)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, l.Level())
+	})
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Info).With("component", "pbservice", "server", "/var/tmp/pb 1")
+	l.Info("view changed", "viewnum", 3, "backups", "", "quote", `say "hi"`, "odd")
+	l.Debug("not written")
+
+	want := regexp.MustCompile(`^time=\S+ level=info msg="view changed" component=pbservice server="/var/tmp/pb 1" viewnum=3 backups="" quote="say \\"hi\\"" odd=\(missing\)` + "\n$")
+	if !want.MatchString(buf.String()) {
+		t.Fatalf("got %q", buf.String())
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	parent := New(&buf, Warn)
+	child := parent.With("role", "backup")
+
+	child.Info("dropped")
+	child.Warn("kept")
+	if strings.Contains(buf.String(), "dropped") || !strings.Contains(buf.String(), "level=warn msg=kept role=backup") {
+		t.Fatalf("at warn, got %q", buf.String())
+	}
+
+	// the child shares its parent's level
+	parent.SetLevel(Debug)
+	buf.Reset()
+	child.Debug("now kept")
+	if !strings.Contains(buf.String(), `level=debug msg="now kept"`) {
+		t.Fatalf("at debug, got %q", buf.String())
+	}
+	if !child.Enabled(Debug) || child.Level() != Debug {
+		t.Fatalf("child level is %v", child.Level())
+	}
+
+	for _, name := range []string{"debug", "INFO", "Warn", "error"} {
+		if _, err := ParseLevel(name); err != nil {
+			t.Fatalf("ParseLevel(%q): %v", name, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatalf("ParseLevel(loud) succeeded")
+	}
+
+	buf.Reset()
+	Discard().Error("nothing")
+	if buf.Len() != 0 {
+		t.Fatalf("Discard wrote %q", buf.String())
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	l := New(&bytes.Buffer{}, Info)
+	h := LevelHandler(l)
+
+	do := func(method string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/loglevel", strings.NewReader(body)))
+		return w
+	}
+
+	if w := do(http.MethodGet, ""); w.Code != http.StatusOK || w.Body.String() != "info\n" {
+		t.Fatalf("GET: %v %q", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPut, "debug\n"); w.Code != http.StatusOK || w.Body.String() != "debug\n" {
+		t.Fatalf("PUT debug: %v %q", w.Code, w.Body.String())
+	}
+	if l.Level() != Debug {
+		t.Fatalf("level is %v after PUT debug", l.Level())
+	}
+	if w := do(http.MethodPut, "loud"); w.Code != http.StatusBadRequest {
+		t.Fatalf("PUT loud: %v", w.Code)
+	}
+	if w := do(http.MethodPost, "warn"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, PUT" {
+		t.Fatalf("POST: %v %v", w.Code, w.Header())
+	}
+	if l.Level() != Debug {
+		t.Fatalf("level changed to %v by bad requests", l.Level())
+	}
+}
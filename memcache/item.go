@@ -0,0 +1,76 @@
+package memcache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// an item is kept in the store as one value: a header line, then the
+// data. the header starts with a byte that text rarely starts with; a
+// value without it (put there by some other client) is an item with no
+// flags that never expires.
+const header = "\xffmc "
+
+// exptimes longer than this many seconds are unix times rather than
+// relative ones, as in memcached.
+const maxRelative = 30 * 24 * 60 * 60
+
+type item struct {
+	flags   uint32
+	expires int64  // unix time, or 0 for never
+	cas     uint64 // changes whenever the item does
+	data    string
+}
+
+// encode returns the item as it is kept in the store.
+func (it item) encode() string {
+	return fmt.Sprintf("%s%d %d %d\n", header, it.flags, it.expires, it.cas) + it.data
+}
+
+// decode returns the item kept in the store as raw.
+func decode(raw string) item {
+	if strings.HasPrefix(raw, header) {
+		if nl := strings.IndexByte(raw, '\n'); nl >= 0 {
+			var it item
+			if _, err := fmt.Sscanf(raw[len(header):nl], "%d %d %d", &it.flags, &it.expires, &it.cas); err == nil {
+				it.data = raw[nl+1:]
+				return it
+			}
+		}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(raw))
+	return item{cas: h.Sum64(), data: raw}
+}
+
+// expired reports whether the item has expired as of now.
+func (it item) expired(now time.Time) bool {
+	return it.expires != 0 && it.expires <= now.Unix()
+}
+
+// expiry turns an exptime from a command into the unix time the item
+// expires at, or 0 for never. a negative exptime has expired already.
+func expiry(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return now.Unix() - 1
+	case exptime <= maxRelative:
+		return now.Unix() + exptime
+	default:
+		return exptime
+	}
+}
+
+// newCAS returns a fresh cas unique, which (almost certainly) no other
+// version of any item has had.
+func newCAS() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])>>1 + 1
+}
@@ -0,0 +1,418 @@
+// Package memcache serves the key/value service in the memcached text
+// protocol, so that memcached clients can use it as a replicated cache.
+//
+// Commands are sent on to the primary through a Clerk, which finds it
+// and retries as usual. The commands are get, gets, set, append,
+// prepend, cas, delete and touch, along with version and quit. An item's
+// flags, expiry and cas unique are kept in the store with its data, and
+// commands that depend on an item's current state (append, prepend, cas,
+// delete and touch) change it with a compare-and-swap on the primary, so
+// they are atomic as in memcached.
+//
+// Expired items are treated as missing, and removed when next read.
+// Expiry goes by the clock of the front-end that reads an item, so
+// front-ends should keep their clocks in step.
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"usc.edu/csci499/proj2/pbservice"
+)
+
+// DefaultTimeout is how long a command may take, unless WithTimeout says otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// limits on what clients may send.
+const (
+	maxValue = 64 << 20
+	maxKey   = 250
+	maxLine  = 64 * 1024
+)
+
+// Server is a memcached front-end to the key/value service.
+type Server struct {
+	ck      *pbservice.Clerk
+	timeout time.Duration
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+}
+
+// an Option configures a Server when it is made.
+type Option func(s *Server)
+
+// WithTimeout sets how long a command keeps being retried before the
+// client is sent a SERVER_ERROR.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = d
+	}
+}
+
+// New returns a server that sends commands through ck.
+func New(ck *pbservice.Clerk, opts ...Option) *Server {
+	s := &Server{
+		ck:        ck,
+		timeout:   DefaultTimeout,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ErrClosed is returned by Serve once the server is closed.
+var ErrClosed = errors.New("memcache: server closed")
+
+// Serve accepts connections on l and serves each of them, until l
+// fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.listeners, l)
+			if s.closed {
+				return ErrClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server's listeners and hangs up on its clients.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// track remembers conn, so that Close can hang up on it; returns
+// false if the server is already closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReaderSize(conn, maxLine)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if fields[0] == "quit" {
+			return
+		} else if err := s.do(r, w, fields); err != nil {
+			return
+		}
+		// flush only once the pipeline of commands already sent is done
+		if r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// do carries out one command, reading its data from r if it has any,
+// and writes its reply. an error means the connection can't go on.
+func (s *Server) do(r *bufio.Reader, w *bufio.Writer, fields []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	cmd, args := fields[0], fields[1:]
+	noreply := false
+	reply := func(line string) {
+		if !noreply {
+			w.WriteString(line + "\r\n")
+		}
+	}
+
+	switch cmd {
+	case "get", "gets":
+		if len(args) == 0 {
+			reply("ERROR")
+			return nil
+		}
+		for _, key := range args {
+			if !validKey(key) {
+				reply("CLIENT_ERROR bad key")
+				return nil
+			}
+		}
+		raws, err := s.ck.MultiLookupContext(ctx, args)
+		if err != nil {
+			reply("SERVER_ERROR " + err.Error())
+			return nil
+		}
+		now := time.Now()
+		for _, key := range args {
+			raw, exists := raws[key]
+			if !exists {
+				continue
+			}
+			it := decode(raw)
+			if it.expired(now) {
+				go s.reap(key, raw)
+				continue
+			}
+			w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(it.flags), 10) + " " + strconv.Itoa(len(it.data)))
+			if cmd == "gets" {
+				w.WriteString(" " + strconv.FormatUint(it.cas, 10))
+			}
+			w.WriteString("\r\n" + it.data + "\r\n")
+		}
+		reply("END")
+
+	case "set", "append", "prepend", "cas":
+		// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+		n := 4
+		if cmd == "cas" {
+			n = 5
+		}
+		if len(args) == n+1 && args[n] == "noreply" {
+			noreply = true
+		} else if len(args) != n {
+			reply("ERROR")
+			return nil
+		}
+		key := args[0]
+		flags, err1 := strconv.ParseUint(args[1], 10, 32)
+		exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+		size, err3 := strconv.Atoi(args[3])
+		var unique uint64
+		var err4 error
+		if cmd == "cas" {
+			unique, err4 = strconv.ParseUint(args[4], 10, 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || size > maxValue {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			// skip the rest of the line, as memcached does
+			if data[size+1] != '\n' {
+				if _, err := r.ReadSlice('\n'); err != nil && err != bufio.ErrBufferFull {
+					return err
+				}
+			}
+			reply("CLIENT_ERROR bad data chunk")
+			return nil
+		}
+		if !validKey(key) {
+			reply("CLIENT_ERROR bad key")
+			return nil
+		}
+		it := item{
+			flags:   uint32(flags),
+			expires: expiry(exptime, time.Now()),
+			cas:     newCAS(),
+			data:    string(data[:size]),
+		}
+		reply(s.store(ctx, cmd, key, it, unique))
+
+	case "delete":
+		// delete <key> [noreply]
+		if len(args) == 2 && args[1] == "noreply" {
+			noreply = true
+		} else if len(args) != 1 {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+		reply(s.delete(ctx, args[0]))
+
+	case "touch":
+		// touch <key> <exptime> [noreply]
+		if len(args) == 3 && args[2] == "noreply" {
+			noreply = true
+		} else if len(args) != 2 {
+			reply("ERROR")
+			return nil
+		}
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid exptime argument")
+			return nil
+		}
+		expires := expiry(exptime, time.Now())
+		reply(s.modify(ctx, args[0], "TOUCHED", "NOT_FOUND", func(it *item) string {
+			it.expires = expires // touching doesn't change the cas unique
+			return ""
+		}))
+
+	case "version":
+		reply("VERSION pbservice")
+
+	default:
+		reply("ERROR")
+	}
+	return nil
+}
+
+// store carries out a storage command, and returns its reply.
+func (s *Server) store(ctx context.Context, cmd string, key string, it item, unique uint64) string {
+	switch cmd {
+	case "set":
+		if err := s.ck.PutContext(ctx, key, it.encode()); err != nil {
+			return "SERVER_ERROR " + err.Error()
+		}
+		return "STORED"
+
+	case "append", "prepend":
+		// the item keeps its flags and expiry, as in memcached
+		return s.modify(ctx, key, "STORED", "NOT_STORED", func(curr *item) string {
+			if cmd == "append" {
+				curr.data += it.data
+			} else {
+				curr.data = it.data + curr.data
+			}
+			curr.cas = it.cas
+			return ""
+		})
+
+	default: // cas
+		return s.modify(ctx, key, "STORED", "NOT_FOUND", func(curr *item) string {
+			if curr.cas != unique {
+				return "EXISTS"
+			}
+			*curr = it
+			return ""
+		})
+	}
+}
+
+// modify changes the item at key with change, atomically, and returns
+// stored, or missing if there is no such item. change may also leave the
+// item alone, and return the reply to give instead.
+func (s *Server) modify(ctx context.Context, key string, stored string, missing string, change func(it *item) string) string {
+	if !validKey(key) {
+		return "CLIENT_ERROR bad key"
+	}
+	for {
+		raw, exists, err := s.ck.LookupContext(ctx, key)
+		if err != nil {
+			return "SERVER_ERROR " + err.Error()
+		}
+		it := decode(raw)
+		if !exists || it.expired(time.Now()) {
+			return missing
+		}
+		if reply := change(&it); reply != "" {
+			return reply
+		}
+		swapped, err := s.ck.CompareAndSwapContext(ctx, key, raw, it.encode())
+		if err != nil {
+			return "SERVER_ERROR " + err.Error()
+		}
+		if swapped {
+			return stored
+		}
+		// someone else changed it in the meantime; try again with theirs
+	}
+}
+
+// delete removes the item at key, and returns the reply to give.
+func (s *Server) delete(ctx context.Context, key string) string {
+	if !validKey(key) {
+		return "CLIENT_ERROR bad key"
+	}
+	for {
+		raw, exists, err := s.ck.LookupContext(ctx, key)
+		if err != nil {
+			return "SERVER_ERROR " + err.Error()
+		}
+		if !exists || decode(raw).expired(time.Now()) {
+			return "NOT_FOUND"
+		}
+		deleted, err := s.ck.CompareAndDeleteContext(ctx, key, raw)
+		if err != nil {
+			return "SERVER_ERROR " + err.Error()
+		}
+		if deleted {
+			return "DELETED"
+		}
+	}
+}
+
+// reap removes an expired item from the store, unless it has been
+// replaced since it was read as raw.
+func (s *Server) reap(key string, raw string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	s.ck.CompareAndDeleteContext(ctx, key, raw)
+}
+
+// validKey reports whether key may be used in the memcached protocol.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "mc-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// do sends a request, and checks that the reply is want, with "\r\n"
+// after each line.
+func (c *client) do(request string, want ...string) {
+	if _, err := io.WriteString(c.conn, request); err != nil {
+		c.t.Fatalf("sending %q: %v", request, err)
+	}
+	for _, line := range want {
+		got, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%q: reading reply: %v", request, err)
+		}
+		if got != line+"\r\n" {
+			c.t.Fatalf("%q -> %q, expected %q", request, got, line+"\r\n")
+		}
+	}
+}
+
+// gets returns key's cas unique.
+func (c *client) gets(key string) string {
+	io.WriteString(c.conn, "gets "+key+"\r\n")
+	line, _ := c.r.ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) != 5 || fields[0] != "VALUE" {
+		c.t.Fatalf("gets %v -> %q", key, line)
+	}
+	c.r.ReadString('\n') // the data
+	c.r.ReadString('\n') // END
+	return fields[4]
+}
+
+func TestCommands(t *testing.T) {
+	vshost := port("v", 1)
+	vs := viewservice.StartServer(vshost)
+	defer vs.Kill()
+	time.Sleep(time.Second)
+
+	s1 := pbservice.StartServer(vshost, port("s", 1))
+	defer s1.Kill()
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings * 2)
+
+	addr := port("l", 1)
+	os.Remove(addr)
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ck := pbservice.MakeClerk(vshost, "")
+	srv := New(ck)
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	c := &client{t, conn, bufio.NewReader(conn)}
+
+	c.do("get a\r\n", "END")
+	c.do("set a 5 0 1\r\nx\r\n", "STORED")
+	c.do("append a 0 0 2\r\nyz\r\n", "STORED")
+	c.do("prepend a 0 0 1\r\nw\r\n", "STORED")
+	c.do("get a missing a\r\n", "VALUE a 5 4", "wxyz", "VALUE a 5 4", "wxyz", "END")
+	c.do("append missing 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("set bin 0 0 3\r\n\x00\xff\r\r\n", "STORED")
+	c.do("get bin\r\n", "VALUE bin 0 3", "\x00\xff\r", "END")
+
+	// cas succeeds with the item's cas unique, and then it changes
+	unique := c.gets("a")
+	c.do("cas a 7 0 1 "+unique+"\r\nc\r\n", "STORED")
+	c.do("cas a 7 0 1 "+unique+"\r\nd\r\n", "EXISTS")
+	c.do("get a\r\n", "VALUE a 7 1", "c", "END")
+	c.do("cas missing 0 0 1 1\r\nc\r\n", "NOT_FOUND")
+	if again := c.gets("a"); again == unique {
+		t.Fatalf("cas unique didn't change")
+	}
+
+	// touch keeps the cas unique
+	unique = c.gets("a")
+	c.do("touch a 100\r\n", "TOUCHED")
+	if again := c.gets("a"); again != unique {
+		t.Fatalf("touch changed the cas unique")
+	}
+	c.do("touch missing 100\r\n", "NOT_FOUND")
+
+	// expired items are gone, and then removed
+	c.do("set e 0 1 1\r\nx\r\n", "STORED")
+	c.do("get e\r\n", "VALUE e 0 1", "x", "END")
+	c.do("set n 0 -1 1\r\nx\r\n", "STORED")
+	c.do("get n\r\n", "END")
+	time.Sleep(2100 * time.Millisecond)
+	c.do("get e\r\n", "END")
+	c.do("append e 0 0 1\r\ny\r\n", "NOT_STORED")
+	c.do("delete e\r\n", "NOT_FOUND")
+	time.Sleep(500 * time.Millisecond)
+	if _, exists, _ := ck.LookupContext(context.Background(), "n"); exists {
+		t.Fatalf("expired item wasn't removed")
+	}
+
+	c.do("delete a\r\n", "DELETED")
+	c.do("delete a\r\n", "NOT_FOUND")
+	c.do("set q 0 0 1 noreply\r\nx\r\nget q\r\n", "VALUE q 0 1", "x", "END")
+
+	// a value put by some other client is an item with no flags
+	ck.Put("plain", "hello")
+	c.do("get plain\r\n", "VALUE plain 0 5", "hello", "END")
+	c.do("append plain 0 0 1\r\n!\r\n", "STORED")
+	c.do("get plain\r\n", "VALUE plain 0 6", "hello!", "END")
+
+	c.do("set a 0 0 1\r\nxy\r\n", "CLIENT_ERROR bad data chunk")
+	c.do("bogus\r\n", "ERROR")
+	c.do("version\r\n", "VERSION pbservice")
+}
@@ -0,0 +1,421 @@
+// Package metrics keeps counters, gauges and histograms, and serves them
+// over HTTP in the Prometheus text exposition format.
+//
+// Each server has a Registry of its own, so that several servers can
+// run in one process (as they do in tests) without their metrics mixing.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets, in seconds: from half
+// a millisecond, for an RPC on the same machine, to ten seconds, for a
+// large state transfer.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics. It is an http.Handler that serves them.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// a metric is anything the registry can write out.
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// add registers m under name, with its HELP and TYPE lines. Registering
+// two metrics with the same name is a bug, so it panics.
+func (r *Registry) add(name string, help string, kind string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.metrics[name]; exists {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.metrics[name] = &described{help, kind, m}
+}
+
+type described struct {
+	help string
+	kind string
+	m    metric
+}
+
+func (d *described) write(w *bufio.Writer, name string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, d.kind)
+	d.m.write(w, name)
+}
+
+// WriteText writes every metric in the text exposition format, in
+// order of name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for i, m := range metrics {
+		m.write(bw, names[i])
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// a float64 that can be updated from many goroutines at once.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func (f *atomicFloat) store(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		if atomic.CompareAndSwapUint64(&f.bits, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v atomicFloat
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.v.add(delta)
+}
+
+// Value returns the counter's value.
+func (c *Counter) Value() float64 {
+	return c.v.load()
+}
+
+func (c *Counter) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", c.Value())
+}
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := new(Counter)
+	r.add(name, help, "counter", c)
+	return c
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v atomicFloat
+}
+
+// Set sets the gauge's value.
+func (g *Gauge) Set(v float64) {
+	g.v.store(v)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Value returns the gauge's value.
+func (g *Gauge) Value() float64 {
+	return g.v.load()
+}
+
+func (g *Gauge) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", g.Value())
+}
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	g := new(Gauge)
+	r.add(name, help, "gauge", g)
+	return g
+}
+
+// a gauge whose values are found out when they're written: f calls set
+// once for each set of label values.
+type gaugeFunc struct {
+	labels []string
+	f      func(set func(value float64, labelValues ...string))
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer, name string) {
+	type sample struct {
+		labels string
+		value  float64
+	}
+	var samples []sample
+	g.f(func(value float64, labelValues ...string) {
+		samples = append(samples, sample{formatLabels(g.labels, labelValues), value})
+	})
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	for _, s := range samples {
+		writeSample(w, name, s.labels, s.value)
+	}
+}
+
+// NewGaugeFunc registers a gauge whose values are found out by calling f
+// whenever the metrics are written. f must not block for long, and must
+// call set with as many label values as there are labels.
+func (r *Registry) NewGaugeFunc(name string, help string, f func(set func(value float64, labelValues ...string)), labels ...string) {
+	r.add(name, help, "gauge", &gaugeFunc{labels, f})
+}
+
+// a family of metrics of the same kind, one for each set of label values.
+type vec struct {
+	labels []string
+	mu     sync.Mutex
+	series map[string]metric // by formatted labels
+	make   func() metric
+}
+
+func (v *vec) with(labelValues []string) metric {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %v label values for labels %v", labelValues, v.labels))
+	}
+	key := formatLabels(v.labels, labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.series[key]
+	if !ok {
+		m = v.make()
+		v.series[key] = m
+	}
+	return m
+}
+
+func (v *vec) write(w *bufio.Writer, name string) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]metric, len(keys))
+	for i, key := range keys {
+		series[i] = v.series[key]
+	}
+	v.mu.Unlock()
+
+	for i, m := range series {
+		switch m := m.(type) {
+		case *Counter:
+			writeSample(w, name, keys[i], m.Value())
+		case *Gauge:
+			writeSample(w, name, keys[i], m.Value())
+		case *Histogram:
+			m.writeLabelled(w, name, keys[i])
+		}
+	}
+}
+
+// CounterVec is a family of counters, told apart by their labels.
+type CounterVec struct {
+	v *vec
+}
+
+// With returns the counter with the given label values, in the order
+// the labels were registered in.
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.v.with(labelValues).(*Counter)
+}
+
+// NewCounterVec registers a family of counters.
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	v := &vec{labels: labels, series: make(map[string]metric), make: func() metric { return new(Counter) }}
+	r.add(name, help, "counter", v)
+	return &CounterVec{v}
+}
+
+// GaugeVec is a family of gauges, told apart by their labels.
+type GaugeVec struct {
+	v *vec
+}
+
+// With returns the gauge with the given label values.
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.v.with(labelValues).(*Gauge)
+}
+
+// NewGaugeVec registers a family of gauges.
+func (r *Registry) NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	v := &vec{labels: labels, series: make(map[string]metric), make: func() metric { return new(Gauge) }}
+	r.add(name, help, "gauge", v)
+	return &GaugeVec{v}
+}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	buckets []float64 // upper bounds, ascending
+	mu      sync.Mutex
+	counts  []uint64 // not cumulative; the last is for +Inf
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets out of order")
+	}
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v) // the first bucket v fits in
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// Count returns how many observations there have been.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := uint64(0)
+	for _, count := range h.counts {
+		n += count
+	}
+	return n
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	h.writeLabelled(w, name, "")
+}
+
+// writeLabelled writes the histogram's series, with labels (already
+// formatted, braces and all) added to each.
+func (h *Histogram) writeLabelled(w *bufio.Writer, name string, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.mu.Unlock()
+
+	inner := strings.TrimSuffix(strings.TrimPrefix(labels, "{"), "}")
+	if inner != "" {
+		inner += ","
+	}
+	cumulative := uint64(0)
+	for i, count := range counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = formatFloat(h.buckets[i])
+		}
+		writeSample(w, name+"_bucket", "{"+inner+`le="`+le+`"}`, float64(cumulative))
+	}
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(cumulative))
+}
+
+// NewHistogram registers a histogram with the given buckets, or
+// DefBuckets if buckets is nil.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.add(name, help, "histogram", h)
+	return h
+}
+
+// HistogramVec is a family of histograms, told apart by their labels.
+type HistogramVec struct {
+	v *vec
+}
+
+// With returns the histogram with the given label values.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.v.with(labelValues).(*Histogram)
+}
+
+// NewHistogramVec registers a family of histograms, each with the given
+// buckets, or DefBuckets if buckets is nil.
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	newHistogram(buckets) // check them now, rather than on first use
+	v := &vec{labels: labels, series: make(map[string]metric), make: func() metric { return newHistogram(buckets) }}
+	r.add(name, help, "histogram", v)
+	return &HistogramVec{v}
+}
+
+// formatLabels returns labels and their values as they are written,
+// braces and all, or "" if there are none.
+func formatLabels(labels []string, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label + `="` + escape(values[i]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, value float64) {
+	w.WriteString(name + labels + " " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
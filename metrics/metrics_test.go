@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTextFormat(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.\nAll of them.")
+	c.Inc()
+	c.Add(2)
+	g := r.NewGauge("temperature", "How hot.")
+	g.Set(-1.5)
+	cv := r.NewCounterVec("calls_total", "Calls.", "method", "code")
+	cv.With("Get", "OK").Inc()
+	cv.With(`say "hi"`, "a\\b").Add(4)
+	h := r.NewHistogram("duration_seconds", "Durations.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(5)
+	hv := r.NewHistogramVec("size_bytes", "Sizes.", []float64{10}, "dir")
+	hv.With("in").Observe(3)
+	r.NewGaugeFunc("age_seconds", "Ages.", func(set func(float64, ...string)) {
+		set(2, "b")
+		set(math.Inf(1), "a")
+	}, "server")
+
+	want := `# HELP age_seconds Ages.
+# TYPE age_seconds gauge
+age_seconds{server="a"} +Inf
+age_seconds{server="b"} 2
+# HELP calls_total Calls.
+# TYPE calls_total counter
+calls_total{method="Get",code="OK"} 1
+calls_total{method="say \"hi\"",code="a\\b"} 4
+# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 2
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 5.15
+duration_seconds_count 3
+# HELP requests_total Requests.\nAll of them.
+# TYPE requests_total counter
+requests_total 3
+# HELP size_bytes Sizes.
+# TYPE size_bytes histogram
+size_bytes_bucket{dir="in",le="10"} 1
+size_bytes_bucket{dir="in",le="+Inf"} 1
+size_bytes_sum{dir="in"} 3
+size_bytes_count{dir="in"} 1
+# HELP temperature How hot.
+# TYPE temperature gauge
+temperature -1.5
+`
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("got\n%s\nexpected\n%s", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type %q", ct)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("x", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("registering a name twice didn't panic")
+		}
+	}()
+	r.NewGauge("x", "")
+}
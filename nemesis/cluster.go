@@ -0,0 +1,137 @@
+package nemesis
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"usc.edu/csci499/proj2/linearizability"
+)
+
+// Cluster is the servers of a cluster on a Network, started and killed by
+// name; it is the Processes a Nemesis kills and restarts. It starts a
+// server with the function it is given, which returns how to kill it, so
+// that it can run any service.
+type Cluster struct {
+	net   *Network
+	start func(name string, node *Node) (kill func())
+
+	mu    sync.Mutex
+	kills map[string]func()
+}
+
+// NewCluster returns a cluster on net of the servers named, each started
+// with start, on its node.
+func NewCluster(net *Network, start func(name string, node *Node) (kill func()), names ...string) *Cluster {
+	c := &Cluster{net: net, start: start, kills: make(map[string]func())}
+	for _, name := range names {
+		c.Restart(name)
+	}
+	return c
+}
+
+// Restart starts the named server afresh, killing it first if it is running.
+func (c *Cluster) Restart(name string) {
+	c.Kill(name)
+	kill := c.start(name, c.net.Node(name))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kills[name] = kill
+}
+
+// Kill kills the named server, if it is running.
+func (c *Cluster) Kill(name string) {
+	c.mu.Lock()
+	kill := c.kills[name]
+	delete(c.kills, name)
+	c.mu.Unlock()
+	if kill != nil {
+		kill()
+	}
+}
+
+// KillAll kills every server that is running.
+func (c *Cluster) KillAll() {
+	c.mu.Lock()
+	var names []string
+	for name := range c.kills {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+	for _, name := range names {
+		c.Kill(name)
+	}
+}
+
+// ServerPlan returns a plan that partitions off, and kills and restarts,
+// the servers named, and mistreats messages with f, each for interval: the
+// faults that primary/backup survives, given an interval long enough to
+// form a new view. The viewservice is left alone, and nothing is paused:
+// cut off or paused, the viewservice would think every server had died at
+// once; a paused backup holds up the primary until they both look dead.
+func ServerPlan(servers []string, f Faults, interval time.Duration) Plan {
+	return Plan{
+		Nodes:    servers,
+		Killable: servers,
+		Faults:   f,
+		Interval: interval,
+	}
+}
+
+// Workload is clients on a Network, each appending to a key that they all
+// share, reading it, and putting a key of its own, over and over, with
+// their requests recorded in a history to check once they stop.
+type Workload struct {
+	history *linearizability.History
+	done    int32
+	wg      sync.WaitGroup
+}
+
+// StartWorkload starts n clients, the i'th of which is on the node
+// "clerk-i", each made with dial on its node.
+func StartWorkload(net *Network, n int, dial func(node *Node) linearizability.KV) *Workload {
+	w := &Workload{history: linearizability.NewHistory(nil)}
+	for i := 0; i < n; i++ {
+		ck := w.history.Client(dial(net.Node("clerk-" + strconv.Itoa(i))))
+		w.wg.Add(1)
+		go func(i int) {
+			defer w.wg.Done()
+			for n := 0; atomic.LoadInt32(&w.done) == 0; n++ {
+				ck.Append("k", "x "+strconv.Itoa(i)+" "+strconv.Itoa(n)+" y")
+				ck.Get("k")
+				ck.Put(strconv.Itoa(i), strconv.Itoa(n))
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(i)
+	}
+	return w
+}
+
+// Stop tells the clients to stop, waits up to timeout for their last
+// requests to finish, and checks that what they saw was linearizable. It
+// returns their requests, including any unfinished, and an error if the
+// clients were stuck, or the history isn't linearizable, or both.
+func (w *Workload) Stop(timeout time.Duration) ([]linearizability.Operation, error) {
+	atomic.StoreInt32(&w.done, 1)
+	finished := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		err = fmt.Errorf("the clients didn't finish within %v of being stopped", timeout)
+	}
+
+	ops := w.history.Operations()
+	if cerr := linearizability.Check(ops); cerr != nil && err != nil {
+		err = fmt.Errorf("%v, and %v", err, cerr)
+	} else if cerr != nil {
+		err = cerr
+	}
+	return ops, err
+}
@@ -0,0 +1,306 @@
+// Package nemesis injects faults into a cluster running in one process:
+// it partitions any sets of nodes from each other (the viewservice
+// included), delays, drops, duplicates and reorders their messages,
+// pauses them, and kills and restarts them, on a schedule.
+//
+// A cluster's viewservice, servers and Clerks join a Network as nodes, by
+// name, through the options that take a wire.Network, a wire.Transport
+// and a clock.Clock:
+//
+//	net := nemesis.NewNetwork(seed)
+//	vs := viewservice.StartServer("vs",
+//		viewservice.WithNetwork(net.Node("vs")), viewservice.WithClock(net.Node("vs").Clock()))
+//	pb := pbservice.StartServer("vs", "pb-0",
+//		pbservice.WithNetwork(net.Node("pb-0")), pbservice.WithClock(net.Node("pb-0").Clock()))
+//	ck := pbservice.MakeClerk("vs", "", pbservice.WithClerkTransport(net.Node("clerk-0")))
+//
+// A Nemesis then runs a Schedule of Actions against the network, and
+// against the cluster's Processes, which it kills and restarts by name.
+// Random makes a schedule of faults from a Plan. A Cluster starts and
+// kills a cluster's servers, and a Workload runs clients against them and
+// checks that what they saw was linearizable; cmd/chaos and pbservice's
+// tests run a schedule against both.
+package nemesis
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"usc.edu/csci499/proj2/logging"
+)
+
+// Processes kills and restarts the nodes of a cluster, by name, for a
+// Nemesis. A node that is restarted comes back afresh, having lost its
+// state, as a crashed server does.
+type Processes interface {
+	Kill(name string)
+	Restart(name string)
+}
+
+// Nemesis inflicts Actions on a Network and the Processes on it, and keeps
+// a log of what it did.
+type Nemesis struct {
+	net    *Network
+	procs  Processes
+	logger *logging.Logger
+
+	mu     sync.Mutex
+	start  time.Time
+	killed map[string]bool
+	paused map[string]bool
+	log    []string
+}
+
+// Option configures a Nemesis.
+type Option func(*Nemesis)
+
+// WithLogger logs each action to l, at level info, as well as keeping it.
+func WithLogger(l *logging.Logger) Option {
+	return func(n *Nemesis) {
+		n.logger = l
+	}
+}
+
+// New returns a nemesis for the cluster on net, which kills and restarts
+// nodes through procs (which may be nil if the schedule doesn't).
+func New(net *Network, procs Processes, opts ...Option) *Nemesis {
+	n := &Nemesis{
+		net:    net,
+		procs:  procs,
+		logger: logging.Discard(),
+		start:  time.Now(),
+		killed: make(map[string]bool),
+		paused: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.logger = n.logger.With("component", "nemesis")
+	return n
+}
+
+// Do inflicts a, now.
+func (n *Nemesis) Do(a Action) {
+	n.mu.Lock()
+	n.log = append(n.log, fmt.Sprintf("%v %v", time.Since(n.start).Round(time.Millisecond), a))
+	n.mu.Unlock()
+	n.logger.Info("acting", "action", a.String())
+	a.do(n)
+}
+
+// Run inflicts each action in s at its time, counted from now, and
+// returns when it has done the last, or when ctx ends.
+func (n *Nemesis) Run(ctx context.Context, s Schedule) error {
+	start := time.Now()
+	for _, e := range s {
+		if d := time.Until(start.Add(e.At)); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		n.Do(e.Action)
+	}
+	return nil
+}
+
+// Recover undoes every fault still in place: it heals the network, stops
+// mistreating messages, resumes what is paused and restarts what is dead.
+func (n *Nemesis) Recover() {
+	n.Do(Heal())
+	n.Do(SetFaults(Faults{}))
+	n.mu.Lock()
+	var paused, killed []string
+	for name := range n.paused {
+		paused = append(paused, name)
+	}
+	for name := range n.killed {
+		killed = append(killed, name)
+	}
+	n.mu.Unlock()
+	sort.Strings(paused)
+	sort.Strings(killed)
+	for _, name := range paused {
+		n.Do(Resume(name))
+	}
+	for _, name := range killed {
+		n.Do(Restart(name))
+	}
+}
+
+// Log returns what the nemesis has done, one action per line, each with
+// how long after the nemesis was made it was done.
+func (n *Nemesis) Log() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return strings.Join(n.log, "\n")
+}
+
+// An Action is a fault, or the undoing of one, that a Nemesis inflicts.
+type Action interface {
+	fmt.Stringer
+	do(n *Nemesis)
+}
+
+type action struct {
+	desc string
+	f    func(n *Nemesis)
+}
+
+func (a action) String() string { return a.desc }
+func (a action) do(n *Nemesis)  { a.f(n) }
+
+// Partition splits the network into groups, as Network.Partition does.
+func Partition(groups ...[]string) Action {
+	var sides []string
+	for _, g := range groups {
+		sides = append(sides, strings.Join(g, " "))
+	}
+	return action{"partition [" + strings.Join(sides, "] [") + "] from the rest", func(n *Nemesis) {
+		n.net.Partition(groups...)
+	}}
+}
+
+// Heal undoes any partition.
+func Heal() Action {
+	return action{"heal", func(n *Nemesis) {
+		n.net.Heal()
+	}}
+}
+
+// SetFaults has the network mistreat messages as f says.
+func SetFaults(f Faults) Action {
+	return action{"faults: " + f.String(), func(n *Nemesis) {
+		n.net.SetFaults(f)
+	}}
+}
+
+// Pause freezes a node, as Network.Pause does.
+func Pause(name string) Action {
+	return action{"pause " + name, func(n *Nemesis) {
+		n.mu.Lock()
+		n.paused[name] = true
+		n.mu.Unlock()
+		n.net.Pause(name)
+	}}
+}
+
+// Resume lets a paused node carry on.
+func Resume(name string) Action {
+	return action{"resume " + name, func(n *Nemesis) {
+		n.mu.Lock()
+		delete(n.paused, name)
+		n.mu.Unlock()
+		n.net.Resume(name)
+	}}
+}
+
+// Kill crashes a node.
+func Kill(name string) Action {
+	return action{"kill " + name, func(n *Nemesis) {
+		n.mu.Lock()
+		n.killed[name] = true
+		n.mu.Unlock()
+		n.procs.Kill(name)
+	}}
+}
+
+// Restart brings a killed node back, without its state.
+func Restart(name string) Action {
+	return action{"restart " + name, func(n *Nemesis) {
+		n.mu.Lock()
+		delete(n.killed, name)
+		n.mu.Unlock()
+		n.procs.Restart(name)
+	}}
+}
+
+// Event is an action, and when to inflict it.
+type Event struct {
+	At     time.Duration // after the schedule starts
+	Action Action
+}
+
+// Schedule is a list of events, in order of time.
+type Schedule []Event
+
+func (s Schedule) String() string {
+	var b strings.Builder
+	for _, e := range s {
+		fmt.Fprintf(&b, "%v %v\n", e.At, e.Action)
+	}
+	return b.String()
+}
+
+// Plan says what faults a random schedule may have.
+type Plan struct {
+	Nodes    []string      // that may be partitioned off, up to half at a time
+	Pausable []string      // that may be paused and resumed
+	Killable []string      // that may be killed and restarted
+	Faults   Faults        // to mistreat messages with, now and then
+	Interval time.Duration // that each fault lasts, and then the calm after it
+}
+
+// Random returns a schedule of faults, chosen with seed, that lasts for
+// d: each of them in turn is inflicted, lasts for p.Interval, and is
+// undone, and the cluster then has p.Interval to recover before the
+// next.
+//
+// For a primary-backup service to survive, Interval must be long enough
+// for a new view to form, and a new backup to catch up, after a server is
+// killed; and no fault may take out the primary and its backups at once,
+// as the viewservice sees it. Cutting off two of three servers can do
+// that, and so can cutting off, or pausing, the viewservice itself; so
+// can pausing a backup, since the primary waits for it, and stops
+// pinging, while it forwards an update.
+func Random(seed int64, p Plan, d time.Duration) Schedule {
+	rr := rand.New(rand.NewSource(seed))
+	pick := func(names []string) string {
+		return names[rr.Intn(len(names))]
+	}
+	var kinds []func() (Action, Action)
+	if len(p.Nodes) > 1 {
+		kinds = append(kinds, func() (Action, Action) {
+			// cut off up to half the nodes from the rest
+			nodes := append([]string(nil), p.Nodes...)
+			rr.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+			cut := nodes[:1+rr.Intn(len(nodes)/2)]
+			sort.Strings(cut)
+			return Partition(cut), Heal()
+		})
+	}
+	if len(p.Pausable) > 0 {
+		kinds = append(kinds, func() (Action, Action) {
+			name := pick(p.Pausable)
+			return Pause(name), Resume(name)
+		})
+	}
+	if len(p.Killable) > 0 {
+		kinds = append(kinds, func() (Action, Action) {
+			name := pick(p.Killable)
+			return Kill(name), Restart(name)
+		})
+	}
+	if p.Faults != (Faults{}) {
+		kinds = append(kinds, func() (Action, Action) {
+			return SetFaults(p.Faults), SetFaults(Faults{})
+		})
+	}
+	var s Schedule
+	if len(kinds) == 0 || p.Interval <= 0 {
+		return s
+	}
+	for at := p.Interval; at+p.Interval <= d; at += 2 * p.Interval {
+		fault, undo := kinds[rr.Intn(len(kinds))]()
+		s = append(s, Event{at, fault}, Event{at + p.Interval, undo})
+	}
+	return s
+}
@@ -0,0 +1,316 @@
+package nemesis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"usc.edu/csci499/proj2/linearizability"
+)
+
+// Counter is an RPC service that counts the requests it handles.
+type Counter struct {
+	mu sync.Mutex
+	n  int
+}
+
+type AddArgs struct {
+	N int
+}
+
+type AddReply struct {
+	Total int
+}
+
+func (c *Counter) Add(args *AddArgs, reply *AddReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += args.N
+	reply.Total = c.n
+	return nil
+}
+
+func (c *Counter) total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestNetwork(t *testing.T) {
+	fmt.Printf("Test: Nemesis network ...\n")
+
+	net := NewNetwork(1)
+	counter := &Counter{}
+	closer, err := net.Node("b").Serve("b", counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := net.Node("a")
+	add := func() bool {
+		var reply AddReply
+		return a.Call("b", "Counter.Add", &AddArgs{1}, &reply)
+	}
+
+	if !add() || counter.total() != 1 {
+		t.Fatalf("an RPC on a healthy network failed")
+	}
+	if a.Call("c", "Counter.Add", &AddArgs{1}, &AddReply{}) {
+		t.Fatalf("an RPC to a node that isn't serving succeeded")
+	}
+
+	net.Partition([]string{"a"})
+	if add() {
+		t.Fatalf("an RPC across a partition succeeded")
+	}
+	net.Partition([]string{"a", "b"}, []string{"c"})
+	if !add() {
+		t.Fatalf("an RPC within one side of a partition failed")
+	}
+	net.Heal()
+
+	net.SetFaults(Faults{Drop: 1})
+	for i := 0; i < 10; i++ {
+		if add() {
+			t.Fatalf("an RPC succeeded with every message dropped")
+		}
+	}
+	before := counter.total()
+	net.SetFaults(Faults{Duplicate: 1})
+	add()
+	for i := 0; counter.total() != before+2; i++ {
+		if i == 100 {
+			t.Fatalf("a duplicated request was handled %v times", counter.total()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	net.SetFaults(Faults{Delay: 50 * time.Millisecond})
+	start := time.Now()
+	add()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("an RPC took %v, with each way delayed 50ms", elapsed)
+	}
+	net.SetFaults(Faults{})
+
+	// a paused server handles nothing until it resumes, and its clock
+	// stands still
+	net.Pause("b")
+	done := make(chan bool)
+	go func() { done <- add() }()
+	slept := make(chan struct{})
+	go func() {
+		net.Node("b").Clock().Sleep(context.Background(), time.Millisecond)
+		close(slept)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("a paused node handled an RPC")
+	case <-slept:
+		t.Fatalf("a paused node's sleep ended")
+	case <-time.After(200 * time.Millisecond):
+	}
+	net.Resume("b")
+	if !<-done {
+		t.Fatalf("an RPC to a resumed node failed")
+	}
+	<-slept
+
+	closer.Close()
+	if add() {
+		t.Fatalf("an RPC to a closed server succeeded")
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// procs records what a Nemesis kills and restarts.
+type procs struct {
+	mu  sync.Mutex
+	did []string
+}
+
+func (p *procs) Kill(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.did = append(p.did, "kill "+name)
+}
+
+func (p *procs) Restart(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.did = append(p.did, "restart "+name)
+}
+
+func TestSchedule(t *testing.T) {
+	fmt.Printf("Test: Nemesis schedules ...\n")
+
+	plan := Plan{
+		Nodes:    []string{"vs", "pb-0", "pb-1", "pb-2"},
+		Pausable: []string{"vs", "pb-0", "pb-1", "pb-2"},
+		Killable: []string{"pb-0", "pb-1", "pb-2"},
+		Faults:   Faults{Drop: 0.1, Duplicate: 0.1, Jitter: time.Millisecond},
+		Interval: time.Second,
+	}
+	s := Random(1, plan, time.Minute)
+	if len(s) != 2*30 {
+		t.Fatalf("a minute of one-second faults had %v events, expected %v", len(s), 2*30)
+	}
+	if again := Random(1, plan, time.Minute); again.String() != s.String() {
+		t.Fatalf("the same seed made schedules\n%v\nand\n%v", s, again)
+	}
+	if other := Random(2, plan, time.Minute); other.String() == s.String() {
+		t.Fatalf("seeds 1 and 2 made the same schedule")
+	}
+	seen := map[string]bool{}
+	for i, e := range s {
+		if i > 0 && e.At <= s[i-1].At {
+			t.Fatalf("schedule out of order:\n%v", s)
+		}
+		what := strings.Fields(e.Action.String())[0]
+		seen[what] = true
+		if i%2 == 1 {
+			undo := map[string]string{"partition": "heal", "pause": "resume", "kill": "restart", "faults:": "faults:"}
+			if was := strings.Fields(s[i-1].Action.String())[0]; undo[was] != what {
+				t.Fatalf("%v was followed by %v", s[i-1].Action, e.Action)
+			}
+		}
+	}
+	for _, what := range []string{"partition", "heal", "pause", "resume", "kill", "restart", "faults:"} {
+		if !seen[what] {
+			t.Fatalf("a minute of faults had no %v:\n%v", what, s)
+		}
+	}
+
+	// run a schedule, stopping part-way, and recover from it
+	net := NewNetwork(1)
+	p := &procs{}
+	n := New(net, p)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	err := n.Run(ctx, Schedule{
+		{0, Kill("pb-0")},
+		{50 * time.Millisecond, Pause("pb-1")},
+		{100 * time.Millisecond, Partition([]string{"vs"})},
+		{time.Hour, Heal()},
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Run() = %v, expected it to time out", err)
+	}
+	if net.connected("vs", "pb-0") {
+		t.Fatalf("the viewservice wasn't partitioned off")
+	}
+	n.Recover()
+	if !net.connected("vs", "pb-0") || net.Faults() != (Faults{}) {
+		t.Fatalf("Recover() left faults in place")
+	}
+	net.waitResumed("pb-1")
+	if got := strings.Join(p.did, ", "); got != "kill pb-0, restart pb-0" {
+		t.Fatalf("killed and restarted %v", got)
+	}
+	log := n.Log()
+	for _, want := range []string{"kill pb-0", "pause pb-1", "partition [vs] from the rest", "heal", "resume pb-1", "restart pb-0"} {
+		if !strings.Contains(log, want) {
+			t.Fatalf("the log lacks %q:\n%v", want, log)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// memKV is a key/value store in memory, which forgets appends if forgetful,
+// and holds up Gets until unblocked, if blocked isn't nil.
+type memKV struct {
+	mu        sync.Mutex
+	data      map[string]string
+	forgetful bool
+	blocked   chan struct{}
+}
+
+func (kv *memKV) Get(key string) string {
+	if kv.blocked != nil {
+		<-kv.blocked
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.data[key]
+}
+
+func (kv *memKV) Put(key string, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.data[key] = value
+}
+
+func (kv *memKV) Append(key string, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if !kv.forgetful {
+		kv.data[key] += value
+	}
+}
+
+func TestCluster(t *testing.T) {
+	fmt.Printf("Test: Nemesis clusters and workloads ...\n")
+
+	net := NewNetwork(1)
+	var mu sync.Mutex
+	running := map[string]int{} // how many of each server are running
+	c := NewCluster(net, func(name string, node *Node) func() {
+		mu.Lock()
+		defer mu.Unlock()
+		running[name]++
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			running[name]--
+		}
+	}, "pb-0", "pb-1")
+	counts := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Sprint(running)
+	}
+	if got := counts(); got != "map[pb-0:1 pb-1:1]" {
+		t.Fatalf("running %v after starting", got)
+	}
+	n := New(net, c)
+	n.Do(Kill("pb-0"))
+	n.Do(Kill("pb-0"))
+	if got := counts(); got != "map[pb-0:0 pb-1:1]" {
+		t.Fatalf("running %v after a kill", got)
+	}
+	n.Do(Restart("pb-1"))
+	n.Recover()
+	if got := counts(); got != "map[pb-0:1 pb-1:1]" {
+		t.Fatalf("running %v after recovering", got)
+	}
+	c.KillAll()
+	if got := counts(); got != "map[pb-0:0 pb-1:0]" {
+		t.Fatalf("running %v after killing them all", got)
+	}
+
+	if p := ServerPlan([]string{"pb-0"}, Faults{Drop: 0.5}, time.Second); len(p.Pausable) != 0 {
+		t.Fatalf("a plan for servers pauses %v", p.Pausable)
+	}
+
+	run := func(kv *memKV) ([]linearizability.Operation, error) {
+		kv.data = map[string]string{}
+		w := StartWorkload(net, 3, func(node *Node) linearizability.KV { return kv })
+		time.Sleep(100 * time.Millisecond)
+		return w.Stop(time.Second)
+	}
+	if ops, err := run(&memKV{}); err != nil || len(ops) < 10 {
+		t.Fatalf("a workload on a correct store made %v requests, and failed: %v", len(ops), err)
+	}
+	if _, err := run(&memKV{forgetful: true}); err == nil {
+		t.Fatalf("a workload on a store that forgets appends passed")
+	}
+	blocked := make(chan struct{})
+	defer close(blocked)
+	if _, err := run(&memKV{blocked: blocked}); err == nil || !strings.Contains(err.Error(), "didn't finish") {
+		t.Fatalf("a workload whose clients are stuck returned %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,268 @@
+package nemesis
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+
+	"usc.edu/csci499/proj2/clock"
+	"usc.edu/csci499/proj2/wire"
+)
+
+// Faults are what a Network does to the messages it carries.
+type Faults struct {
+	Drop      float64       // the chance of losing a request, or its reply
+	Duplicate float64       // the chance of delivering a request a second time, later
+	Delay     time.Duration // before each request, and each reply, arrives
+	Jitter    time.Duration // up to this much more, at random, so messages overtake each other
+}
+
+func (f Faults) String() string {
+	return fmt.Sprintf("drop %v, duplicate %v, delay %v+%v", f.Drop, f.Duplicate, f.Delay, f.Jitter)
+}
+
+// Network carries RPCs between the members of a cluster in one process,
+// in real time, and lets a test partition, pause and mistreat them. An RPC
+// is delivered by wire.Deliver, in the caller's goroutine.
+type Network struct {
+	mu      sync.Mutex
+	rand    *rand.Rand
+	servers map[string]*rpc.Server
+	faults  Faults
+	group   map[string]int           // a partitioned node's side; nil when whole
+	paused  map[string]chan struct{} // closed when the node resumes
+}
+
+// NewNetwork returns a network, without faults, whose random choices
+// follow from seed. Since messages race each other in real time, the
+// same seed doesn't make for the same run, as it does in package sim.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:    rand.New(rand.NewSource(seed)),
+		servers: make(map[string]*rpc.Server),
+		paused:  make(map[string]chan struct{}),
+	}
+}
+
+// SetFaults changes what the network does to messages from now on.
+func (n *Network) SetFaults(f Faults) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.faults = f
+}
+
+// Faults returns what the network is doing to messages.
+func (n *Network) Faults() Faults {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.faults
+}
+
+// Partition splits the network: nodes in different groups can't reach
+// each other, and the nodes in none of the groups make one more group. So
+// Partition([]string{"vs"}) cuts the viewservice off from everyone.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[string]int)
+	for i, nodes := range groups {
+		for _, name := range nodes {
+			n.group[name] = i + 1
+		}
+	}
+}
+
+// Heal undoes Partition.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = nil
+}
+
+// Pause freezes a node, as a long GC pause or a SIGSTOP would: it sends
+// nothing, what is sent to it waits, and, if it was started on the node's
+// Clock, its sleeps don't end, until it is resumed.
+func (n *Network) Pause(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.paused[name] == nil {
+		n.paused[name] = make(chan struct{})
+	}
+}
+
+// Resume lets a paused node carry on.
+func (n *Network) Resume(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c := n.paused[name]; c != nil {
+		close(c)
+		delete(n.paused, name)
+	}
+}
+
+// waitResumed waits until name isn't paused.
+func (n *Network) waitResumed(name string) {
+	for {
+		n.mu.Lock()
+		c := n.paused[name]
+		n.mu.Unlock()
+		if c == nil {
+			return
+		}
+		<-c
+	}
+}
+
+// connected reports whether a message from one node can reach another.
+func (n *Network) connected(from string, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.group[from] == n.group[to]
+}
+
+// delay returns how long the next message takes to arrive.
+func (n *Network) delay() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	d := n.faults.Delay
+	if n.faults.Jitter > 0 {
+		d += time.Duration(n.rand.Int63n(int64(n.faults.Jitter)))
+	}
+	return d
+}
+
+// chance returns true with probability p.
+func (n *Network) chance(p func(Faults) float64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rand.Float64() < p(n.faults)
+}
+
+// Node returns the member of the network called name, for a server to be
+// started on (it is a wire.Network) or a Clerk to send RPCs over.
+func (n *Network) Node(name string) *Node {
+	return &Node{network: n, name: name}
+}
+
+// Node is one member of a Network.
+type Node struct {
+	network *Network
+	name    string
+}
+
+// Serve makes rcvr's RPC methods callable at addr, until the returned
+// io.Closer is closed, as a server does when it is killed.
+func (node *Node) Serve(addr string, rcvr interface{}) (io.Closer, error) {
+	server := rpc.NewServer()
+	if err := server.Register(rcvr); err != nil {
+		return nil, err
+	}
+	n := node.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.servers[addr] != nil {
+		return nil, fmt.Errorf("nemesis: %v is already serving", addr)
+	}
+	n.servers[addr] = server
+	return closer(func() error {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.servers[addr] == server {
+			delete(n.servers, addr)
+		}
+		return nil
+	}), nil
+}
+
+type closer func() error
+
+func (c closer) Close() error { return c() }
+
+// Call sends an RPC from the node to srv, suffering the network's faults
+// on the way there and back.
+func (node *Node) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	n := node.network
+	n.waitResumed(node.name)
+	time.Sleep(n.delay())
+
+	n.mu.Lock()
+	server := n.servers[srv]
+	n.mu.Unlock()
+	if server == nil || !n.connected(node.name, srv) || n.chance(dropped) {
+		return false
+	}
+	n.waitResumed(srv)
+	if n.chance(duplicated) {
+		// the copy is handled later, and its reply goes nowhere. it's
+		// copied now, since the caller may reuse args once Call returns.
+		if dup, err := snapshot(args); err == nil {
+			go func() {
+				time.Sleep(n.delay())
+				n.waitResumed(srv)
+				wire.Deliver(server, rpcname, dup, nil)
+			}()
+		}
+	}
+	if n.chance(dropped) {
+		wire.Deliver(server, rpcname, args, nil)
+		return false
+	}
+	if err := wire.Deliver(server, rpcname, args, reply); err != nil {
+		return false
+	}
+
+	time.Sleep(n.delay())
+	if !n.connected(srv, node.name) {
+		return false
+	}
+	n.waitResumed(node.name)
+	return true
+}
+
+// snapshot returns a deep copy of args, through gob.
+func snapshot(args interface{}) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return nil, err
+	}
+	dup := reflect.New(reflect.TypeOf(args))
+	if err := gob.NewDecoder(&buf).Decode(dup.Interface()); err != nil {
+		return nil, err
+	}
+	return dup.Elem().Interface(), nil
+}
+
+func dropped(f Faults) float64    { return f.Drop }
+func duplicated(f Faults) float64 { return f.Duplicate }
+
+// Clock returns a clock for the node's server to run on, whose sleeps
+// last as long as the node is paused.
+func (node *Node) Clock() clock.Clock {
+	return nodeClock{node}
+}
+
+type nodeClock struct {
+	node *Node
+}
+
+func (c nodeClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c nodeClock) Sleep(ctx context.Context, d time.Duration) {
+	clock.Real.Sleep(ctx, d)
+	c.node.network.waitResumed(c.node.name)
+}
+
+func (c nodeClock) Go(f func()) {
+	go f()
+}
+
+var _ wire.Network = (*Node)(nil)
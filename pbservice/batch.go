@@ -0,0 +1,273 @@
+package pbservice
+
+import (
+	"context"
+	"sort"
+)
+
+// applyPuts applies a batch of Puts, in key order so that every server
+// numbers the updates the same way, and queues them for the learners.
+// the caller must hold pb.mu.
+func (pb *PBServer) applyPuts(puts map[string][]byte) {
+	keys := make([]string, 0, len(puts))
+	for key := range puts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		pb.apply("Put", key, puts[key])
+		pb.streamUpdate("Put", key, puts[key])
+	}
+}
+
+// server MultiGet() RPC handler.
+// like Get, but reads several keys at once.
+func (pb *PBServer) MultiGet(args *MultiGetArgs, reply *MultiGetReply) error {
+	span := pb.startHandler(args.Impl.Trace, "PBServer.MultiGet", "keys", len(args.Keys))
+	defer func() { endSpan(span, reply.Err) }()
+	pb.lock(span)
+	defer pb.mu.Unlock()
+
+	if expired(args.Impl.Deadline) {
+		reply.Err = ErrExpired
+		return nil
+	}
+
+	// check with the viewservice that we may still serve reads, as Get does
+	realView, err := pb.pingTraced(span)
+	if err != nil {
+		return err
+	}
+	if !pb.servesReads(realView) {
+		pb.log().Debug("rejected request", "rpc", "MultiGet", "client", args.Impl.ClientID, "err", ErrWrongServer, "primary", realView.Primary)
+		reply.Err = ErrWrongServer
+		reply.Impl.Hint = realView
+		return nil
+	}
+
+	reply.Values = make(map[string][]byte, len(args.Keys))
+	for _, key := range args.Keys {
+		value, exists := pb.impl.kvMap[key]
+		reply.Values[key] = value // shares the stored value, which is never changed
+		if !exists {
+			reply.Missing = append(reply.Missing, key)
+		}
+	}
+	reply.Err = OK
+	return nil
+}
+
+// server MultiPut() RPC handler.
+// like PutAppend with Put, but for several keys at once. the batch is
+// forwarded to the backups, and deduplicated, as one request.
+func (pb *PBServer) MultiPut(args *MultiPutArgs, reply *MultiPutReply) error {
+	span := pb.startHandler(args.Impl.Trace, "PBServer.MultiPut", "keys", len(args.Puts))
+	defer func() { endSpan(span, reply.Err) }()
+	pb.lock(span)
+	defer pb.mu.Unlock()
+
+	if pb.me != pb.impl.Primary {
+		pb.log().Debug("rejected request", "rpc", "MultiPut", "client", args.Impl.ClientID, "err", ErrWrongServer, "primary", pb.impl.Primary)
+		reply.Err = ErrWrongServer
+		reply.Impl.Hint = pb.view()
+		return nil
+	}
+
+	if expired(args.Impl.Deadline) {
+		reply.Err = ErrExpired
+		return nil
+	}
+
+	if pb.isDuplicate(args.Impl.ClientID, args.Impl.RequestID) {
+		reply.Err = OK
+		return nil
+	}
+
+	if targets := pb.forwardTargets(); len(targets) > 0 {
+		fwdArgs := &ForwardPutArgs{
+			ClientID:  args.Impl.ClientID,
+			RequestID: args.Impl.RequestID,
+			Done:      args.Impl.Done,
+			Applied:   pb.impl.Applied,
+			Operation: "MultiPut",
+			Puts:      args.Puts,
+		}
+		if err := pb.forwardTraced(span, targets, fwdArgs); err != OK {
+			reply.Err = err
+			reply.Impl.Hint = pb.view()
+			return nil
+		}
+	}
+
+	applying := span.Child("apply")
+	pb.applyPuts(args.Puts)
+	applying.End()
+	pb.recordRequest(args.Impl.ClientID, args.Impl.RequestID, args.Impl.Done)
+
+	reply.Err = OK
+	return nil
+}
+
+// MultiGet fetches the values of several keys from the primary in one
+// request; keys that have never been set map to "".
+// It keeps trying until the primary replies.
+func (ck *Clerk) MultiGet(keys []string) map[string]string {
+	values, _ := ck.MultiGetContext(context.Background(), keys) // never fails without a deadline
+	return values
+}
+
+// MultiGetContext is like MultiGet, but gives up when ctx is cancelled or
+// its deadline passes, returning a *RequestError.
+func (ck *Clerk) MultiGetContext(ctx context.Context, keys []string) (map[string]string, error) {
+	reply, err := ck.multiGetContext(ctx, keys)
+	return asStrings(reply.Values), err
+}
+
+// MultiLookupContext is like MultiGetContext, but leaves the keys that
+// don't exist out of the map, rather than mapping them to "".
+func (ck *Clerk) MultiLookupContext(ctx context.Context, keys []string) (map[string]string, error) {
+	reply, err := ck.multiGetContext(ctx, keys)
+	for _, key := range reply.Missing {
+		delete(reply.Values, key)
+	}
+	return asStrings(reply.Values), err
+}
+
+// asStrings converts the values of a batch, which travel as bytes, back to
+// strings; nil stays nil.
+func asStrings(values map[string][]byte) map[string]string {
+	if values == nil {
+		return nil
+	}
+	strs := make(map[string]string, len(values))
+	for key, value := range values {
+		strs[key] = string(value)
+	}
+	return strs
+}
+
+// asBytes converts the values of a batch to bytes, for the wire.
+func asBytes(values map[string]string) map[string][]byte {
+	data := make(map[string][]byte, len(values))
+	for key, value := range values {
+		data[key] = []byte(value)
+	}
+	return data
+}
+
+// multiGetContext does the work of MultiGetContext and MultiLookupContext,
+// returning the server's reply.
+func (ck *Clerk) multiGetContext(ctx context.Context, keys []string) (_ MultiGetReply, err error) {
+	requestID := ck.startRequest()
+	defer ck.finishRequest(requestID)
+
+	ctx, span := ck.impl.tracer.Start(ctx, "Clerk.MultiGet", "keys", len(keys), "client", ck.impl.clientID, "request", requestID)
+	defer func() { endRequest(span, err) }()
+
+	failures := 0 // attempts that have failed, for backing off
+	for {
+		if ctx.Err() != nil {
+			return MultiGetReply{}, ck.requestError(ctx, "MultiGet", "")
+		}
+
+		view, err := ck.knownView(ctx)
+		if err != nil {
+			return MultiGetReply{}, ck.requestError(ctx, "MultiGet", "")
+		}
+
+		args := MultiGetArgs{
+			Keys: keys,
+			Impl: GetArgsImpl{
+				ClientID:  ck.impl.clientID,
+				RequestID: requestID,
+			},
+		}
+		args.Impl.Deadline, _ = ctx.Deadline()
+
+		var reply MultiGetReply
+		attempt := startAttempt(ctx, "PBServer.MultiGet", reader(view))
+		args.Impl.Trace = attempt.Context()
+		ok := ck.call(ctx, reader(view), "PBServer.MultiGet", &args, &reply)
+		endAttempt(attempt, ok, &reply.Err)
+
+		if ok && reply.Err == OK {
+			if reply.Values == nil {
+				// gob leaves out an empty map
+				reply.Values = make(map[string][]byte)
+			}
+			return reply, nil
+		} else if !ok {
+			ck.forgetPrimary(view.Primary)
+		} else if reply.Err == ErrWrongServer {
+			if ck.followHint(view.Primary, reply.Impl.Hint) {
+				continue
+			}
+		}
+
+		failures++
+		ck.impl.clock.Sleep(ctx, ck.backoff(failures))
+	}
+}
+
+// MultiPut tells the primary to update the values of several keys,
+// as one request.
+func (ck *Clerk) MultiPut(puts map[string]string) {
+	ck.MultiPutContext(context.Background(), puts) // never fails without a deadline
+}
+
+// MultiPutContext is like MultiPut, but gives up when ctx is cancelled or its
+// deadline passes, returning a *RequestError. If it gives up, either all of
+// the Puts happened or none did.
+func (ck *Clerk) MultiPutContext(ctx context.Context, puts map[string]string) (err error) {
+	requestID := ck.startRequest()
+	defer ck.finishRequest(requestID)
+
+	ctx, span := ck.impl.tracer.Start(ctx, "Clerk.MultiPut", "keys", len(puts), "client", ck.impl.clientID, "request", requestID)
+	defer func() { endRequest(span, err) }()
+
+	data := asBytes(puts) // every codec carries bytes intact
+
+	failures := 0 // attempts that have failed, for backing off
+	for {
+		if ctx.Err() != nil {
+			return ck.requestError(ctx, "MultiPut", "")
+		}
+
+		view, err := ck.knownView(ctx)
+		if err != nil {
+			return ck.requestError(ctx, "MultiPut", "")
+		}
+		primary := view.Primary
+
+		args := MultiPutArgs{
+			Puts: data,
+			Impl: PutAppendArgsImpl{
+				ClientID:  ck.impl.clientID,
+				RequestID: requestID,
+				Operation: "MultiPut",
+				Done:      ck.doneThrough(),
+			},
+		}
+		args.Impl.Deadline, _ = ctx.Deadline()
+
+		var reply MultiPutReply
+		attempt := startAttempt(ctx, "PBServer.MultiPut", primary)
+		args.Impl.Trace = attempt.Context()
+		ok := ck.call(ctx, primary, "PBServer.MultiPut", &args, &reply)
+		endAttempt(attempt, ok, &reply.Err)
+
+		if ok && reply.Err == OK {
+			return nil
+		} else if !ok {
+			ck.forgetPrimary(primary)
+		} else if reply.Err == ErrWrongServer {
+			if ck.followHint(primary, reply.Impl.Hint) {
+				continue
+			}
+		}
+
+		failures++
+		ck.impl.clock.Sleep(ctx, ck.backoff(failures))
+	}
+}
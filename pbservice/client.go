@@ -4,9 +4,11 @@ import (
 	"crypto/rand"
 	"fmt"
 	"math/big"
-	"net/rpc"
 
+	"usc.edu/csci499/proj2/clock"
+	"usc.edu/csci499/proj2/trace"
 	"usc.edu/csci499/proj2/viewservice"
+	"usc.edu/csci499/proj2/wire"
 )
 
 type Clerk struct {
@@ -22,12 +24,73 @@ func nrand() int64 {
 	return x
 }
 
-func MakeClerk(vshost string, me string) *Clerk {
+// a ClerkOption configures a Clerk when it is made.
+type ClerkOption func(ck *Clerk)
+
+// WithClerkTracer traces the Clerk's requests with t: a span for each
+// request, with a span for each attempt at it and for each viewservice
+// lookup. The attempts' spans are sent along to the servers.
+func WithClerkTracer(t *trace.Tracer) ClerkOption {
+	return func(ck *Clerk) {
+		ck.impl.tracer = t
+	}
+}
+
+// WithClerkConfig sets how long the Clerk backs off between attempts at
+// a request, from c's retry backoffs, rather than from
+// viewservice.DefaultConfig(). NewClerk fails if c isn't valid.
+func WithClerkConfig(c viewservice.Config) ClerkOption {
+	return func(ck *Clerk) {
+		ck.impl.config = c
+	}
+}
+
+// WithClerkClock makes the Clerk wait between attempts on c, rather
+// than on clock.Real.
+func WithClerkClock(c clock.Clock) ClerkOption {
+	return func(ck *Clerk) {
+		ck.impl.clock = c
+	}
+}
+
+// WithClerkTransport sends the Clerk's RPCs, to the viewservice too,
+// over t. A request given up on by its context may still arrive.
+func WithClerkTransport(t wire.Transport) ClerkOption {
+	return func(ck *Clerk) {
+		ck.impl.transport = t
+	}
+}
+
+// MakeClerk is like NewClerk, but panics if the options are invalid.
+func MakeClerk(vshost string, me string, opts ...ClerkOption) *Clerk {
+	ck, err := NewClerk(vshost, me, opts...)
+	if err != nil {
+		panic("pbservice: MakeClerk: " + err.Error())
+	}
+	return ck
+}
+
+// NewClerk returns a Clerk of the service whose viewservice is vshost,
+// or an error, before contacting anything, if the options are invalid.
+func NewClerk(vshost string, me string, opts ...ClerkOption) (*Clerk, error) {
 	ck := new(Clerk)
-	ck.vs = viewservice.MakeClerk(me, vshost)
+	for _, opt := range opts {
+		opt(ck)
+	}
+	if ck.impl.config == (viewservice.Config{}) {
+		ck.impl.config = viewservice.DefaultConfig()
+	}
+	if err := ck.impl.config.Validate(); err != nil {
+		return nil, err
+	}
+	if ck.impl.transport != nil {
+		ck.vs = viewservice.MakeClerk(me, vshost, viewservice.WithClerkTransport(ck.impl.transport))
+	} else {
+		ck.vs = viewservice.MakeClerk(me, vshost)
+	}
 	ck.initImpl()
 
-	return ck
+	return ck, nil
 }
 
 //
@@ -46,7 +109,7 @@ func MakeClerk(vshost string, me string) *Clerk {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	c, errx := wire.Dial("unix", srv)
 	if errx != nil {
 		return false
 	}
@@ -1,42 +1,267 @@
 package pbservice
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
+
+	"usc.edu/csci499/proj2/clock"
+	"usc.edu/csci499/proj2/trace"
+	"usc.edu/csci499/proj2/viewservice"
+	"usc.edu/csci499/proj2/wire"
 )
 
 // ClerkImpl contains metadata about the client and the view of the distributed system.
+// A Clerk may be used by many goroutines at once; mu guards everything below it.
 type ClerkImpl struct {
-	clientID  int64  // Unique identifier for the client. This helps differentiate requests from different clients.
-	requestID int64  // Identifier for each request made by the client. This aids in ensuring at-most-once semantics.
-	primary   string // The current primary server's address known to the client.
-	viewnum   uint   // The current view number known to the client, indicating the configuration version.
+	mu          sync.Mutex
+	clientID    int64              // Unique identifier for the client. This helps differentiate requests from different clients.
+	requestID   int64              // Identifier for the client's next request. IDs increase, and a request keeps its ID across retries, for at-most-once semantics.
+	outstanding map[int64]bool     // Requests the client has started but not finished.
+	primary     string             // The current primary server's address known to the client, or "" to ask the viewservice.
+	view        viewservice.View   // The latest view fetched from the viewservice, indicating the configuration version.
+	conns       connPool           // Connections shared by concurrent requests.
+	tracer      *trace.Tracer      // Traces requests, if not nil.
+	config      viewservice.Config // How long to back off between attempts.
+	clock       clock.Clock        // What the Clerk waits on between attempts.
+	transport   wire.Transport     // Carries the Clerk's RPCs, or nil to dial Unix sockets, sharing connections.
+}
+
+// Reasons a Clerk's context-aware methods give up on a request;
+// test for them with errors.Is.
+var (
+	ErrTimeout       = errors.New("request timed out")
+	ErrNoPrimary     = errors.New("no primary")
+	ErrCancelled     = errors.New("request cancelled")
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// RequestError describes a request that a Clerk gave up on.
+type RequestError struct {
+	Op     string // "Get", "Put", "Append", "Delete", "CompareAndSwap", "MultiGet" and so on
+	Key    string // "" for MultiGet and MultiPut
+	Reason error  // ErrTimeout, ErrNoPrimary, ErrCancelled or ErrValueTooLarge
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("pbservice: %v(%q): %v", e.Op, e.Key, e.Reason)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Reason
+}
+
+// requestError explains why ctx ended the request: cancellation, or its
+// deadline passing, blamed on the viewservice if it had no primary to offer.
+func (ck *Clerk) requestError(ctx context.Context, op string, key string) error {
+	// the view, rather than the primary, which is forgotten whenever it
+	// fails to answer
+	ck.impl.mu.Lock()
+	offered := ck.impl.view.Primary
+	ck.impl.mu.Unlock()
+
+	reason := ErrTimeout
+	if ctx.Err() == context.Canceled {
+		reason = ErrCancelled
+	} else if offered == "" {
+		reason = ErrNoPrimary
+	}
+	return &RequestError{Op: op, Key: key, Reason: reason}
+}
+
+// backoff returns how long to wait before the next attempt at a request
+// whose last failures attempts have failed.
+func (ck *Clerk) backoff(failures int) time.Duration {
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	return ck.impl.config.Backoff(failures)
+}
+
+// SetConfig changes how long the Clerk backs off between attempts at a
+// request, if c is valid; requests already under way use it from their
+// next attempt.
+func (ck *Clerk) SetConfig(c viewservice.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	ck.impl.config = c
+	return nil
 }
 
 // initImpl initializes the ClerkImpl, setting a unique clientID and resetting other values.
+// It runs after the ClerkOptions, and fills in defaults for what they left unset.
 func (ck *Clerk) initImpl() {
-	// Initialize the primary by fetching from the viewservice.
-	ck.impl.primary = ck.vs.Primary()
-	// Get the full view to initialize the viewnum.
-	view, ok := ck.vs.Get()
-	if ok {
-		ck.impl.viewnum = view.Viewnum
-	} else {
-		ck.impl.viewnum = 0
+	if ck.impl.clock == nil {
+		ck.impl.clock = clock.Real
 	}
+	// Initialize the primary and view by fetching from the viewservice.
+	ck.fetchPrimary(context.Background())
 	ck.impl.clientID = nrand() // Assign a unique ID to this client.
 	ck.impl.requestID = 1      // Initialize the request counter.
+	ck.impl.outstanding = make(map[int64]bool)
+}
+
+// fetchPrimary queries the viewservice to get the latest primary server's address and view,
+// giving up when ctx ends, in which case it returns ctx.Err() and leaves the view alone.
+// The caller must not hold ck.impl.mu: the viewservice may be slow to answer, and the
+// Clerk's other requests shouldn't wait for it.
+func (ck *Clerk) fetchPrimary(ctx context.Context) error {
+	// Directly call the GetContext() method on the viewservice's Clerk.
+	view, err := ck.vs.GetContext(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	if ck.impl.primary != "" && ck.impl.view.Viewnum > view.Viewnum {
+		// another request learned of a newer view meanwhile, from a server's hint
+		return nil
+	}
+	if err == nil {
+		ck.impl.view = view
+	} else if ck.impl.primary == "" {
+		ck.impl.view = viewservice.View{}
+	}
+	ck.impl.primary = ck.impl.view.Primary
+	return nil
 }
 
-// fetchPrimary queries the viewservice to get the latest primary server's address and view number.
-func (ck *Clerk) fetchPrimary() {
-	// Directly call the Primary() and Get() methods on the viewservice's Clerk.
-	ck.impl.primary = ck.vs.Primary()
-	view, ok := ck.vs.Get()
-	if ok {
-		ck.impl.viewnum = view.Viewnum
+// knownView returns the view the client knows about, first asking the
+// viewservice if the client doesn't know of a primary. it fails only if
+// ctx ends while it waits for the viewservice.
+func (ck *Clerk) knownView(ctx context.Context) (viewservice.View, error) {
+	ck.impl.mu.Lock()
+	view, primary := ck.impl.view, ck.impl.primary
+	ck.impl.mu.Unlock()
+	if primary != "" {
+		return view, nil
+	}
+
+	// If the client doesn't know the current primary, fetch it from the viewservice.
+	span := trace.FromContext(ctx).Child("viewservice.Get")
+	span.SetKind(trace.Client)
+	err := ck.fetchPrimary(ctx)
+
+	ck.impl.mu.Lock()
+	view = ck.impl.view
+	ck.impl.mu.Unlock()
+	if err != nil {
+		span.SetError(err)
+	}
+	span.SetAttributes("viewnum", view.Viewnum, "primary", view.Primary)
+	span.End()
+	if err != nil {
+		return viewservice.View{}, err
+	}
+	return view, nil
+}
+
+// startAttempt starts the span of one attempt at the request traced in
+// ctx: an RPC to srv.
+func startAttempt(ctx context.Context, rpcname string, srv string) *trace.Span {
+	span := trace.FromContext(ctx).Child(rpcname, "server", srv)
+	span.SetKind(trace.Client)
+	return span
+}
+
+// endAttempt ends the span of an attempt, with the server's answer, which
+// is only looked at if there was one.
+func endAttempt(span *trace.Span, ok bool, err *Err) {
+	if !ok {
+		span.SetError("no reply")
 	} else {
-		ck.impl.viewnum = 0
+		span.SetAttributes("reply", *err)
+	}
+	span.End()
+}
+
+// endRequest ends the span of a request, with the error it failed with, if any.
+func endRequest(span *trace.Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// knownPrimary returns the primary the client knows about, or "" if it
+// will have to ask the viewservice.
+func (ck *Clerk) knownPrimary() string {
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	return ck.impl.primary
+}
+
+// forgetPrimary clears the client's knowledge of primary, so that it asks the
+// viewservice again, unless another request has already done so.
+func (ck *Clerk) forgetPrimary(primary string) {
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	if ck.impl.primary == primary {
+		ck.impl.primary = ""
+	}
+}
+
+// followHint switches the client to the view a server that wasn't the right
+// one to ask told it about. if the hint is no newer than what the client
+// already knows, it forgets primary, and so asks the viewservice instead.
+// returns whether the client followed the hint.
+func (ck *Clerk) followHint(primary string, hint viewservice.View) bool {
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	if hint.Viewnum > ck.impl.view.Viewnum && hint.Primary != "" {
+		ck.impl.view = hint
+		ck.impl.primary = hint.Primary
+		return true
+	}
+	if ck.impl.primary == primary {
+		ck.impl.primary = ""
+	}
+	return false
+}
+
+// reader returns where to send Gets in view: the primary,
+// or the tail of the chain in chain replication mode.
+func reader(view viewservice.View) string {
+	if view.Chain {
+		return view.Tail()
 	}
+	return view.Primary
+}
+
+// startRequest assigns the next request ID and notes the request as outstanding.
+func (ck *Clerk) startRequest() int64 {
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	id := ck.impl.requestID
+	ck.impl.requestID++
+	ck.impl.outstanding[id] = true
+	return id
+}
+
+// finishRequest notes that the client won't retry request id any more.
+func (ck *Clerk) finishRequest(id int64) {
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	delete(ck.impl.outstanding, id)
+}
+
+// doneThrough returns the ID such that the client has finished every
+// request up to and including it, so servers can forget about them.
+func (ck *Clerk) doneThrough() int64 {
+	ck.impl.mu.Lock()
+	defer ck.impl.mu.Unlock()
+	done := ck.impl.requestID - 1
+	for id := range ck.impl.outstanding {
+		if id <= done {
+			done = id - 1
+		}
+	}
+	return done
 }
 
 // fetch a key's value from the current primary;
@@ -48,84 +273,361 @@ func (ck *Clerk) fetchPrimary() {
 // Get fetches the value associated with the given key from the primary server.
 // It keeps trying until it succeeds or the primary indicates the key doesn't exist.
 func (ck *Clerk) Get(key string) string {
+	value, _ := ck.GetContext(context.Background(), key) // never fails without a deadline
+	return value
+}
+
+// GetContext is like Get, but gives up when ctx is cancelled or its deadline
+// passes, returning a *RequestError. The deadline is also sent to the primary,
+// which abandons the request if it only gets to it after the deadline.
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
+	reply, err := ck.getContext(ctx, key)
+	return string(reply.Impl.Data), err
+}
+
+// getContext does the work of GetContext and GetBytesContext, returning the
+// primary's reply. the value is in reply.Impl.Data: it travels as bytes,
+// which every codec carries intact, whereas JSON strings can only hold UTF-8.
+func (ck *Clerk) getContext(ctx context.Context, key string) (_ GetReply, err error) {
+	requestID := ck.startRequest()
+	defer ck.finishRequest(requestID)
+
+	ctx, span := ck.impl.tracer.Start(ctx, "Clerk.Get", "key", key, "client", ck.impl.clientID, "request", requestID)
+	defer func() { endRequest(span, err) }()
+
+	failures := 0 // attempts that have failed, for backing off
 	for {
-		// If the client doesn't know the current primary, fetch it from the viewservice.
-		if ck.impl.primary == "" {
-			ck.fetchPrimary()
+		if ctx.Err() != nil {
+			return GetReply{}, ck.requestError(ctx, "Get", key)
 		}
 
 		// keep note of current primary
-		currPrimary := ck.impl.primary
+		view, err := ck.knownView(ctx)
+		if err != nil {
+			return GetReply{}, ck.requestError(ctx, "Get", key)
+		}
+		currPrimary := view.Primary
 
 		// Prepare the GetArgs with necessary metadata.
 		args := GetArgs{
 			Key: key,
 			Impl: GetArgsImpl{
 				ClientID:  ck.impl.clientID,
-				RequestID: nrand(),
+				RequestID: requestID,
+				Bytes:     true,
 			},
 		}
+		args.Impl.Deadline, _ = ctx.Deadline()
 
 		var reply GetReply
-		// Send a Get RPC to the known primary.
-		ok := call(ck.impl.primary, "PBServer.Get", &args, &reply)
+		// Send a Get RPC to the known primary (or tail).
+		attempt := startAttempt(ctx, "PBServer.Get", reader(view))
+		args.Impl.Trace = attempt.Context()
+		ok := ck.call(ctx, reader(view), "PBServer.Get", &args, &reply)
+		endAttempt(attempt, ok, &reply.Err)
 
 		// GRACES CHANGES TO ACCOUNT FOR OLD PRIMARY TRYING TO ISSUE GET()
 		// Check if the primary has changed since the last fetch.
-		if ck.impl.primary != "" && ck.impl.primary != currPrimary {
-			// Primary has changed, clear the knowledge of the old primary and retry.
-			ck.impl.primary = ""
-			continue // Retry the request with the new primary.
+		// (another request may have learned of the new primary meanwhile.)
+		if primary := ck.knownPrimary(); primary != "" && primary != currPrimary {
+			// Primary has changed, so retry with the new primary.
+			continue
 		}
 
-		// If RPC was successful and the primary returned a valid response, increment the request counter and return.
+		// If RPC was successful and the primary returned a valid response, return.
 		if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-			ck.impl.requestID++
-			return reply.Value //if ErrNoKey, the reply.Value is empty string
-		} else if !ok || reply.Err == ErrWrongServer {
-			// If there was an issue or the primary has changed, clear the known primary.
-			ck.impl.primary = ""
+			return reply, nil //if ErrNoKey, the reply.Value is empty string
+		} else if !ok {
+			// If there was an issue, clear the known primary.
+			ck.forgetPrimary(currPrimary)
+		} else if reply.Err == ErrWrongServer {
+			// the primary has changed; go straight where the server says, if it knows better
+			if ck.followHint(currPrimary, reply.Impl.Hint) {
+				continue
+			}
 		}
 
 		// Introduce a short delay before retrying.
-		time.Sleep(100 * time.Millisecond)
+		failures++
+		ck.impl.clock.Sleep(ctx, ck.backoff(failures))
 	}
 }
 
 // PutAppend sends a Put or Append RPC to the primary server.
 // It keeps trying until the operation succeeds.
 func (ck *Clerk) PutAppend(key string, value string, op string) {
+	ck.putAppendContext(context.Background(), key, value, nil, op) // never fails without a deadline
+}
+
+// PutContext is like Put, but gives up when ctx is cancelled or its deadline
+// passes, returning a *RequestError. If it gives up, the Put may or may not
+// have happened.
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) error {
+	return ck.putAppendContext(ctx, key, value, nil, "Put")
+}
+
+// AppendContext is like Append, but gives up when ctx is cancelled or its
+// deadline passes, returning a *RequestError. If it gives up, the Append may
+// or may not have happened.
+func (ck *Clerk) AppendContext(ctx context.Context, key string, value string) error {
+	return ck.putAppendContext(ctx, key, value, nil, "Append")
+}
+
+// GetBytes is like Get, for binary values. The value arrives as bytes,
+// so it isn't copied once more into a string.
+func (ck *Clerk) GetBytes(key string) []byte {
+	value, _ := ck.GetBytesContext(context.Background(), key) // never fails without a deadline
+	return value
+}
+
+// GetBytesContext is like GetContext, for binary values.
+func (ck *Clerk) GetBytesContext(ctx context.Context, key string) ([]byte, error) {
+	reply, err := ck.getContext(ctx, key)
+	return reply.Impl.Data, err
+}
+
+// PutBytes is like Put, for binary values. The caller must not modify
+// value until PutBytes returns.
+func (ck *Clerk) PutBytes(key string, value []byte) {
+	ck.PutBytesContext(context.Background(), key, value) // never fails without a deadline
+}
+
+// PutBytesContext is like PutContext, for binary values.
+func (ck *Clerk) PutBytesContext(ctx context.Context, key string, value []byte) error {
+	return ck.putAppendContext(ctx, key, "", value, "Put")
+}
+
+// AppendBytes is like Append, for binary values. The caller must not modify
+// value until AppendBytes returns.
+func (ck *Clerk) AppendBytes(key string, value []byte) {
+	ck.AppendBytesContext(context.Background(), key, value) // never fails without a deadline
+}
+
+// AppendBytesContext is like AppendContext, for binary values.
+func (ck *Clerk) AppendBytesContext(ctx context.Context, key string, value []byte) error {
+	return ck.putAppendContext(ctx, key, "", value, "Append")
+}
+
+// Delete tells the primary to remove key, so that Get returns "" for it.
+func (ck *Clerk) Delete(key string) {
+	ck.DeleteContext(context.Background(), key) // never fails without a deadline
+}
+
+// DeleteContext is like Delete, but gives up when ctx is cancelled or its
+// deadline passes, returning a *RequestError. If it gives up, the Delete
+// may or may not have happened.
+func (ck *Clerk) DeleteContext(ctx context.Context, key string) error {
+	return ck.putAppendContext(ctx, key, "", nil, "Delete")
+}
+
+// LookupContext is like GetContext, but also reports whether the key
+// exists, rather than returning "" for a key that doesn't.
+func (ck *Clerk) LookupContext(ctx context.Context, key string) (value string, exists bool, err error) {
+	reply, err := ck.getContext(ctx, key)
+	return string(reply.Impl.Data), err == nil && reply.Err == OK, err
+}
+
+// View returns the current view, fresh from the viewservice,
+// and false if the viewservice could not be reached.
+func (ck *Clerk) View() (viewservice.View, bool) {
+	return ck.vs.Get()
+}
+
+// CompareAndSwapContext sets key to value, but only if key's value is
+// still old; it reports whether it did. It gives up, returning a
+// *RequestError, when ctx is cancelled or its deadline passes, in which
+// case the swap may or may not have happened.
+func (ck *Clerk) CompareAndSwapContext(ctx context.Context, key string, old string, value string) (bool, error) {
+	reply, err := ck.updateContext(ctx, key, value, nil, "CompareAndSwap", old)
+	return reply == OK, err
+}
+
+// CompareAndDeleteContext is like CompareAndSwapContext, but removes
+// key if its value is still old.
+func (ck *Clerk) CompareAndDeleteContext(ctx context.Context, key string, old string) (bool, error) {
+	reply, err := ck.updateContext(ctx, key, "", nil, "CompareAndDelete", old)
+	return reply == OK, err
+}
+
+// putAppendContext does the work of the Put and Append methods. if data
+// is not empty, it is sent as the value instead of value.
+func (ck *Clerk) putAppendContext(ctx context.Context, key string, value string, data []byte, op string) error {
+	_, err := ck.updateContext(ctx, key, value, data, op, "")
+	return err
+}
+
+// updateContext sends an update to the primary until it is done, returning
+// the primary's answer: OK, or ErrMismatch if a compare-and-swap (with
+// expect as the value to compare) didn't go ahead.
+func (ck *Clerk) updateContext(ctx context.Context, key string, value string, data []byte, op string, expect string) (_ Err, err error) {
+	// the request keeps its ID across retries, so the primary can tell
+	// a retry of a request it already applied from a new one.
+	requestID := ck.startRequest()
+	defer ck.finishRequest(requestID)
+
+	ctx, span := ck.impl.tracer.Start(ctx, "Clerk."+op, "key", key, "client", ck.impl.clientID, "request", requestID)
+	defer func() { endRequest(span, err) }()
+
+	// the value travels as bytes, which every codec carries intact, whereas
+	// JSON strings can only hold UTF-8. one too large for one message is
+	// uploaded ahead of the request.
+	if data == nil {
+		data = []byte(value)
+	}
+	if len(data) > maxUploadSize {
+		return "", &RequestError{Op: op, Key: key, Reason: ErrValueTooLarge}
+	}
+	large := len(data) > chunkSize
+
+	failures := 0 // attempts that have failed, for backing off
 	for {
+		if ctx.Err() != nil {
+			return "", ck.requestError(ctx, op, key)
+		}
+
 		// If the client doesn't know the current primary, fetch it from the viewservice.
-		if ck.impl.primary == "" {
-			ck.fetchPrimary()
+		view, err := ck.knownView(ctx)
+		if err != nil {
+			return "", ck.requestError(ctx, op, key)
+		}
+		primary := view.Primary
+
+		if large {
+			uploading := trace.FromContext(ctx).Child("upload", "server", primary, "bytes", len(data))
+			reply, ok := ck.upload(ctx, primary, requestID, data)
+			endAttempt(uploading, ok, &reply.Err)
+			if !ok {
+				ck.forgetPrimary(primary)
+			} else if reply.Err == ErrWrongServer && ck.followHint(primary, reply.Hint) {
+				continue
+			}
+			if !ok || reply.Err != OK {
+				failures++
+				ck.impl.clock.Sleep(ctx, ck.backoff(failures))
+				continue
+			}
 		}
 
 		// Prepare the PutAppendArgs with necessary metadata and operation details.
 		args := PutAppendArgs{
-			Key:   key,
-			Value: value,
+			Key: key,
 			Impl: PutAppendArgsImpl{
 				ClientID:  ck.impl.clientID,
-				RequestID: nrand(),
+				RequestID: requestID,
 				Operation: op,
+				Done:      ck.doneThrough(),
+				Data:      data,
+				Expect:    []byte(expect),
 			},
 		}
+		if large {
+			args.Impl.Data = nil
+			args.Impl.Uploaded = len(data)
+		}
+		args.Impl.Deadline, _ = ctx.Deadline()
 
 		var reply PutAppendReply
 		// Send a Put or Append RPC to the known primary.
-		ok := call(ck.impl.primary, "PBServer.PutAppend", &args, &reply)
+		attempt := startAttempt(ctx, "PBServer.PutAppend", primary)
+		args.Impl.Trace = attempt.Context()
+		ok := ck.call(ctx, primary, "PBServer.PutAppend", &args, &reply)
+		endAttempt(attempt, ok, &reply.Err)
+
+		// If RPC was successful and the operation was completed by the primary, return.
+		if ok && (reply.Err == OK || reply.Err == ErrMismatch) {
+			return reply.Err, nil
+		} else if !ok {
+			// If there was an issue, clear the known primary.
+			ck.forgetPrimary(primary)
+		} else if reply.Err == ErrWrongServer {
+			// the primary has changed; go straight where the server says, if it knows better
+			if ck.followHint(primary, reply.Impl.Hint) {
+				continue
+			}
+		}
+
+		// Introduce a short delay before retrying.
+		failures++
+		ck.impl.clock.Sleep(ctx, ck.backoff(failures))
+	}
+}
 
-		// If RPC was successful and the operation was completed by the primary, increment the request counter and return.
-		if ok && reply.Err == OK {
-			ck.impl.requestID++
-			return
-		} else if !ok || reply.Err == ErrWrongServer {
-			// If there was an issue or the primary has changed, clear the known primary.
-			ck.impl.primary = ""
+// StaleRead is the result of GetStale(): the value of a key as of the
+// given view and number of applied updates on the server that read it.
+type StaleRead struct {
+	Value   string
+	Viewnum uint
+	Applied uint64
+}
+
+// GetStale fetches a key's value from a learner or a backup, as long as it
+// has heard from the primary within maxStaleness, falling back to the primary
+// (or the tail of a chain). It keeps trying until some server replies with
+// the value or says the key doesn't exist.
+func (ck *Clerk) GetStale(key string, maxStaleness time.Duration) StaleRead {
+	r, _ := ck.GetStaleContext(context.Background(), key, maxStaleness) // never fails without a deadline
+	return r
+}
+
+// GetStaleContext is like GetStale, but gives up when ctx is cancelled or
+// its deadline passes, returning a *RequestError.
+func (ck *Clerk) GetStaleContext(ctx context.Context, key string, maxStaleness time.Duration) (_ StaleRead, err error) {
+	ctx, span := ck.impl.tracer.Start(ctx, "Clerk.GetStale", "key", key, "client", ck.impl.clientID)
+	defer func() { endRequest(span, err) }()
+
+	failures := 0 // attempts that have failed, for backing off
+	for {
+		if ctx.Err() != nil {
+			return StaleRead{}, ck.requestError(ctx, "GetStale", key)
+		}
+
+		// If the client doesn't know the current primary, fetch it from the viewservice.
+		view, err := ck.knownView(ctx)
+		if err != nil {
+			return StaleRead{}, ck.requestError(ctx, "GetStale", key)
+		}
+
+		args := GetStaleArgs{
+			Key:          key,
+			MaxStaleness: maxStaleness,
+		}
+		args.Deadline, _ = ctx.Deadline()
+
+		// offload reads to the learners first, then the backups, spreading
+		// them out by starting at a random one of each. only then try the
+		// server that serves up-to-date reads.
+		servers := []string{}
+		for _, group := range [][]string{view.Learners, view.Backups} {
+			if n := len(group); n > 0 {
+				start := int(nrand() % int64(n))
+				for i := 0; i < n; i++ {
+					if srv := group[(start+i)%n]; srv != reader(view) {
+						servers = append(servers, srv)
+					}
+				}
+			}
+		}
+		servers = append(servers, reader(view))
+
+		for _, srv := range servers {
+			var reply GetStaleReply
+			attempt := startAttempt(ctx, "PBServer.GetStale", srv)
+			ok := ck.call(ctx, srv, "PBServer.GetStale", &args, &reply)
+			endAttempt(attempt, ok, &reply.Err)
+			if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+				return StaleRead{
+					Value:   string(reply.Value), //if ErrNoKey, the reply.Value is empty
+					Viewnum: reply.Viewnum,
+					Applied: reply.Applied,
+				}, nil
+			}
 		}
 
+		// nobody could serve the read, so the view has probably changed.
+		ck.forgetPrimary(view.Primary)
+
 		// Introduce a short delay before retrying.
-		time.Sleep(100 * time.Millisecond)
+		failures++
+		ck.impl.clock.Sleep(ctx, ck.backoff(failures))
 	}
 }
@@ -0,0 +1,40 @@
+package pbservice
+
+import (
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+// Config returns the server's timing.
+func (pb *PBServer) Config() viewservice.Config {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return pb.impl.config
+}
+
+// SetConfig changes the server's timing while it runs, if c is valid.
+// it takes effect at the next ping, which tells the viewservice.
+func (pb *PBServer) SetConfig(c viewservice.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.impl.config = c
+	pb.log().Info("timing changed", "ping_interval", c.PingInterval, "dead_pings", c.DeadPings)
+	return nil
+}
+
+// checkConfig compares the viewservice's timing, from a ping's reply,
+// with ours, and warns when they stop agreeing. the caller must hold pb.mu.
+func (pb *PBServer) checkConfig(theirs viewservice.Config) {
+	if theirs == (viewservice.Config{}) {
+		return // a viewservice that doesn't say
+	}
+	agrees := theirs.Agrees(pb.impl.config)
+	if !agrees && pb.impl.configAgrees {
+		pb.log().Warn("viewservice's timing disagrees",
+			"ping_interval", pb.impl.config.PingInterval, "dead_pings", pb.impl.config.DeadPings,
+			"vs_ping_interval", theirs.PingInterval, "vs_dead_pings", theirs.DeadPings)
+	}
+	pb.impl.configAgrees = agrees
+}
@@ -0,0 +1,162 @@
+package pbservice
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// the database's digest is a two-level hash tree: keys are hashed into
+// buckets, each bucket's digest is the XOR of the hashes of its entries
+// (so that it can be kept up to date as updates are applied), and the
+// root is the hash of the bucket digests. servers with the same root
+// (almost certainly) have the same database, and otherwise the buckets
+// whose digests differ are the ones to repair.
+const digestBuckets = 256
+
+type digest [digestBuckets]uint64
+
+// bucketOf returns the bucket that key belongs to.
+func bucketOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % digestBuckets)
+}
+
+// entryHash returns the hash of one key and its value.
+func entryHash(key string, value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write(value)
+	return h.Sum64()
+}
+
+// set updates the digest for key's value changing from old (if it existed)
+// to value.
+func (d *digest) set(key string, old []byte, existed bool, value []byte) {
+	b := bucketOf(key)
+	if existed {
+		d[b] ^= entryHash(key, old)
+	}
+	d[b] ^= entryHash(key, value)
+}
+
+// remove updates the digest for key, with the given value, being deleted.
+func (d *digest) remove(key string, value []byte) {
+	d[bucketOf(key)] ^= entryHash(key, value)
+}
+
+// root returns the hash of the bucket digests.
+func (d *digest) root() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, bucket := range d {
+		binary.LittleEndian.PutUint64(buf[:], bucket)
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// digestOf computes the digest of a whole database.
+func digestOf(kvMap map[string][]byte) digest {
+	var d digest
+	for key, value := range kvMap {
+		d.set(key, nil, false, value)
+	}
+	return d
+}
+
+// repair sends backup the contents of every bucket whose digest differs
+// from ours, a few buckets per message. the caller must hold pb.mu.
+func (pb *PBServer) repair(backup string, viewnum uint, theirs []uint64) (Err, int) {
+	if len(theirs) != digestBuckets {
+		return ErrNotSynced, 0
+	}
+	differ := make(map[int]bool)
+	for b := range pb.impl.digest {
+		if pb.impl.digest[b] != theirs[b] {
+			differ[b] = true
+		}
+	}
+	pb.log().Warn("backup diverged; repairing", "backup", backup, "buckets", len(differ), "of", digestBuckets)
+
+	// gather up the entries of each differing bucket, in order of key
+	keys := make(map[int][]string)
+	for key := range pb.impl.kvMap {
+		if b := bucketOf(key); differ[b] {
+			keys[b] = append(keys[b], key)
+		}
+	}
+	buckets := make([]int, 0, len(differ))
+	for b := range differ {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+
+	args := &RepairArgs{Viewnum: viewnum, Applied: pb.impl.Applied, Buckets: make(map[int]map[string][]byte)}
+	size := 0
+	for i, b := range buckets {
+		entries := make(map[string][]byte, len(keys[b]))
+		for _, key := range keys[b] {
+			entries[key] = pb.impl.kvMap[key]
+			size += len(key) + len(entries[key])
+		}
+		args.Buckets[b] = entries
+
+		// a bucket is never split, so a message may be longer than a chunk
+		if size >= chunkSize || i == len(buckets)-1 {
+			if i == len(buckets)-1 {
+				args.Last = true
+				args.Root = pb.impl.digest.root()
+			}
+			var reply RepairReply
+			if !pb.call(backup, "PBServer.Repair", args, &reply) {
+				return ErrWrongServer, 0
+			}
+			if reply.Err != OK {
+				return reply.Err, 0
+			}
+			args = &RepairArgs{Viewnum: viewnum, Applied: pb.impl.Applied, Buckets: make(map[int]map[string][]byte)}
+			size = 0
+		}
+	}
+	return OK, len(buckets)
+}
+
+// RPC Handler for the Repair RPC.
+// replaces the contents of some of the backup's buckets with the primary's.
+func (pb *PBServer) Repair(args *RepairArgs, reply *RepairReply) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if !pb.isBackup() {
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	if pb.impl.SyncedView != args.Viewnum || pb.impl.Applied != args.Applied {
+		reply.Err = ErrNotSynced
+		return nil
+	}
+
+	for key, value := range pb.impl.kvMap {
+		if _, repaired := args.Buckets[bucketOf(key)]; repaired {
+			pb.impl.digest.remove(key, value)
+			delete(pb.impl.kvMap, key)
+		}
+	}
+	for _, entries := range args.Buckets {
+		for key, value := range entries {
+			pb.impl.kvMap[key] = value
+			pb.impl.digest.set(key, nil, false, value)
+		}
+	}
+
+	// after the last message, the whole database should match
+	if args.Last && pb.impl.digest.root() != args.Root {
+		reply.Err = ErrChecksum
+		return nil
+	}
+	reply.Err = OK
+	return nil
+}
@@ -0,0 +1,41 @@
+package pbservice
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+// Handler returns the handler for the server's HTTP endpoints, for
+// serving them somewhere other than WithHTTPAddr's address.
+func (pb *PBServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", pb.impl.metrics.registry)
+	mux.Handle("/loglevel", logging.LevelHandler(pb.impl.logger))
+	mux.HandleFunc("/status", pb.serveStatus)
+	mux.Handle("/config", viewservice.ConfigHandler(pb.Config, pb.SetConfig))
+	return mux
+}
+
+// HTTPAddr returns the address the server serves HTTP on, or "" if
+// it wasn't started WithHTTPAddr.
+func (pb *PBServer) HTTPAddr() string {
+	if pb.impl.httpListener == nil {
+		return ""
+	}
+	return pb.impl.httpListener.Addr().String()
+}
+
+// startHTTP starts serving HTTP at pb.impl.httpAddr, until the server is killed.
+func (pb *PBServer) startHTTP() {
+	l, e := net.Listen("tcp", pb.impl.httpAddr)
+	if e != nil {
+		log.Fatal("listen error: ", e)
+	}
+	pb.impl.httpListener = l
+	pb.impl.httpServer = &http.Server{Handler: pb.Handler()}
+	go pb.impl.httpServer.Serve(l)
+}
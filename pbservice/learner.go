@@ -0,0 +1,179 @@
+package pbservice
+
+import (
+	"sort"
+)
+
+// the most updates the primary will queue up for a learner; past that,
+// it drops them and sends the learner a fresh copy of the database instead.
+const maxLearnerBacklog = 1000
+
+// the primary's side of the asynchronous update stream to one learner.
+type learnerStream struct {
+	pending      []LearnUpdate // updates not yet sent, in order
+	needSnapshot bool          // whether the learner may have missed updates, and so needs the whole database
+	busy         bool          // whether a goroutine is sending to the learner
+}
+
+// isLearner reports whether this server is acting as a learner, i.e. it asked
+// to be one and the viewservice has not made it primary or backup instead.
+func (pb *PBServer) isLearner() bool {
+	return pb.impl.learner && !pb.view().IsMember(pb.me)
+}
+
+// streamUpdate queues an update the primary just applied for every learner.
+// the caller must hold pb.mu.
+func (pb *PBServer) streamUpdate(op string, key string, value []byte) {
+	update := LearnUpdate{
+		Seq:       pb.impl.Applied,
+		Operation: op,
+		Key:       key,
+		Value:     value,
+	}
+	for _, learner := range pb.streamNames() {
+		stream := pb.impl.streams[learner]
+		if stream.needSnapshot {
+			continue
+		}
+		if len(stream.pending) >= maxLearnerBacklog {
+			// the learner is too far behind, catch it up with a snapshot instead
+			stream.pending = nil
+			stream.needSnapshot = true
+			continue
+		}
+		stream.pending = append(stream.pending, update)
+		pb.wakeStream(learner, stream)
+	}
+}
+
+// feedLearners brings the primary's streams in line with the learners the
+// viewservice knows about, and wakes each stream up so that learners with
+// nothing new hear from the primary anyway. the caller must hold pb.mu.
+func (pb *PBServer) feedLearners() {
+	live := make(map[string]bool)
+	for _, learner := range pb.impl.Learners {
+		live[learner] = true
+		if _, exists := pb.impl.streams[learner]; !exists {
+			// a new learner (or a learner of a new primary) starts from a snapshot
+			pb.impl.streams[learner] = &learnerStream{needSnapshot: true}
+		}
+	}
+
+	for _, learner := range pb.streamNames() {
+		if !live[learner] {
+			delete(pb.impl.streams, learner)
+			continue
+		}
+		pb.wakeStream(learner, pb.impl.streams[learner])
+	}
+}
+
+// streamNames returns the learners the primary has streams to, in order, so
+// that they are woken in the same order every time. the caller must hold pb.mu.
+func (pb *PBServer) streamNames() []string {
+	learners := make([]string, 0, len(pb.impl.streams))
+	for learner := range pb.impl.streams {
+		learners = append(learners, learner)
+	}
+	sort.Strings(learners)
+	return learners
+}
+
+// wakeStream starts a goroutine sending to a learner, unless one is
+// already. the caller must hold pb.mu.
+func (pb *PBServer) wakeStream(learner string, stream *learnerStream) {
+	if !stream.busy {
+		stream.busy = true
+		pb.impl.clock.Go(func() { pb.sendToLearner(learner, stream) })
+	}
+}
+
+// sendToLearner sends a learner whatever it is missing until it is caught up.
+// it does not hold pb.mu while an RPC is in flight, so learners never slow
+// down the primary's writes.
+func (pb *PBServer) sendToLearner(learner string, stream *learnerStream) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	for {
+		args := &LearnArgs{
+			Viewnum: pb.impl.Viewnum,
+			Updates: stream.pending,
+		}
+		if stream.needSnapshot {
+			args.Snapshot = make(map[string][]byte, len(pb.impl.kvMap))
+			for k, v := range pb.impl.kvMap {
+				args.Snapshot[k] = v
+			}
+			args.HasSnapshot = true
+			args.Applied = pb.impl.Applied
+			args.Updates = nil
+			stream.needSnapshot = false
+		}
+		stream.pending = nil
+
+		pb.mu.Unlock()
+		var reply LearnReply
+		ok := pb.call(learner, "PBServer.Learn", args, &reply)
+		pb.mu.Lock()
+
+		if !ok || reply.Err != OK {
+			// we can't tell what the learner got, so start over with a snapshot
+			stream.pending = nil
+			stream.needSnapshot = true
+			break
+		}
+		if len(stream.pending) == 0 && !stream.needSnapshot {
+			break
+		}
+	}
+
+	stream.busy = false
+}
+
+// RPC Handler for the Learn RPC.
+// a learner installs the snapshot, if there is one, and then applies the
+// updates it has not seen yet, in order.
+func (pb *PBServer) Learn(args *LearnArgs, reply *LearnReply) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if !pb.isLearner() {
+		reply.Err = ErrWrongServer
+		return nil
+	}
+
+	if args.HasSnapshot {
+		// never go back to the state of an older primary
+		if args.Viewnum < pb.impl.LearnedView {
+			reply.Err = ErrWrongServer
+			return nil
+		}
+		if args.Snapshot == nil {
+			args.Snapshot = make(map[string][]byte)
+		}
+		pb.impl.kvMap = args.Snapshot
+		pb.impl.digest = digestOf(args.Snapshot)
+		pb.impl.Applied = args.Applied
+		pb.impl.LearnedView = args.Viewnum
+	} else if args.Viewnum != pb.impl.LearnedView {
+		// updates are numbered by the primary that sent the last snapshot
+		reply.Err = ErrNeedSnapshot
+		return nil
+	}
+
+	for _, update := range args.Updates {
+		if update.Seq <= pb.impl.Applied {
+			continue // already have it
+		}
+		if update.Seq != pb.impl.Applied+1 {
+			reply.Err = ErrNeedSnapshot
+			return nil
+		}
+		pb.apply(update.Operation, update.Key, update.Value)
+	}
+
+	pb.impl.LastSync = pb.impl.clock.Now()
+	reply.Err = OK
+	return nil
+}
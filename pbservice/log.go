@@ -0,0 +1,39 @@
+package pbservice
+
+import "usc.edu/csci499/proj2/logging"
+
+// role returns the server's role in its current view.
+func (pb *PBServer) role() string {
+	switch {
+	case pb.me == pb.impl.Primary:
+		return "primary"
+	case pb.isBackup():
+		return "backup"
+	case pb.impl.learner:
+		return "learner"
+	}
+	return "idle"
+}
+
+// a logger with a server's role and view as fields, made once per view
+// rather than for every message.
+type viewLogger struct {
+	*logging.Logger
+	role    string
+	viewnum uint
+}
+
+// log returns the server's logger, with its role and view as fields.
+// the caller must hold pb.mu.
+func (pb *PBServer) log() *logging.Logger {
+	role := pb.role()
+	if l := pb.impl.viewLogger; l.Logger == nil || l.role != role || l.viewnum != pb.impl.Viewnum {
+		pb.impl.viewLogger = viewLogger{pb.impl.logger.With("role", role, "viewnum", pb.impl.Viewnum), role, pb.impl.Viewnum}
+	}
+	return pb.impl.viewLogger.Logger
+}
+
+// Logger returns the server's logger, for changing its level.
+func (pb *PBServer) Logger() *logging.Logger {
+	return pb.impl.logger
+}
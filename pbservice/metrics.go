@@ -0,0 +1,103 @@
+package pbservice
+
+import (
+	"math"
+	"time"
+
+	"usc.edu/csci499/proj2/metrics"
+)
+
+// the metrics a server keeps, served at /metrics.
+type serverMetrics struct {
+	registry         *metrics.Registry
+	calls            *metrics.CounterVec
+	failed           *metrics.CounterVec
+	latency          *metrics.HistogramVec
+	viewnum          *metrics.Gauge
+	role             *metrics.GaugeVec
+	applied          *metrics.Gauge
+	lag              *metrics.Gauge
+	syncedBackups    *metrics.Gauge
+	transferBytes    *metrics.CounterVec
+	transferDuration *metrics.Histogram
+	dedupHits        *metrics.Counter
+	diverged         *metrics.Counter
+	repaired         *metrics.Counter
+}
+
+// the roles a server can have, as the role gauge shows them.
+var roles = []string{"primary", "backup", "learner", "idle"}
+
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	return &serverMetrics{
+		registry:         r,
+		calls:            r.NewCounterVec("pbservice_rpc_requests_total", "RPCs served, by method.", "method"),
+		failed:           r.NewCounterVec("pbservice_rpc_failures_total", "RPCs whose handler returned an error, by method.", "method"),
+		latency:          r.NewHistogramVec("pbservice_rpc_duration_seconds", "How long RPCs took to serve, by method.", nil, "method"),
+		viewnum:          r.NewGauge("pbservice_view_number", "The view the server is in."),
+		role:             r.NewGaugeVec("pbservice_role", "1 for the server's role in its view, 0 for the others.", "role"),
+		applied:          r.NewGauge("pbservice_applied_updates", "How many updates the server has applied."),
+		lag:              r.NewGauge("pbservice_replication_lag_seconds", "On a backup, how long since the primary last said it was up to date; +Inf if it hasn't in this view."),
+		syncedBackups:    r.NewGauge("pbservice_synced_backups", "On the primary, how many backups have the database in this view."),
+		transferBytes:    r.NewCounterVec("pbservice_state_transfer_bytes_total", "Bytes of keys and values sent or received in state transfers.", "direction"),
+		transferDuration: r.NewHistogram("pbservice_state_transfer_duration_seconds", "How long the primary took to send a backup the whole database.", nil),
+		dedupHits:        r.NewCounter("pbservice_dedup_hits_total", "Requests found to have been applied already."),
+		diverged:         r.NewCounter("pbservice_divergences_total", "On the primary, how many times a backup was found to differ from it."),
+		repaired:         r.NewCounter("pbservice_repaired_buckets_total", "On the primary, digest buckets sent to backups to repair them."),
+	}
+}
+
+// observe is a wire.Observer that counts and times RPCs.
+func (m *serverMetrics) observe(method string, elapsed time.Duration, failed bool) {
+	m.calls.With(method).Inc()
+	m.latency.With(method).Observe(elapsed.Seconds())
+	if failed {
+		m.failed.With(method).Inc()
+	}
+}
+
+// updateGauges brings the gauges up to date with the server's state.
+// the caller must hold pb.mu.
+func (pb *PBServer) updateGauges() {
+	m := pb.impl.metrics
+	m.viewnum.Set(float64(pb.impl.Viewnum))
+	m.applied.Set(float64(pb.impl.Applied))
+
+	role := pb.role()
+	for _, r := range roles {
+		if r == role {
+			m.role.With(r).Set(1)
+		} else {
+			m.role.With(r).Set(0)
+		}
+	}
+
+	lag := 0.0
+	if role == "backup" {
+		lag = math.Inf(1)
+		if pb.impl.SyncedView == pb.impl.Viewnum {
+			lag = pb.impl.clock.Now().Sub(pb.impl.LastSync).Seconds()
+		}
+	}
+	m.lag.Set(lag)
+
+	synced := 0
+	if role == "primary" {
+		for _, backup := range pb.impl.Backups {
+			if pb.impl.synced[backup] == pb.impl.Viewnum {
+				synced++
+			}
+		}
+	}
+	m.syncedBackups.Set(float64(synced))
+}
+
+// transferSize returns the bytes of keys and values in a state transfer chunk.
+func transferSize(pieces []TransferPiece) int {
+	size := 0
+	for _, piece := range pieces {
+		size += len(piece.Key) + len(piece.Data)
+	}
+	return size
+}
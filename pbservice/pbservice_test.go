@@ -1,12 +1,22 @@
 package pbservice
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,16 +24,29 @@ import (
 	"testing"
 	"time"
 
+	"usc.edu/csci499/proj2/linearizability"
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/nemesis"
+	"usc.edu/csci499/proj2/trace"
 	"usc.edu/csci499/proj2/viewservice"
+	"usc.edu/csci499/proj2/wire"
 )
 
-func check(t *testing.T, ck *Clerk, key string, value string) {
+func check(t *testing.T, ck linearizability.KV, key string, value string) {
 	v := ck.Get(key)
 	if v != value {
 		t.Fatalf("Get(%v) -> %v, expected %v", key, v, value)
 	}
 }
 
+// checkHistory fails the test if what the clerks were told, all told,
+// couldn't have come from a single copy of the data.
+func checkHistory(t *testing.T, h *linearizability.History) {
+	if err := linearizability.Check(h.Operations()); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func port(tag string, host int) string {
 	s := "/var/tmp/824-"
 	s += strconv.Itoa(os.Getuid()) + "/"
@@ -334,7 +357,8 @@ func TestPartition1(t *testing.T) {
 	time.Sleep(time.Second)
 	vck := viewservice.MakeClerk("", vshost)
 
-	ck1 := MakeClerk(vshost, "")
+	history := linearizability.NewHistory(nil)
+	ck1 := history.Client(MakeClerk(vshost, ""))
 
 	fmt.Printf("Test: Old primary does not serve Gets ...\n")
 
@@ -396,7 +420,7 @@ func TestPartition1(t *testing.T) {
 	time.Sleep(2 * viewservice.PingInterval)
 
 	// change the value (on s2) so it's no longer "1".
-	ck2 := MakeClerk(vshost, "")
+	ck2 := history.Client(MakeClerk(vshost, ""))
 	ck2.Put("a", "111")
 	check(t, ck2, "a", "111")
 
@@ -411,6 +435,7 @@ func TestPartition1(t *testing.T) {
 	}
 
 	check(t, ck2, "a", "111")
+	checkHistory(t, history)
 
 	fmt.Printf("  ... Passed\n")
 
@@ -430,7 +455,8 @@ func TestPartition2(t *testing.T) {
 	time.Sleep(time.Second)
 	vck := viewservice.MakeClerk("", vshost)
 
-	ck1 := MakeClerk(vshost, "")
+	history := linearizability.NewHistory(nil)
+	ck1 := history.Client(MakeClerk(vshost, ""))
 
 	vshosta := vshost + "a"
 	os.Link(vshost, vshosta)
@@ -499,7 +525,7 @@ func TestPartition2(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 
-	ck2 := MakeClerk(vshost, "")
+	ck2 := history.Client(MakeClerk(vshost, ""))
 	ck2.Put("a", "2")
 	check(t, ck2, "a", "2")
 
@@ -516,6 +542,7 @@ func TestPartition2(t *testing.T) {
 	}
 
 	check(t, ck2, "a", "2")
+	checkHistory(t, history)
 
 	fmt.Printf("  ... Passed\n")
 
@@ -541,6 +568,8 @@ func TestConcurrentSame(t *testing.T) {
 
 	fmt.Printf("Test: Concurrent Put()s to the same key ...\n")
 
+	history := linearizability.NewHistory(nil)
+
 	const nservers = 2
 	var sa [nservers]*PBServer
 	for i := 0; i < nservers; i++ {
@@ -565,7 +594,7 @@ func TestConcurrentSame(t *testing.T) {
 	const nkeys = 2
 	for xi := 0; xi < nclients; xi++ {
 		go func(i int) {
-			ck := MakeClerk(vshost, "")
+			ck := history.Client(MakeClerk(vshost, ""))
 			rr := rand.New(rand.NewSource(int64(os.Getpid() + i)))
 			for atomic.LoadInt32(&done) == 0 {
 				k := strconv.Itoa(rr.Int() % nkeys)
@@ -580,7 +609,7 @@ func TestConcurrentSame(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// read from primary
-	ck := MakeClerk(vshost, "")
+	ck := history.Client(MakeClerk(vshost, ""))
 	var vals [nkeys]string
 	for i := 0; i < nkeys; i++ {
 		vals[i] = ck.Get(strconv.Itoa(i))
@@ -616,6 +645,8 @@ func TestConcurrentSame(t *testing.T) {
 		}
 	}
 
+	checkHistory(t, history)
+
 	fmt.Printf("  ... Passed\n")
 
 	for i := 0; i < nservers; i++ {
@@ -664,6 +695,8 @@ func TestConcurrentSameAppend(t *testing.T) {
 
 	fmt.Printf("Test: Concurrent Append()s to the same key ...\n")
 
+	history := linearizability.NewHistory(nil)
+
 	const nservers = 2
 	var sa [nservers]*PBServer
 	for i := 0; i < nservers; i++ {
@@ -687,7 +720,7 @@ func TestConcurrentSameAppend(t *testing.T) {
 	ff := func(i int, ch chan int) {
 		ret := -1
 		defer func() { ch <- ret }()
-		ck := MakeClerk(vshost, "")
+		ck := history.Client(MakeClerk(vshost, ""))
 		n := 0
 		for n < 50 {
 			v := "x " + strconv.Itoa(i) + " " + strconv.Itoa(n) + " y"
@@ -715,7 +748,7 @@ func TestConcurrentSameAppend(t *testing.T) {
 		counts = append(counts, n)
 	}
 
-	ck := MakeClerk(vshost, "")
+	ck := history.Client(MakeClerk(vshost, ""))
 
 	// check that primary's copy of the value has all
 	// the Append()s.
@@ -750,6 +783,8 @@ func TestConcurrentSameAppend(t *testing.T) {
 		t.Fatal("primary and backup had different values")
 	}
 
+	checkHistory(t, history)
+
 	fmt.Printf("  ... Passed\n")
 
 	for i := 0; i < nservers; i++ {
@@ -824,6 +859,8 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 
 	fmt.Printf("Test: Concurrent Append()s to the same key; unreliable ...\n")
 
+	history := linearizability.NewHistory(nil)
+
 	const nservers = 2
 	var sa [nservers]*PBServer
 	for i := 0; i < nservers; i++ {
@@ -843,7 +880,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
 
 	{
-		ck := MakeClerk(vshost, "")
+		ck := history.Client(MakeClerk(vshost, ""))
 		ck.Put("0", "x")
 		ck.Put("1", "x")
 	}
@@ -859,7 +896,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 		go func(i int, ch chan bool) {
 			ok := false
 			defer func() { ch <- ok }()
-			ck := MakeClerk(vshost, "")
+			ck := history.Client(MakeClerk(vshost, ""))
 			rr := rand.New(rand.NewSource(int64(os.Getpid() + i)))
 			for atomic.LoadInt32(&done) == 0 {
 				k := strconv.Itoa(rr.Int() % nkeys)
@@ -881,7 +918,7 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 	}
 
 	// read from primary
-	ck := MakeClerk(vshost, "")
+	ck := history.Client(MakeClerk(vshost, ""))
 	var vals [nkeys]string
 	for i := 0; i < nkeys; i++ {
 		vals[i] = ck.Get(strconv.Itoa(i))
@@ -917,6 +954,8 @@ func TestConcurrentSameUnreliable(t *testing.T) {
 		}
 	}
 
+	checkHistory(t, history)
+
 	fmt.Printf("  ... Passed\n")
 
 	for i := 0; i < nservers; i++ {
@@ -939,6 +978,8 @@ func TestRepeatedCrash(t *testing.T) {
 
 	fmt.Printf("Test: Repeated failures/restarts ...\n")
 
+	history := linearizability.NewHistory(nil)
+
 	const nservers = 3
 	var sa [nservers]*PBServer
 	samu := sync.Mutex{}
@@ -987,7 +1028,7 @@ func TestRepeatedCrash(t *testing.T) {
 		go func(i int) {
 			ok := false
 			defer func() { cha[i] <- ok }()
-			ck := MakeClerk(vshost, "")
+			ck := history.Client(MakeClerk(vshost, ""))
 			data := map[string]string{}
 			rr := rand.New(rand.NewSource(int64(os.Getpid() + i)))
 			for atomic.LoadInt32(&done) == 0 {
@@ -1022,12 +1063,14 @@ func TestRepeatedCrash(t *testing.T) {
 		}
 	}
 
-	ck := MakeClerk(vshost, "")
+	ck := history.Client(MakeClerk(vshost, ""))
 	ck.Put("aaa", "bbb")
 	if v := ck.Get("aaa"); v != "bbb" {
 		t.Fatalf("final Put/Get failed")
 	}
 
+	checkHistory(t, history)
+
 	fmt.Printf("  ... Passed\n")
 
 	for i := 0; i < nservers; i++ {
@@ -1051,6 +1094,8 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 
 	fmt.Printf("Test: Repeated failures/restarts with concurrent updates to same key; unreliable ...\n")
 
+	history := linearizability.NewHistory(nil)
+
 	const nservers = 3
 	var sa [nservers]*PBServer
 	samu := sync.Mutex{}
@@ -1098,7 +1143,7 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 	ff := func(i int, ch chan int) {
 		ret := -1
 		defer func() { ch <- ret }()
-		ck := MakeClerk(vshost, "")
+		ck := history.Client(MakeClerk(vshost, ""))
 		n := 0
 		old_val := ""
 		for atomic.LoadInt32(&done) == 0 {
@@ -1139,7 +1184,7 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 		counts = append(counts, n)
 	}
 
-	ck := MakeClerk(vshost, "")
+	ck := history.Client(MakeClerk(vshost, ""))
 
 	checkAppends(t, ck.Get("0"), counts)
 
@@ -1148,6 +1193,8 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 		t.Fatalf("final Put/Get failed")
 	}
 
+	checkHistory(t, history)
+
 	fmt.Printf("  ... Passed\n")
 
 	for i := 0; i < nservers; i++ {
@@ -1159,3 +1206,1764 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 	vs.Kill()
 	time.Sleep(time.Second)
 }
+
+// with two backups per view, the service should survive
+// the primary and then the new primary failing, without
+// ever waiting for a new backup to catch up.
+func TestMultipleBackups(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "multi"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost, viewservice.WithBackups(2))
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Multiple backups ...\n")
+
+	const nservers = 3
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		sa[i] = StartServer(vshost, port(tag, i+1))
+		time.Sleep(viewservice.PingInterval * 2)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if len(view.Backups) == 2 {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view1, _ := vck.Get()
+	if len(view1.Backups) != 2 || view1.Backup != view1.Backups[0] {
+		t.Fatalf("view never got two backups: %v", view1)
+	}
+
+	// give p+b time to ack, initialize
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "aa")
+	ck.Append("a", "bb")
+	ck.Put("b", "cc")
+
+	// kill the primary, then the new primary; the last
+	// server standing must have every update.
+	b := "cc"
+	for round := 0; round < 2; round++ {
+		view, _ := vck.Get()
+		for i := 0; i < nservers; i++ {
+			if sa[i].me == view.Primary {
+				sa[i].kill()
+			}
+		}
+		for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+			v, _ := vck.Get()
+			if v.Primary != view.Primary && v.Primary != "" {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		check(t, ck, "a", "aabb")
+		check(t, ck, "b", b)
+		ck.Append("b", strconv.Itoa(round))
+		b += strconv.Itoa(round)
+	}
+	check(t, ck, "b", "cc01")
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill()
+	}
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+// in chain mode, writes go to the head, reads to the tail,
+// and the chain survives losing a middle server and the head.
+func TestChain(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "chain"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost, viewservice.WithBackups(2), viewservice.WithChain())
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Chain replication ...\n")
+
+	const nservers = 3
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		sa[i] = StartServer(vshost, port(tag, i+1))
+		time.Sleep(viewservice.PingInterval * 2)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if len(view.Backups) == 2 {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view1, _ := vck.Get()
+	if !view1.Chain || len(view1.Backups) != 2 {
+		t.Fatalf("chain never formed: %v", view1)
+	}
+
+	// give the chain time to ack, initialize
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "x")
+	ck.Append("a", "y")
+	check(t, ck, "a", "xy")
+
+	// the tail is a backup, but serves stale reads however fresh they must
+	// be, since it is where the clerk falls back to
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	r, err := ck.GetStaleContext(ctx, "a", 0)
+	cancel()
+	if err != nil || r.Value != "xy" {
+		t.Fatalf("GetStaleContext(a, 0) -> %q, %v; expected xy", r.Value, err)
+	}
+
+	// the head must not serve reads
+	args := &GetArgs{Key: "a", Impl: GetArgsImpl{ClientID: nrand(), RequestID: nrand()}}
+	var reply GetReply
+	call(view1.Primary, "PBServer.Get", args, &reply)
+	if reply.Err != ErrWrongServer {
+		t.Fatalf("head of the chain served a Get: %v", reply.Err)
+	}
+
+	// kill the middle of the chain
+	middle := view1.Backups[0]
+	for i := 0; i < nservers; i++ {
+		if sa[i].me == middle {
+			sa[i].kill()
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if !view.IsMember(middle) {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view2, _ := vck.Get()
+	if view2.Primary != view1.Primary || view2.Tail() != view1.Tail() {
+		t.Fatalf("chain not repaired in order: %v -> %v", view1, view2)
+	}
+	ck.Append("a", "z")
+	check(t, ck, "a", "xyz")
+
+	// kill the head
+	for i := 0; i < nservers; i++ {
+		if sa[i].me == view2.Primary {
+			sa[i].kill()
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != view2.Primary {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	check(t, ck, "a", "xyz")
+	ck.Append("a", "w")
+	check(t, ck, "a", "xyzw")
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill()
+	}
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestGetStale(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "stale"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Bounded-staleness reads from the backup ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(viewservice.PingInterval * 2)
+	s2 := StartServer(vshost, port(tag, 2))
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s1.me && view.Backup == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	// give p+b time to ack, initialize
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "1")
+	ck.Append("a", "2")
+
+	r := ck.GetStale("a", time.Second)
+	if r.Value != "12" {
+		t.Fatalf("GetStale(a) -> %v, expected 12", r.Value)
+	}
+	view, _ := vck.Get()
+	if r.Viewnum != view.Viewnum || r.Applied < 2 {
+		t.Fatalf("GetStale(a) reported view %v and %v applied updates", r.Viewnum, r.Applied)
+	}
+
+	// the backup refuses reads it can't vouch for
+	args := &GetStaleArgs{Key: "a", MaxStaleness: 0}
+	var reply GetStaleReply
+	call(s2.me, "PBServer.GetStale", args, &reply)
+	if reply.Err != ErrStale {
+		t.Fatalf("backup served a read with zero staleness allowed: %v", reply.Err)
+	}
+
+	// but the clerk then falls back to the primary
+	r = ck.GetStale("a", 0)
+	if r.Value != "12" {
+		t.Fatalf("GetStale(a) -> %v, expected 12", r.Value)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestLearner(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "learner"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Learners receive updates outside the view ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(viewservice.PingInterval * 2)
+	s2 := StartServer(vshost, port(tag, 2))
+	time.Sleep(viewservice.PingInterval * 2)
+	s3 := StartServer(vshost, port(tag, 3), AsLearner())
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Backup == s2.me && len(view.Learners) == 1 {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view1, _ := vck.Get()
+	if view1.Primary != s1.me || view1.Backup != s2.me || len(view1.Learners) != 1 || view1.Learners[0] != s3.me {
+		t.Fatalf("learner did not join: %v", view1)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	// the snapshot of an empty database is installed, too, rather than
+	// asked for again and again until the first write; gob may deliver it
+	// as a nil map
+	s3.mu.Lock()
+	learned, applied := s3.impl.LearnedView, s3.impl.Applied
+	s3.mu.Unlock()
+	if learned == 0 {
+		t.Fatalf("learner didn't take the snapshot of an empty database")
+	}
+	var lreply LearnReply
+	s3.Learn(&LearnArgs{Viewnum: learned + 1, HasSnapshot: true, Applied: applied}, &lreply)
+	s3.mu.Lock()
+	if lreply.Err != OK || s3.impl.LearnedView != learned+1 || s3.impl.kvMap == nil {
+		t.Fatalf("learner answered %v to an empty snapshot sent as nil", lreply.Err)
+	}
+	s3.impl.LearnedView = learned // back to the real primary's
+	s3.mu.Unlock()
+
+	ck := MakeClerk(vshost, "")
+	for i := 0; i < 20; i++ {
+		ck.Append("a", strconv.Itoa(i))
+	}
+	ck.Put("b", "bb")
+
+	// the learner catches up asynchronously
+	want := "012345678910111213141516171819"
+	var reply GetStaleReply
+	for iters := 0; iters < 20; iters++ {
+		args := &GetStaleArgs{Key: "a", MaxStaleness: time.Second}
+		reply = GetStaleReply{}
+		call(s3.me, "PBServer.GetStale", args, &reply)
+		if reply.Err == OK && string(reply.Value) == want {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if reply.Err != OK || string(reply.Value) != want {
+		t.Fatalf("learner has %q (%v), expected %v", reply.Value, reply.Err, want)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Learner stands in as backup ...\n")
+
+	s2.kill()
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Backup == s3.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view2, _ := vck.Get()
+	if view2.Backup != s3.me || len(view2.Learners) != 0 {
+		t.Fatalf("learner did not become backup: %v", view2)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	s1.kill()
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s3.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	check(t, ck, "a", want)
+	check(t, ck, "b", "bb")
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	s2.kill()
+	s3.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "ctx"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+
+	ck := MakeClerk(vshost, "")
+
+	fmt.Printf("Test: Context deadlines and cancellation ...\n")
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		_, err := ck.GetContext(ctx, "a")
+		cancel()
+		if !errors.Is(err, ErrNoPrimary) {
+			t.Fatalf("GetContext with no primary returned %v", err)
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			cancel()
+		}()
+		err = ck.PutContext(ctx, "a", "x")
+		if !errors.Is(err, ErrCancelled) {
+			t.Fatalf("cancelled PutContext returned %v", err)
+		}
+
+		// a viewservice that doesn't answer holds no request up past its
+		// deadline. the clerk's first Get fails, so it knows no primary,
+		// and the rest never return.
+		var gets int32
+		stuck := make(chan struct{})
+		defer close(stuck)
+		hung := MakeClerk(vshost, "", WithClerkTransport(wire.TransportFunc(
+			func(srv string, rpcname string, args interface{}, reply interface{}) bool {
+				if rpcname == "ViewServer.Get" {
+					if atomic.AddInt32(&gets, 1) > 1 {
+						<-stuck
+					}
+					return false
+				}
+				return call(srv, rpcname, args, reply)
+			})))
+		ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+		start := time.Now()
+		_, err = hung.GetContext(ctx, "a")
+		cancel()
+		if !errors.Is(err, ErrNoPrimary) || time.Since(start) > time.Second {
+			t.Fatalf("GetContext with a hung viewservice returned %v after %v", err, time.Since(start))
+		}
+		ctx, cancel = context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			cancel()
+		}()
+		start = time.Now()
+		err = hung.PutContext(ctx, "a", "x")
+		if !errors.Is(err, ErrCancelled) || time.Since(start) > time.Second {
+			t.Fatalf("cancelled PutContext with a hung viewservice returned %v after %v", err, time.Since(start))
+		}
+	}
+
+	s1 := StartServer(vshost, port(tag, 1))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := ck.PutContext(ctx, "a", "x"); err != nil {
+			t.Fatalf("PutContext failed: %v", err)
+		}
+		if err := ck.AppendContext(ctx, "a", "y"); err != nil {
+			t.Fatalf("AppendContext failed: %v", err)
+		}
+		v, err := ck.GetContext(ctx, "a")
+		cancel()
+		if err != nil || v != "xy" {
+			t.Fatalf("GetContext returned %v, %v; expected xy", v, err)
+		}
+
+		// the primary abandons requests that are already past their deadline
+		args := &PutAppendArgs{Key: "a", Value: "z", Impl: PutAppendArgsImpl{
+			ClientID: nrand(), RequestID: nrand(), Operation: "Append",
+			Deadline: time.Now().Add(-time.Second),
+		}}
+		var reply PutAppendReply
+		call(s1.me, "PBServer.PutAppend", args, &reply)
+		if reply.Err != ErrExpired {
+			t.Fatalf("expired PutAppend returned %v", reply.Err)
+		}
+		check(t, ck, "a", "xy")
+	}
+
+	{
+		// a request that waits on a hung viewservice holds up none of
+		// the shared clerk's others. the clerk's first Get reaches the
+		// primary, and the next fails, so the clerk asks the viewservice
+		// again, and never hears back.
+		var gets, pbGets int32
+		stuck := make(chan struct{})
+		defer close(stuck)
+		shared := MakeClerk(vshost, "", WithClerkTransport(wire.TransportFunc(
+			func(srv string, rpcname string, args interface{}, reply interface{}) bool {
+				switch {
+				case rpcname == "ViewServer.Get" && atomic.AddInt32(&gets, 1) > 1:
+					<-stuck
+					return false
+				case rpcname == "PBServer.Get" && atomic.AddInt32(&pbGets, 1) == 2:
+					return false
+				}
+				return call(srv, rpcname, args, reply)
+			})))
+		check(t, shared, "a", "xy")
+		go shared.Get("a")
+		for atomic.LoadInt32(&gets) < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		done := make(chan error)
+		go func() { done <- shared.SetConfig(viewservice.DefaultConfig()) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("SetConfig failed: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("a request waiting on the viewservice held up the clerk")
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+// slowPrimary answers each Get after as long as its key says.
+type slowPrimary struct{}
+
+func (p *slowPrimary) Get(args *GetArgs, reply *GetReply) error {
+	d, _ := time.ParseDuration(args.Key)
+	time.Sleep(d)
+	reply.Err = OK
+	reply.Impl.Data = []byte(args.Key)
+	return nil
+}
+
+// the reply to a request that gave up still arrives, over a connection
+// another request keeps open, and must not be written where the clerk
+// reads it. (run with -race.)
+func TestAbandonedReply(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Abandoned requests' replies ...\n")
+
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("PBServer", &slowPrimary{})
+	me := port("abandoned", 1)
+	os.Remove(me)
+	l, err := net.Listen("unix", me)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go wire.ServeConn(rpcs, conn)
+		}
+	}()
+
+	ck := MakeClerk(port("abandonedv", 1), "")
+	ck.impl.mu.Lock()
+	ck.impl.view = viewservice.View{Viewnum: 1, Primary: me}
+	ck.impl.primary = me
+	ck.impl.mu.Unlock()
+
+	// the slower request keeps the connection open, and so the faster,
+	// which gives up, shares it
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if v, err := ck.GetContext(ctx, "400ms"); err != nil || v != "400ms" {
+			t.Errorf("GetContext returned %q, %v", v, err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if _, err := ck.GetContext(ctx, "200ms"); !errors.Is(err, ErrTimeout) {
+				t.Errorf("GetContext past its deadline returned %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// many goroutines share one Clerk, with a backup taking over part-way.
+func TestConcurrentClerk(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "shared"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Concurrent requests through one Clerk ...\n")
+
+	history := linearizability.NewHistory(nil)
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	view1, _ := vck.Get()
+	if view1.Primary != s1.me || view1.Backup != s2.me {
+		t.Fatalf("wrong initial view %v", view1)
+	}
+
+	ck := history.Client(MakeClerk(vshost, ""))
+	ck.Put("k", "")
+
+	const nclients = 8
+	var done int32
+	counts := make([]int, nclients)
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; atomic.LoadInt32(&done) == 0; n++ {
+				ck.Append("k", "x "+strconv.Itoa(i)+" "+strconv.Itoa(n)+" y")
+				counts[i] = n + 1
+			}
+		}(i)
+	}
+
+	time.Sleep(time.Second)
+	s1.kill()
+	time.Sleep(deadtime * 2)
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+
+	checkAppends(t, ck.Get("k"), counts)
+
+	checkHistory(t, history)
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestRedirectHint(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "hint"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: ErrWrongServer replies carry the new view ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "x")
+
+	if _, err := vck.Handoff(); err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	time.Sleep(deadtime * 2)
+	if vck.Primary() != s2.me {
+		t.Fatalf("primary is %v after handoff, expected %v", vck.Primary(), s2.me)
+	}
+
+	// the old primary sends writers on to the new one
+	args := &PutAppendArgs{Key: "a", Value: "y", Impl: PutAppendArgsImpl{
+		ClientID: nrand(), RequestID: 1, Operation: "Append",
+	}}
+	var reply PutAppendReply
+	call(s1.me, "PBServer.PutAppend", args, &reply)
+	if reply.Err != ErrWrongServer || reply.Impl.Hint.Primary != s2.me {
+		t.Fatalf("old primary replied %v with hint %v", reply.Err, reply.Impl.Hint)
+	}
+
+	var greply GetReply
+	call(s1.me, "PBServer.Get", &GetArgs{Key: "a"}, &greply)
+	if greply.Err != ErrWrongServer || greply.Impl.Hint.Primary != s2.me {
+		t.Fatalf("old primary replied %v with hint %v", greply.Err, greply.Impl.Hint)
+	}
+
+	// ck still thinks s1 is the primary, and follows the hint
+	ck.Append("a", "y")
+	check(t, ck, "a", "xy")
+	if primary := ck.knownPrimary(); primary != s2.me {
+		t.Fatalf("Clerk's primary is %v, expected %v", primary, s2.me)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestMultiGetPut(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "multi"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: MultiGet and MultiPut ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+
+	const nkeys = 30
+	puts := map[string]string{}
+	keys := []string{"missing"}
+	for i := 0; i < nkeys; i++ {
+		k := strconv.Itoa(i)
+		puts[k] = "v" + k
+		keys = append(keys, k)
+	}
+	ck.MultiPut(puts)
+	check(t, ck, "7", "v7")
+
+	values := ck.MultiGet(keys)
+	if len(values) != nkeys+1 || values["missing"] != "" {
+		t.Fatalf("MultiGet returned %v", values)
+	}
+	for k, v := range puts {
+		if values[k] != v {
+			t.Fatalf("MultiGet(%v) -> %v, expected %v", k, values[k], v)
+		}
+	}
+	found, err := ck.MultiLookupContext(context.Background(), []string{"missing", "7"})
+	if _, exists := found["missing"]; exists || found["7"] != "v7" || err != nil {
+		t.Fatalf("MultiLookup returned %v, %v", found, err)
+	}
+
+	// a retried batch is not applied again
+	args := &MultiPutArgs{Puts: map[string][]byte{"a": []byte("1"), "b": []byte("1")}, Impl: PutAppendArgsImpl{
+		ClientID: nrand(), RequestID: 1, Operation: "MultiPut",
+	}}
+	var reply MultiPutReply
+	call(s1.me, "PBServer.MultiPut", args, &reply)
+	if reply.Err != OK {
+		t.Fatalf("MultiPut returned %v", reply.Err)
+	}
+	ck.Put("a", "2")
+	call(s1.me, "PBServer.MultiPut", args, &reply)
+	check(t, ck, "a", "2")
+
+	// the backup got the batches
+	s1.kill()
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	values = ck.MultiGet([]string{"a", "b", "7"})
+	if values["a"] != "2" || values["b"] != "1" || values["7"] != "v7" {
+		t.Fatalf("MultiGet from backup returned %v", values)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestBytes(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "bytes"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Binary values ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+
+	v := make([]byte, 256)
+	for i := range v {
+		v[i] = byte(i)
+	}
+	ck.PutBytes("b", v[:128])
+	ck.AppendBytes("b", v[128:])
+	if got := ck.GetBytes("b"); string(got) != string(v) {
+		t.Fatalf("GetBytes(b) -> %v, expected %v", got, v)
+	}
+	check(t, ck, "b", string(v))
+
+	ck.Put("s", "text")
+	if got := ck.GetBytes("s"); string(got) != "text" {
+		t.Fatalf("GetBytes(s) -> %q, expected text", got)
+	}
+	if got := ck.GetBytes("missing"); len(got) != 0 {
+		t.Fatalf("GetBytes(missing) -> %q, expected nothing", got)
+	}
+
+	// the backup has the same bytes
+	s1.kill()
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if got := ck.GetBytes("b"); string(got) != string(v) {
+		t.Fatalf("GetBytes(b) from backup -> %v, expected %v", got, v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestLargeValues(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "large"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Large values and chunked state transfer ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+
+	big := make([]byte, 5*chunkSize+123)
+	for i := range big {
+		big[i] = byte(rand.Int())
+	}
+	ck.PutBytes("big", big[:3*chunkSize])
+	ck.AppendBytes("big", big[3*chunkSize:])
+	ck.Put("s", strings.Repeat("x", 2*chunkSize))
+	for i := 0; i < 100; i++ {
+		ck.Put(strconv.Itoa(i), strconv.Itoa(i))
+	}
+	if got := ck.GetBytes("big"); string(got) != string(big) {
+		t.Fatalf("GetBytes(big) returned %v bytes, not the %v put", len(got), len(big))
+	}
+
+	// a new backup is sent it all in chunks, and then gets big updates uploaded
+	s2 := StartServer(vshost, port(tag, 2))
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if v, _ := vck.Get(); v.Backup == s2.me && v.Primary == s1.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(deadtime)
+	ck.Append("s", strings.Repeat("y", 2*chunkSize))
+
+	s1.kill()
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if got := ck.GetBytes("big"); string(got) != string(big) {
+		t.Fatalf("GetBytes(big) from backup returned %v bytes, not the %v put", len(got), len(big))
+	}
+	check(t, ck, "s", strings.Repeat("x", 2*chunkSize)+strings.Repeat("y", 2*chunkSize))
+	check(t, ck, "42", "42")
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+// an interrupted state transfer carries on where it left off, and a
+// corrupted chunk is sent again.
+func TestTransferResume(t *testing.T) {
+	fmt.Printf("Test: Resumable state transfer ...\n")
+
+	primary := new(PBServer)
+	primary.initImpl()
+	for i := 0; i < 50; i++ {
+		primary.apply("Put", strconv.Itoa(i), bytes.Repeat([]byte(strconv.Itoa(i)), chunkSize/7))
+	}
+	primary.apply("Put", "empty", nil)
+	keys := []string{}
+	for key := range primary.impl.kvMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	backup := new(PBServer)
+	backup.initImpl()
+
+	var reply ForwardDatabaseReply
+	args := primary.nextChunk(1, keys, 0, 0)
+	for n := 0; !args.Done; n++ {
+		if n == 3 {
+			// the backup hears of a corrupted chunk
+			bad := *args
+			bad.Pieces = append([]TransferPiece{}, args.Pieces...)
+			// (the pieces share the primary's values, so corrupt a copy)
+			bad.Pieces[0].Data = append([]byte("?"), bad.Pieces[0].Data[1:]...)
+			backup.receiveChunk(&bad, &reply)
+			if reply.Err != ErrChecksum {
+				t.Fatalf("corrupted chunk: %v", reply.Err)
+			}
+		}
+		if n == 5 {
+			// the primary loses track, and starts over; the backup says where it got to
+			next, offset := reply.Next, reply.Offset
+			backup.receiveChunk(primary.nextChunk(1, keys, 0, 0), &reply)
+			if reply.Err != ErrOutOfOrder || reply.Next != next || reply.Offset != offset {
+				t.Fatalf("restarted transfer: %v at %v/%v, expected %v/%v", reply.Err, reply.Next, reply.Offset, next, offset)
+			}
+		}
+		backup.receiveChunk(args, &reply)
+		if reply.Err != OK {
+			t.Fatalf("chunk %v: %v", n, reply.Err)
+		}
+		args = primary.nextChunk(1, keys, reply.Next, reply.Offset)
+	}
+	backup.receiveChunk(args, &reply)
+	if reply.Err != OK || backup.impl.SyncedView != 1 || backup.impl.Applied != primary.impl.Applied {
+		t.Fatalf("last chunk: %v", reply.Err)
+	}
+	if len(backup.impl.kvMap) != len(primary.impl.kvMap) {
+		t.Fatalf("backup has %v keys, expected %v", len(backup.impl.kvMap), len(primary.impl.kvMap))
+	}
+	for key, value := range primary.impl.kvMap {
+		if got, exists := backup.impl.kvMap[key]; !exists || !bytes.Equal(got, value) {
+			t.Fatalf("backup has wrong value for %v", key)
+		}
+	}
+
+	// a backup that gives bad answers doesn't keep the primary, holding
+	// pb.mu, sending forever, and positions past the end aren't sliced
+	for _, bad := range []func(n int, reply *ForwardDatabaseReply){
+		func(n int, reply *ForwardDatabaseReply) { reply.Err = ErrOutOfOrder },
+		func(n int, reply *ForwardDatabaseReply) { reply.Err, reply.Next = OK, len(keys)+5 },
+		func(n int, reply *ForwardDatabaseReply) { reply.Err, reply.Offset = OK, 1<<30 },
+		func(n int, reply *ForwardDatabaseReply) { reply.Err, reply.Next = OK, -1 },
+		func(n int, reply *ForwardDatabaseReply) { reply.Err, reply.Next = OK, n%2 }, // no progress
+	} {
+		calls := 0
+		primary.impl.transport = wire.TransportFunc(func(srv string, rpcname string, args interface{}, reply interface{}) bool {
+			calls++
+			bad(calls, reply.(*ForwardDatabaseReply))
+			return true
+		})
+		if primary.sendState("backup", 1, keys) {
+			t.Fatalf("a misbehaving backup was sent the state")
+		}
+		if calls > 1000 {
+			t.Fatalf("a misbehaving backup was sent %v messages", calls)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestUploadLimits(t *testing.T) {
+	fmt.Printf("Test: Upload limits and expiry ...\n")
+
+	pb := new(PBServer)
+	pb.initImpl()
+	pb.me = "p"
+	pb.impl.Primary = "p"
+	send := func(clientID int64, offset int, data []byte) UploadReply {
+		args := &UploadArgs{ClientID: clientID, RequestID: 1, Offset: offset, Data: data, Checksum: crc32.ChecksumIEEE(data)}
+		var reply UploadReply
+		pb.Upload(args, &reply)
+		return reply
+	}
+
+	if reply := send(1, 0, []byte("abc")); reply.Err != OK || pb.impl.uploadSize != 3 {
+		t.Fatalf("upload: %v, holding %v bytes", reply.Err, pb.impl.uploadSize)
+	}
+
+	// no one value grows past maxUploadSize
+	long := &upload{data: make([]byte, maxUploadSize), touched: time.Now()}
+	pb.impl.uploads[uploadKey{2, 1}] = long
+	pb.impl.uploadSize += len(long.data)
+	if reply := send(2, maxUploadSize, []byte("x")); reply.Err != ErrTooLarge {
+		t.Fatalf("an upload past the longest value: %v", reply.Err)
+	}
+
+	// nor do all of them past maxUploadBytes
+	pb.impl.uploadSize = maxUploadBytes - 1
+	if reply := send(3, 0, []byte("xy")); reply.Err != ErrTooLarge {
+		t.Fatalf("an upload past the most held: %v", reply.Err)
+	}
+	pb.impl.uploadSize = 3 + maxUploadSize
+
+	// abandoned uploads expire
+	pb.impl.uploads[uploadKey{2, 1}].touched = time.Now().Add(-2 * uploadExpiry)
+	pb.expireUploads()
+	if len(pb.impl.uploads) != 1 || pb.impl.uploadSize != 3 {
+		t.Fatalf("after expiry, %v uploads hold %v bytes", len(pb.impl.uploads), pb.impl.uploadSize)
+	}
+
+	// the clerk doesn't try to send a value that's too long
+	ck := MakeClerk(port("uploadv", 1), "")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ck.PutContext(ctx, "a", strings.Repeat("x", maxUploadSize+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("PutContext of a value too large returned %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDivergence(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "diverge"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Backup divergence is detected and repaired ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	for i := 0; i < 100; i++ {
+		ck.Put(strconv.Itoa(i), strconv.Itoa(i))
+	}
+	time.Sleep(viewservice.PingInterval * 2)
+
+	// the backup silently loses an update, and gains a key
+	s2.mu.Lock()
+	s2.apply("Put", "7", []byte("wrong"))
+	s2.apply("Put", "extra", []byte("x"))
+	s2.impl.Applied -= 2
+	s2.mu.Unlock()
+
+	time.Sleep(viewservice.PingInterval * 3)
+
+	s1.mu.Lock()
+	diverged, repaired := s1.impl.Diverged, s1.impl.Repaired
+	s1.mu.Unlock()
+	if diverged == 0 || repaired == 0 || repaired > 2 {
+		t.Fatalf("primary noticed %v divergences, and repaired %v buckets", diverged, repaired)
+	}
+
+	s1.kill()
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	check(t, ck, "7", "7")
+	check(t, ck, "extra", "")
+	check(t, ck, "42", "42")
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestCodec(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "codec"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: JSON-RPC codec ...\n")
+
+	if err := wire.SetCodec("json"); err != nil {
+		t.Fatalf("SetCodec: %v", err)
+	}
+	defer wire.SetCodec("gob")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "x")
+	ck.Append("a", "y")
+	ck.MultiPut(map[string]string{"b": "1", "c": "2"})
+	check(t, ck, "a", "xy")
+
+	s1.kill()
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	check(t, ck, "a", "xy")
+	if values := ck.MultiGet([]string{"b", "c"}); values["b"] != "1" || values["c"] != "2" {
+		t.Fatalf("MultiGet returned %v", values)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Binary values in every codec ...\n")
+
+	// values that aren't UTF-8, such as the memcache front-end's items,
+	// come back intact whichever codec carries them
+	binary := "\xffmc \x00\xfe\xc3("
+	for _, codec := range wire.Codecs() {
+		if err := wire.SetCodec(codec); err != nil {
+			t.Fatalf("SetCodec(%v): %v", codec, err)
+		}
+		ck := MakeClerk(vshost, "") // a new clerk makes new connections, in codec
+		ck.Put("bin", binary)
+		ck.Append("bin", binary)
+		check(t, ck, "bin", binary+binary)
+		if got := ck.GetBytes("bin"); string(got) != binary+binary {
+			t.Fatalf("%v: GetBytes(bin) -> %q, expected %q", codec, got, binary+binary)
+		}
+		swapped, err := ck.CompareAndSwapContext(context.Background(), "bin", binary+binary, binary)
+		if !swapped || err != nil {
+			t.Fatalf("%v: CompareAndSwap of a binary value failed: %v", codec, err)
+		}
+		ck.MultiPut(map[string]string{"bin2": binary})
+		if values := ck.MultiGet([]string{"bin", "bin2"}); values["bin"] != binary || values["bin2"] != binary {
+			t.Fatalf("%v: MultiGet returned %q", codec, values)
+		}
+		if r := ck.GetStale("bin", time.Second); r.Value != binary {
+			t.Fatalf("%v: GetStale(bin) -> %q, expected %q", codec, r.Value, binary)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestDelete(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "delete"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Delete ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	ctx := context.Background()
+	ck.Put("a", "x")
+	ck.Put("b", "y")
+	ck.Delete("a")
+	ck.Delete("missing")
+
+	if _, exists, err := ck.LookupContext(ctx, "a"); exists || err != nil {
+		t.Fatalf("Lookup(a) after Delete -> exists %v, err %v", exists, err)
+	}
+	if value, exists, err := ck.LookupContext(ctx, "b"); !exists || value != "y" || err != nil {
+		t.Fatalf("Lookup(b) -> %q, exists %v, err %v", value, exists, err)
+	}
+
+	// a heartbeat or two, so that a divergence would be noticed
+	time.Sleep(deadtime)
+
+	// the backup deleted it too
+	s1.kill()
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if _, exists, err := ck.LookupContext(ctx, "a"); exists || err != nil {
+		t.Fatalf("Lookup(a) from backup -> exists %v, err %v", exists, err)
+	}
+	check(t, ck, "b", "y")
+	s1.mu.Lock()
+	diverged := s1.impl.Diverged
+	s1.mu.Unlock()
+	if diverged != 0 {
+		t.Fatalf("backup diverged %v times", diverged)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "cas"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Compare-and-swap ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	ctx := context.Background()
+	ck.Put("a", "0")
+
+	if swapped, err := ck.CompareAndSwapContext(ctx, "a", "1", "2"); swapped || err != nil {
+		t.Fatalf("CompareAndSwap with the wrong value -> %v, %v", swapped, err)
+	}
+	if swapped, err := ck.CompareAndSwapContext(ctx, "missing", "", "2"); swapped || err != nil {
+		t.Fatalf("CompareAndSwap of a missing key -> %v, %v", swapped, err)
+	}
+	check(t, ck, "a", "0")
+
+	// concurrent increments, each retried until its swap goes through
+	const nclients = 5
+	const nincrements = 10
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ck := MakeClerk(vshost, "")
+			for j := 0; j < nincrements; {
+				old := ck.Get("a")
+				n, _ := strconv.Atoi(old)
+				if swapped, _ := ck.CompareAndSwapContext(ctx, "a", old, strconv.Itoa(n+1)); swapped {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	check(t, ck, "a", strconv.Itoa(nclients*nincrements))
+
+	ck.Put("b", "x")
+	if deleted, err := ck.CompareAndDeleteContext(ctx, "b", "y"); deleted || err != nil {
+		t.Fatalf("CompareAndDelete with the wrong value -> %v, %v", deleted, err)
+	}
+	if deleted, err := ck.CompareAndDeleteContext(ctx, "b", "x"); !deleted || err != nil {
+		t.Fatalf("CompareAndDelete -> %v, %v", deleted, err)
+	}
+
+	// the backup agrees
+	s1.kill()
+	for i := 0; i < viewservice.DeadPings*3; i++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	check(t, ck, "a", strconv.Itoa(nclients*nincrements))
+	if _, exists, _ := ck.LookupContext(ctx, "b"); exists {
+		t.Fatalf("b exists on the backup after CompareAndDelete")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestMetrics(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "metrics"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+
+	fmt.Printf("Test: Metrics ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1), WithHTTPAddr("127.0.0.1:0"))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", strings.Repeat("x", 1000))
+	check(t, ck, "a", strings.Repeat("x", 1000))
+
+	// the same request twice is a dedup hit
+	args := &PutAppendArgs{Key: "b", Value: "y", Impl: PutAppendArgsImpl{ClientID: nrand(), RequestID: 1, Operation: "Append"}}
+	for i := 0; i < 2; i++ {
+		var reply PutAppendReply
+		if !call(s1.me, "PBServer.PutAppend", args, &reply) || reply.Err != OK {
+			t.Fatalf("PutAppend failed: %v", reply.Err)
+		}
+	}
+	check(t, ck, "b", "y")
+
+	// let a tick go by, for the gauges
+	time.Sleep(2 * viewservice.PingInterval)
+
+	resp, err := http.Get("http://" + s1.HTTPAddr() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`pbservice_role{role="primary"} 1` + "\n",
+		`pbservice_role{role="backup"} 0` + "\n",
+		"pbservice_view_number 2\n",
+		"pbservice_applied_updates 2\n",
+		"pbservice_synced_backups 1\n",
+		"pbservice_dedup_hits_total 1\n",
+		`pbservice_rpc_requests_total{method="PBServer.PutAppend"} 3` + "\n",
+		`pbservice_rpc_duration_seconds_count{method="PBServer.Get"} `,
+		"pbservice_state_transfer_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("primary's metrics are missing %q:\n%s", want, body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s2.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	backup := rec.Body.String()
+	for _, want := range []string{
+		`pbservice_role{role="backup"} 1` + "\n",
+		`pbservice_rpc_requests_total{method="PBServer.ForwardPut"} 2` + "\n",
+		`pbservice_state_transfer_bytes_total{direction="received"} `,
+	} {
+		if !strings.Contains(backup, want) {
+			t.Fatalf("backup's metrics are missing %q:\n%s", want, backup)
+		}
+	}
+	if strings.Contains(backup, "pbservice_replication_lag_seconds +Inf") {
+		t.Fatalf("backup lags infinitely:\n%s", backup)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+// a buffer that servers can log to while a test reads it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogging(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "logging"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+
+	fmt.Printf("Test: Logging ...\n")
+
+	var log1, log2 logBuffer
+	s1 := StartServer(vshost, port(tag, 1), WithLogger(logging.New(&log1, logging.Debug)))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2), WithLogger(logging.New(&log2, logging.Info)))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "x")
+
+	args := &PutAppendArgs{Key: "b", Value: "y", Impl: PutAppendArgsImpl{ClientID: 42, RequestID: 1, Operation: "Append"}}
+	for i := 0; i < 2; i++ {
+		var reply PutAppendReply
+		if !call(s1.me, "PBServer.PutAppend", args, &reply) || reply.Err != OK {
+			t.Fatalf("PutAppend failed: %v", reply.Err)
+		}
+	}
+
+	for _, want := range []string{
+		`level=info msg="view changed" component=pbservice server=` + s1.me + ` role=idle viewnum=0 new_viewnum=1 primary=` + s1.me,
+		`level=info msg="sent state" component=pbservice server=` + s1.me + ` role=primary viewnum=1 backup=` + s2.me + ` for_viewnum=2`,
+		`level=debug msg="duplicate request" component=pbservice server=` + s1.me + ` role=primary viewnum=2 client=42 request=1`,
+	} {
+		if !strings.Contains(log1.String(), want) {
+			t.Fatalf("primary's log is missing %q:\n%s", want, log1.String())
+		}
+	}
+	if want := `level=info msg="received state" component=pbservice server=` + s2.me + ` role=backup viewnum=2`; !strings.Contains(log2.String(), want) {
+		t.Fatalf("backup's log is missing %q:\n%s", want, log2.String())
+	}
+
+	// the logger with the role and view is made once per view, not per message
+	s1.mu.Lock()
+	same := s1.log() == s1.log()
+	s1.mu.Unlock()
+	if !same {
+		t.Fatalf("the server makes a new logger for every message")
+	}
+
+	// the backup logs rejections once its level is turned down to debug
+	get := func() {
+		var reply GetReply
+		call(s2.me, "PBServer.Get", &GetArgs{Key: "a", Impl: GetArgsImpl{ClientID: 7}}, &reply)
+		if reply.Err != ErrWrongServer {
+			t.Fatalf("backup served a Get: %v", reply.Err)
+		}
+	}
+	rejected := `level=debug msg="rejected request" component=pbservice server=` + s2.me + ` role=backup viewnum=2 rpc=Get client=7`
+	get()
+	if strings.Contains(log2.String(), rejected) {
+		t.Fatalf("backup logged at debug while at info:\n%s", log2.String())
+	}
+	rec := httptest.NewRecorder()
+	s2.Handler().ServeHTTP(rec, httptest.NewRequest("PUT", "/loglevel", strings.NewReader("debug")))
+	if rec.Code != http.StatusOK || s2.Logger().Level() != logging.Debug {
+		t.Fatalf("PUT /loglevel: %v %q", rec.Code, rec.Body.String())
+	}
+	get()
+	if !strings.Contains(log2.String(), rejected) {
+		t.Fatalf("backup's log is missing %q:\n%s", rejected, log2.String())
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestTracing(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "tracing"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+
+	fmt.Printf("Test: Tracing ...\n")
+
+	var rec trace.Recorder
+	s1 := StartServer(vshost, port(tag, 1), WithTracer(trace.NewTracer("pbservice", &rec)))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2), WithTracer(trace.NewTracer("pbservice", &rec)))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "", WithClerkTracer(trace.NewTracer("clerk", &rec)))
+	ck.forgetPrimary(ck.knownPrimary()) // so the Put asks the viewservice
+	ck.Put("a", "x")
+	check(t, ck, "a", "x")
+
+	// follow the Put's spans down the tree of the request
+	spans := rec.Spans()
+	find := func(name string, parent trace.SpanData) trace.SpanData {
+		for _, span := range spans {
+			if span.Name == name && span.Parent == parent.Context.SpanID && span.Context.TraceID == parent.Context.TraceID {
+				return span
+			}
+		}
+		t.Fatalf("no %v span within %v", name, parent.Name)
+		return trace.SpanData{}
+	}
+	var put trace.SpanData
+	for _, span := range spans {
+		if span.Name == "Clerk.Put" {
+			put = span
+		}
+	}
+	if !put.Context.IsValid() {
+		t.Fatalf("no span for the Put")
+	}
+	find("viewservice.Get", put)
+	attempt := find("PBServer.PutAppend", put)
+	primary := find("PBServer.PutAppend", attempt)
+	find("lock", primary)
+	find("apply", primary)
+	backup := find("PBServer.ForwardPut", find("forward", primary))
+	find("lock", backup)
+	find("apply", backup)
+	if attempt.Kind != trace.Client || primary.Kind != trace.Server || backup.Kind != trace.Server {
+		t.Fatalf("spans are of the wrong kinds")
+	}
+
+	// the Get's span on the primary includes checking with the viewservice
+	spans = rec.Spans()
+	var get trace.SpanData
+	for _, span := range spans {
+		if span.Name == "Clerk.Get" {
+			get = span
+		}
+	}
+	if !get.Context.IsValid() {
+		t.Fatalf("no span for the Get")
+	}
+	find("viewservice.Ping", find("PBServer.Get", find("PBServer.Get", get)))
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestStatus(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "status"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+
+	fmt.Printf("Test: Status ...\n")
+
+	s1 := StartServer(vshost, port(tag, 1))
+	time.Sleep(time.Second)
+	s2 := StartServer(vshost, port(tag, 2))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "x")
+	ck.Put("b", "y")
+
+	status := func(pb *PBServer) Status {
+		rec := httptest.NewRecorder()
+		pb.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("GET /status: %v %v", rec.Code, rec.Header())
+		}
+		var st Status
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatalf("bad status %v: %s", err, rec.Body.String())
+		}
+		return st
+	}
+
+	primary := status(s1)
+	if primary.Server != s1.me || primary.Role != "primary" || primary.Viewnum != 2 ||
+		primary.Primary != s1.me || len(primary.Backups) != 1 || primary.Backups[0] != s2.me {
+		t.Fatalf("bad primary status %+v", primary)
+	}
+	// the second Put told the primary the Clerk was done with the first
+	if primary.Keys != 2 || primary.Applied != 2 || primary.Clients != 1 || primary.Requests != 1 {
+		t.Fatalf("bad primary counts %+v", primary)
+	}
+	if age, ok := primary.LastForwardAge[s2.me]; !ok || age < 0 || age > 5 {
+		t.Fatalf("bad last forward %+v", primary)
+	}
+
+	backup := status(s2)
+	if backup.Role != "backup" || backup.Viewnum != 2 || backup.Primary != s1.me || backup.Keys != 2 || backup.SyncedView != 2 {
+		t.Fatalf("bad backup status %+v", backup)
+	}
+	if backup.LastSyncAge == nil || *backup.LastSyncAge > 5 || len(backup.LastForwardAge) != 0 {
+		t.Fatalf("bad backup sync %+v", backup)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	s2.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+func TestConfig(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "config"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+
+	fmt.Printf("Test: Config hot reload ...\n")
+
+	// the server starts with a dead threshold the viewservice doesn't share
+	slow := viewservice.DefaultConfig()
+	slow.DeadPings = 20
+	var log logBuffer
+	s1 := StartServer(vshost, port(tag, 1), WithConfig(slow), WithLogger(logging.New(&log, logging.Warn)))
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	if st := s1.Status(); st.ConfigAgrees || st.Config != slow {
+		t.Fatalf("bad config in status %+v", st)
+	}
+	if st := vs.Status().Servers[s1.me]; st.Agrees {
+		t.Fatalf("viewservice thinks %v agrees: %+v", s1.me, st)
+	}
+	if !strings.Contains(log.String(), `level=warn msg="viewservice's timing disagrees"`) {
+		t.Fatalf("no warning about the disagreement:\n%s", log.String())
+	}
+
+	rec := httptest.NewRecorder()
+	s1.Handler().ServeHTTP(rec, httptest.NewRequest("PUT", "/config", strings.NewReader(`{"dead_pings": -1}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("PUT of an invalid config: %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	s1.Handler().ServeHTTP(rec, httptest.NewRequest("PUT", "/config", strings.NewReader(`{"dead_pings": 5}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /config: %v %s", rec.Code, rec.Body.String())
+	}
+	if s1.Config() != viewservice.DefaultConfig() {
+		t.Fatalf("config is %+v after PUT", s1.Config())
+	}
+	time.Sleep(viewservice.PingInterval * 3)
+
+	if st := s1.Status(); !st.ConfigAgrees {
+		t.Fatalf("still disagrees after the change: %+v", st)
+	}
+	if st := vs.Status().Servers[s1.me]; !st.Agrees {
+		t.Fatalf("viewservice thinks %v still disagrees: %+v", s1.me, st)
+	}
+
+	// a Clerk backs off as told, and can be told again
+	backoff := viewservice.DefaultConfig()
+	backoff.RetryBackoff = 10 * time.Millisecond
+	backoff.MaxRetryBackoff = time.Second
+	ck := MakeClerk(vshost, "", WithClerkConfig(backoff))
+	ck.Put("a", "x")
+	check(t, ck, "a", "x")
+	if ck.backoff(3) != 40*time.Millisecond {
+		t.Fatalf("backoff after 3 failures is %v", ck.backoff(3))
+	}
+	if err := ck.SetConfig(viewservice.Config{}); err == nil {
+		t.Fatalf("Clerk took an invalid config")
+	}
+	if ck.backoff(3) != 40*time.Millisecond {
+		t.Fatalf("invalid config changed the backoff to %v", ck.backoff(3))
+	}
+
+	// an invalid config is refused before the Clerk contacts anything
+	var calls int32
+	counted := WithClerkTransport(wire.TransportFunc(func(srv string, rpcname string, args interface{}, reply interface{}) bool {
+		atomic.AddInt32(&calls, 1)
+		return call(srv, rpcname, args, reply)
+	}))
+	bad := viewservice.DefaultConfig()
+	bad.RetryBackoff = 0
+	if _, err := NewClerk(vshost, "", WithClerkConfig(bad), counted); err == nil {
+		t.Fatalf("NewClerk took an invalid config")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "pbservice: MakeClerk:") {
+				t.Fatalf("MakeClerk with an invalid config: %v", r)
+			}
+		}()
+		MakeClerk(vshost, "", WithClerkConfig(bad), counted)
+	}()
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("a Clerk with an invalid config sent %v RPCs", n)
+	}
+	if _, err := NewClerk(vshost, "", counted); err != nil {
+		t.Fatalf("NewClerk failed: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
+
+// clients partitioned, paused, killed, and mistreated at random by a
+// nemesis must still see a linearizable history.
+func TestNemesis(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Linearizable despite a nemesis ...\n")
+
+	seed := int64(os.Getpid())
+	net := nemesis.NewNetwork(seed)
+	vsnode := net.Node("vs")
+	vs := viewservice.StartServer("vs", viewservice.WithNetwork(vsnode), viewservice.WithClock(vsnode.Clock()),
+		viewservice.WithLogger(logging.Discard()))
+	names := []string{"pb-0", "pb-1", "pb-2"}
+	c := nemesis.NewCluster(net, func(name string, node *nemesis.Node) func() {
+		return StartServer("vs", name, WithNetwork(node), WithClock(node.Clock()), WithLogger(logging.Discard())).kill
+	}, names...)
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+
+	w := nemesis.StartWorkload(net, 3, func(node *nemesis.Node) linearizability.KV {
+		return MakeClerk("vs", "", WithClerkTransport(node))
+	})
+	n := nemesis.New(net, c)
+	plan := nemesis.ServerPlan(names, nemesis.Faults{Drop: 0.1, Duplicate: 0.1, Jitter: 5 * time.Millisecond}, deadtime*3)
+	n.Run(context.Background(), nemesis.Random(seed, plan, 10*time.Second))
+	n.Recover()
+	time.Sleep(deadtime * 3)
+
+	ops, err := w.Stop(10 * time.Second)
+	if err != nil {
+		t.Fatalf("%v\nseed %v:\n%v", err, seed, n.Log())
+	}
+	if len(ops) < 100 {
+		t.Fatalf("only %v requests were made; seed %v:\n%v", len(ops), seed, n.Log())
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	c.KillAll()
+	time.Sleep(time.Second)
+	vs.Kill()
+	time.Sleep(time.Second)
+}
@@ -0,0 +1,104 @@
+package pbservice
+
+import (
+	"context"
+	"net/rpc"
+	"reflect"
+	"sync"
+
+	"usc.edu/csci499/proj2/wire"
+)
+
+// connPool lets a Clerk's concurrent requests share connections:
+// requests to the same server that overlap in time are pipelined
+// over one connection. a connection is closed as soon as no request
+// is using it, so a Clerk used by one goroutine dials once per RPC,
+// just like call().
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*sharedConn // server -> connection new requests should use
+}
+
+type sharedConn struct {
+	client *rpc.Client
+	users  int // requests using the connection
+}
+
+// get returns a connection to srv, dialing one if no request is using one.
+func (p *connPool) get(ctx context.Context, srv string) (*sharedConn, error) {
+	p.mu.Lock()
+	if sc, exists := p.conns[srv]; exists {
+		sc.users++
+		p.mu.Unlock()
+		return sc, nil
+	}
+	p.mu.Unlock()
+
+	client, err := wire.DialContext(ctx, "unix", srv)
+	if err != nil {
+		return nil, err
+	}
+	sc := &sharedConn{client: client, users: 1}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		p.conns = make(map[string]*sharedConn)
+	}
+	// if another request dialed meanwhile, this connection just isn't shared
+	if _, exists := p.conns[srv]; !exists {
+		p.conns[srv] = sc
+	}
+	return sc, nil
+}
+
+// put gives back a connection a request got from get. a broken connection
+// is not handed out again.
+func (p *connPool) put(srv string, sc *sharedConn, broken bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sc.users--
+	if (broken || sc.users == 0) && p.conns[srv] == sc {
+		delete(p.conns, srv)
+	}
+	if sc.users == 0 {
+		sc.client.Close()
+	}
+}
+
+// call is like call(), but shares connections with the clerk's other
+// requests, and gives up (returning false) as soon as ctx is cancelled
+// or its deadline passes. a Clerk with a transport of its own sends
+// the RPC over that instead, and only checks ctx first.
+//
+// reply is only written if call returns true: the reply to an RPC given
+// up on may still arrive, so it is decoded into a reply of call's own.
+func (ck *Clerk) call(ctx context.Context, srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	if ck.impl.transport != nil {
+		return ctx.Err() == nil && ck.impl.transport.Call(srv, rpcname, args, reply)
+	}
+	sc, errx := ck.impl.conns.get(ctx, srv)
+	if errx != nil {
+		return false
+	}
+
+	own := reflect.New(reflect.TypeOf(reply).Elem())
+	done := sc.client.Go(rpcname, args, own.Interface(), make(chan *rpc.Call, 1)).Done
+	select {
+	case call := <-done:
+		if call.Error == nil {
+			ck.impl.conns.put(srv, sc, false)
+			reflect.ValueOf(reply).Elem().Set(own.Elem())
+			return true
+		}
+		// an error from the server itself leaves the connection usable
+		_, fromServer := call.Error.(rpc.ServerError)
+		ck.impl.conns.put(srv, sc, !fromServer)
+		return false
+	case <-ctx.Done():
+		ck.impl.conns.put(srv, sc, false)
+		return false
+	}
+}
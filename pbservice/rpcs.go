@@ -1,9 +1,18 @@
 package pbservice
 
 const (
-	OK             = "OK"
-	ErrNoKey       = "ErrNoKey"
-	ErrWrongServer = "ErrWrongServer"
+	OK              = "OK"
+	ErrNoKey        = "ErrNoKey"
+	ErrWrongServer  = "ErrWrongServer"
+	ErrStale        = "ErrStale"
+	ErrNeedSnapshot = "ErrNeedSnapshot"
+	ErrExpired      = "ErrExpired"
+	ErrNotSynced    = "ErrNotSynced"
+	ErrOutOfOrder   = "ErrOutOfOrder"
+	ErrChecksum     = "ErrChecksum"
+	ErrDiverged     = "ErrDiverged"
+	ErrMismatch     = "ErrMismatch"
+	ErrTooLarge     = "ErrTooLarge"
 )
 
 type Err string
@@ -16,7 +25,8 @@ type PutAppendArgs struct {
 }
 
 type PutAppendReply struct {
-	Err Err
+	Err  Err
+	Impl PutAppendReplyImpl
 }
 
 type GetArgs struct {
@@ -27,4 +37,5 @@ type GetArgs struct {
 type GetReply struct {
 	Err   Err
 	Value string
+	Impl  GetReplyImpl
 }
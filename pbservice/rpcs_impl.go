@@ -1,5 +1,12 @@
 package pbservice
 
+import (
+	"time"
+
+	"usc.edu/csci499/proj2/trace"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
 // In all data types that represent arguments to RPCs, field names
 // must start with capital letters, otherwise RPC will break.
 
@@ -12,6 +19,12 @@ type PutAppendArgsImpl struct {
 	ClientID  int64
 	RequestID int64
 	Operation string
+	Deadline  time.Time         // if not zero, the primary should not start the request after this
+	Done      int64             // the client has finished all its requests with IDs up to this one
+	Data      []byte            // if not nil, the value to put or append, in place of Value
+	Uploaded  int               // if not zero, the value was sent ahead with Upload, and is this long
+	Expect    []byte            // with CompareAndSwap or CompareAndDelete, the value the key must have
+	Trace     trace.SpanContext // the client's span for this attempt, if it is tracing
 }
 
 //
@@ -20,27 +33,173 @@ type PutAppendArgsImpl struct {
 type GetArgsImpl struct {
 	ClientID  int64
 	RequestID int64
+	Deadline  time.Time         // if not zero, the primary should not start the request after this
+	Bytes     bool              // whether to reply with the value in Impl.Data rather than Value
+	Trace     trace.SpanContext // the client's span for this attempt, if it is tracing
+}
+
+//
+// additional state to include in replies to PutAppend RPC.
+//
+type PutAppendReplyImpl struct {
+	Hint viewservice.View // with ErrWrongServer, the view the server knows of
+}
+
+//
+// additional state to include in replies to Get RPC.
+//
+type GetReplyImpl struct {
+	Hint viewservice.View // with ErrWrongServer, the view the server knows of
+	Data []byte           // the value, if the client asked for bytes
+}
+
+//
+// the requests a server has applied for one client. a client may have
+// several requests in flight, so a single last request ID isn't enough.
+//
+type ClientRecord struct {
+	Done int64          // every request with an ID up to Done has been applied (or given up on)
+	Seen map[int64]bool // requests with IDs past Done that have been applied
 }
 
 //
 // for new RPCs that you add, declare types for arguments and reply.
 //
+type GetStaleArgs struct {
+	Key          string
+	MaxStaleness time.Duration // how long ago a backup may last have heard from the primary
+	Deadline     time.Time     // when the client gives up, or zero
+}
+
+type GetStaleReply struct {
+	Err     Err
+	Value   []byte
+	Viewnum uint   // the view the serving server was in
+	Applied uint64 // how many updates the serving server had applied
+}
+
+// one chunk of the database, sent by the primary to a backup. the
+// database is sent in order of key, and values longer than a chunk
+// are split across chunks.
 type ForwardDatabaseArgs struct {
-	Data map[string]string
+	Viewnum  uint   // the view the primary is bringing its backups into
+	Applied  uint64 // number of updates the primary has applied to the database being sent
+	Next     int    // the chunk starts with this key, counting in order from 0...
+	Offset   int    // ...at this offset into its value
+	Pieces   []TransferPiece
+	Checksum uint32                  // crc32 of Pieces
+	Done     bool                    // whether this is the last chunk
+	Clients  map[int64]*ClientRecord // with the last chunk
+	Root     uint64                  // with the last chunk, the root of the database's digest
+}
+
+type TransferPiece struct {
+	Key  string
+	Data []byte // the next part of Key's value
+	Last bool   // whether Data ends the value
 }
 
 type ForwardDatabaseReply struct {
+	Err    Err
+	Next   int // where the backup wants the transfer to carry on from
+	Offset int
+}
+
+type HeartbeatArgs struct {
+	Viewnum uint
+	Applied uint64 // the backup should have applied as many updates
+	Root    uint64 // the root of the primary's digest
+}
+
+type HeartbeatReply struct {
+	Err     Err
+	Buckets []uint64 // with ErrDiverged, the backup's bucket digests
+}
+
+// the contents of some of the primary's digest buckets, to replace
+// those of a backup that has diverged.
+type RepairArgs struct {
+	Viewnum uint
+	Applied uint64
+	Buckets map[int]map[string][]byte // bucket -> the keys in it and their values
+	Last    bool                      // whether this is the last message of the repair
+	Root    uint64                    // with the last message, the root of the primary's digest
+}
+
+type RepairReply struct {
 	Err Err
 }
 
+// part of a value sent ahead of the Put or Append that uses it.
+type UploadArgs struct {
+	ClientID  int64
+	RequestID int64
+	Offset    int // where Data goes in the value
+	Data      []byte
+	Checksum  uint32 // crc32 of Data
+	Forwarded bool   // whether the primary (or the previous server in a chain) is passing it on
+}
+
+type UploadReply struct {
+	Err      Err
+	Received int              // how much of the value the server has
+	Hint     viewservice.View // with ErrWrongServer, the view the server knows of
+}
+
 type ForwardPutArgs struct {
 	ClientID  int64
 	RequestID int64
+	Done      int64
+	Applied   uint64 // how many updates the primary had applied before this one
 	Operation string
 	Key       string
-	Value     string
+	Value     []byte
+	Puts      map[string][]byte // with Operation "MultiPut", the keys to put and their values
+	Uploaded  int               // if not zero, the value was sent ahead with Upload, and is this long
+	Trace     trace.SpanContext // the sender's span for forwarding the update, if it is tracing
 }
 
 type ForwardPutReply struct {
 	Err Err
 }
+
+type MultiGetArgs struct {
+	Keys []string
+	Impl GetArgsImpl
+}
+
+type MultiGetReply struct {
+	Err     Err
+	Values  map[string][]byte // empty for keys that don't exist
+	Missing []string          // the keys that don't exist
+	Impl    GetReplyImpl
+}
+
+type MultiPutArgs struct {
+	Puts map[string][]byte
+	Impl PutAppendArgsImpl
+}
+
+type MultiPutReply struct {
+	Err  Err
+	Impl PutAppendReplyImpl
+}
+
+type LearnUpdate struct {
+	Seq       uint64 // the update's place in the primary's order of updates
+	Operation string
+	Key       string
+	Value     []byte
+}
+
+type LearnArgs struct {
+	Viewnum     uint              // the sending primary's view
+	HasSnapshot bool              // whether Snapshot replaces the learner's database; gob sends an empty one as nil
+	Snapshot    map[string][]byte // with HasSnapshot, the primary's database
+	Applied     uint64            // with HasSnapshot, how many updates it reflects
+	Updates     []LearnUpdate
+}
+
+type LearnReply struct {
+	Err Err
+}
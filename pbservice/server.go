@@ -1,6 +1,7 @@
 package pbservice
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -10,9 +11,12 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
-	"time"
 
+	"usc.edu/csci499/proj2/clock"
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/trace"
 	"usc.edu/csci499/proj2/viewservice"
+	"usc.edu/csci499/proj2/wire"
 )
 
 type PBServer struct {
@@ -29,7 +33,20 @@ type PBServer struct {
 // tell the server to shut itself down.
 func (pb *PBServer) kill() {
 	atomic.StoreInt32(&pb.dead, 1)
-	pb.l.Close()
+	if pb.l != nil {
+		pb.l.Close()
+	}
+	if pb.impl.left != nil {
+		pb.impl.left.Close()
+	}
+	if pb.impl.httpServer != nil {
+		pb.impl.httpServer.Close()
+	}
+}
+
+// Kill shuts the server down, for tests outside this package.
+func (pb *PBServer) Kill() {
+	pb.kill()
 }
 
 // call this to find out if the server is dead.
@@ -49,11 +66,86 @@ func (pb *PBServer) isunreliable() bool {
 	return atomic.LoadInt32(&pb.unreliable) != 0
 }
 
-func StartServer(vshost string, me string) *PBServer {
+// an Option configures a PBServer when it is started.
+type Option func(pb *PBServer)
+
+// AsLearner starts the server as a learner: it receives updates
+// from the primary asynchronously, serves reads that may be stale,
+// and is only made a backup if there is no idle server.
+func AsLearner() Option {
+	return func(pb *PBServer) {
+		pb.impl.learner = true
+	}
+}
+
+// WithHTTPAddr serves the server's metrics over HTTP, at /metrics on
+// addr, a TCP address such as ":9100", its log level at /loglevel, its
+// status at /status, and its timing at /config.
+func WithHTTPAddr(addr string) Option {
+	return func(pb *PBServer) {
+		pb.impl.httpAddr = addr
+	}
+}
+
+// WithConfig sets the server's timing, rather than
+// viewservice.DefaultConfig(). it should agree with the viewservice's.
+// StartServer fails if it isn't valid.
+func WithConfig(c viewservice.Config) Option {
+	return func(pb *PBServer) {
+		pb.impl.config = c
+	}
+}
+
+// WithClock runs the server on c, rather than on clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(pb *PBServer) {
+		pb.impl.clock = c
+	}
+}
+
+// WithNetwork serves the server on n, under its name, rather than on a
+// Unix socket, and sends its RPCs (to the viewservice too) over n.
+func WithNetwork(n wire.Network) Option {
+	return func(pb *PBServer) {
+		pb.impl.network = n
+		pb.impl.transport = n
+	}
+}
+
+// WithLogger sends the server's logs to l, rather than to standard
+// error at level warn.
+func WithLogger(l *logging.Logger) Option {
+	return func(pb *PBServer) {
+		pb.impl.logger = l
+	}
+}
+
+// WithTracer traces the requests the server handles with t: a span for
+// each, with spans for waiting for the lock, checking with the
+// viewservice, forwarding to the backups and applying the update.
+func WithTracer(t *trace.Tracer) Option {
+	return func(pb *PBServer) {
+		pb.impl.tracer = t
+	}
+}
+
+func StartServer(vshost string, me string, opts ...Option) *PBServer {
 	pb := new(PBServer)
 	pb.me = me
-	pb.vs = viewservice.MakeClerk(me, vshost)
 	pb.initImpl()
+	for _, opt := range opts {
+		opt(pb)
+	}
+	pb.vs = viewservice.MakeClerk(me, vshost, viewservice.WithClerkTransport(pb.impl.transport))
+	pb.impl.logger = pb.impl.logger.With("component", "pbservice", "server", me)
+	if err := pb.impl.config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if pb.impl.network != nil {
+		pb.joinNetwork()
+		return pb
+	}
 
 	rpcs := rpc.NewServer()
 	rpcs.Register(pb)
@@ -65,6 +157,10 @@ func StartServer(vshost string, me string) *PBServer {
 	}
 	pb.l = l
 
+	if pb.impl.httpAddr != "" {
+		pb.startHTTP()
+	}
+
 	go func() {
 		for pb.isdead() == false {
 			conn, err := pb.l.Accept()
@@ -80,9 +176,9 @@ func StartServer(vshost string, me string) *PBServer {
 					if err != nil {
 						fmt.Printf("shutdown: %v\n", err)
 					}
-					go rpcs.ServeConn(conn)
+					go wire.ServeConnObserved(rpcs, conn, pb.impl.metrics.observe)
 				} else {
-					go rpcs.ServeConn(conn)
+					go wire.ServeConnObserved(rpcs, conn, pb.impl.metrics.observe)
 				}
 			} else if err == nil {
 				conn.Close()
@@ -94,12 +190,29 @@ func StartServer(vshost string, me string) *PBServer {
 		}
 	}()
 
-	go func() {
+	pb.startTicking()
+
+	return pb
+}
+
+func (pb *PBServer) startTicking() {
+	pb.impl.clock.Go(func() {
 		for pb.isdead() == false {
 			pb.tick()
-			time.Sleep(viewservice.PingInterval)
+			pb.impl.clock.Sleep(context.Background(), pb.Config().PingInterval)
 		}
-	}()
+	})
+}
 
-	return pb
+// joinNetwork serves the server on pb.impl.network, and starts it ticking.
+func (pb *PBServer) joinNetwork() {
+	left, err := pb.impl.network.Serve(pb.me, pb)
+	if err != nil {
+		log.Fatal("serve error: ", err)
+	}
+	pb.impl.left = left
+	if pb.impl.httpAddr != "" {
+		pb.startHTTP()
+	}
+	pb.startTicking()
 }
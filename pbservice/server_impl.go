@@ -1,5 +1,22 @@
 package pbservice
 
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"usc.edu/csci499/proj2/clock"
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/trace"
+	"usc.edu/csci499/proj2/viewservice"
+	"usc.edu/csci499/proj2/wire"
+)
+
 /* Notes:
 
 passing:
@@ -22,70 +39,311 @@ TestRepeatedCrashUnreliable
 //
 // GIOVANNI PART
 type PBServerImpl struct {
-	kvMap                map[string]string
-	Viewnum              uint
-	Primary              string
-	Backup               string
-	LastRequestProcessed map[int64]int64 // map of clientID to last requestID processed
+	kvMap      map[string][]byte // the bytes of a stored value are never changed, so replies and messages share them
+	Viewnum    uint
+	Primary    string
+	Backups    []string
+	Chain      bool                    // whether Primary and Backups form a replication chain
+	SyncedView uint                    // the view in which this server last received the whole database
+	LastSync   time.Time               // when this server last heard from its primary (or predecessor) that it was up to date
+	Applied    uint64                  // number of updates applied to kvMap, in the order the primary applied them
+	Clients    map[int64]*ClientRecord // map of clientID to the requests applied for it
+	synced     map[string]uint         // on the primary, the view in which each backup was last sent the database
+	forwarded  map[string]time.Time    // when an update was last forwarded successfully to each server
+	staging    *staging                // on a backup, a state transfer in progress
+	uploads    map[uploadKey]*upload   // values being uploaded ahead of the requests that use them
+	uploadSize int                     // how many bytes uploads holds, in all
+	digest     digest                  // digest of kvMap, kept up to date as it changes
+	Diverged   uint64                  // on the primary, how many times a backup was found to differ from it
+	Repaired   uint64                  // on the primary, how many digest buckets it has sent to backups to repair them
+
+	learner     bool                      // whether this server asked to be a learner
+	LearnedView uint                      // on a learner, the view of the primary whose updates it is applying
+	Learners    []string                  // the learners the viewservice told us about
+	streams     map[string]*learnerStream // on the primary, the update stream to each learner
+
+	metrics      *serverMetrics // served at /metrics
+	httpAddr     string         // where to serve HTTP, or "" not to
+	httpListener net.Listener
+	httpServer   *http.Server
+	logger       *logging.Logger // with the component and server fields; see pb.log()
+	viewLogger   viewLogger      // logger, with the role and view fields too, as of the last pb.log()
+	tracer       *trace.Tracer   // traces requests, if not nil
+	config       viewservice.Config
+	configAgrees bool // whether the viewservice's timing agreed with config, as of the last ping
+	clock        clock.Clock
+	transport    wire.Transport // carries the server's RPCs to other servers
+	network      wire.Network   // served on instead of a Unix socket, if not nil
+	left         io.Closer      // leaves network
 }
 
 // your pb.impl.* initializations here.
 func (pb *PBServer) initImpl() {
 	pb.impl = PBServerImpl{
-		kvMap:                make(map[string]string),
-		Viewnum:              0,
-		Primary:              "",
-		Backup:               "",
-		LastRequestProcessed: make(map[int64]int64),
+		kvMap:        make(map[string][]byte),
+		Viewnum:      0,
+		Primary:      "",
+		Backups:      nil,
+		Chain:        false,
+		SyncedView:   0,
+		Applied:      0,
+		Clients:      make(map[int64]*ClientRecord),
+		synced:       make(map[string]uint),
+		forwarded:    make(map[string]time.Time),
+		uploads:      make(map[uploadKey]*upload),
+		streams:      make(map[string]*learnerStream),
+		metrics:      newServerMetrics(),
+		logger:       logging.New(os.Stderr, logging.Warn),
+		config:       viewservice.DefaultConfig(),
+		configAgrees: true,
+		clock:        clock.Real,
+		transport:    wire.TransportFunc(call),
+	}
+
+}
+
+// isDuplicate reports whether the client's request has already been applied.
+func (pb *PBServer) isDuplicate(clientID int64, requestID int64) bool {
+	record, exists := pb.impl.Clients[clientID]
+	if exists && (requestID <= record.Done || record.Seen[requestID]) {
+		pb.impl.metrics.dedupHits.Inc()
+		pb.log().Debug("duplicate request", "client", clientID, "request", requestID)
+		return true
+	}
+	return false
+}
+
+// recordRequest notes that the client's request has been applied, and forgets
+// about the requests the client says it has finished with.
+func (pb *PBServer) recordRequest(clientID int64, requestID int64, done int64) {
+	record, exists := pb.impl.Clients[clientID]
+	if !exists {
+		record = &ClientRecord{Seen: make(map[int64]bool)}
+		pb.impl.Clients[clientID] = record
+	}
+	record.Seen[requestID] = true
+	if len(pb.impl.uploads) > 0 {
+		pb.forgetUploads(clientID, requestID, done)
+	}
+	if done > record.Done {
+		record.Done = done
+		for id := range record.Seen {
+			if id <= done {
+				delete(record.Seen, id)
+			}
+		}
+	}
+}
+
+// call sends an RPC to another server, over the server's transport.
+func (pb *PBServer) call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return pb.impl.transport.Call(srv, rpcname, args, reply)
+}
+
+// ping the viewservice with our view number and progress.
+func (pb *PBServer) ping() (viewservice.View, error) {
+	reply, err := pb.vs.PingReply(viewservice.PingArgs{
+		Viewnum: pb.impl.Viewnum,
+		Applied: pb.impl.Applied,
+		Learner: pb.impl.learner,
+		Config:  pb.impl.config,
+	})
+	if err == nil {
+		pb.checkConfig(reply.Config)
+	}
+	return reply.View, err
+}
+
+// isBackup reports whether this server is a backup in the view it knows about.
+func (pb *PBServer) isBackup() bool {
+	for _, backup := range pb.impl.Backups {
+		if backup == pb.me {
+			return true
+		}
 	}
+	return false
+}
+
+// view returns the view this server knows about.
+func (pb *PBServer) view() viewservice.View {
+	view := viewservice.View{
+		Viewnum: pb.impl.Viewnum,
+		Primary: pb.impl.Primary,
+		Backups: pb.impl.Backups,
+		Chain:   pb.impl.Chain,
+	}
+	if len(view.Backups) > 0 {
+		view.Backup = view.Backups[0]
+	}
+	return view
+}
 
+// adopt the given view as the one this server knows about.
+func (pb *PBServer) setView(view viewservice.View) {
+	pb.log().Info("view changed", "new_viewnum", view.Viewnum, "primary", view.Primary, "backups", strings.Join(view.Backups, ","))
+	pb.impl.Viewnum = view.Viewnum
+	pb.impl.Primary = view.Primary
+	pb.impl.Backups = view.Backups
+	pb.impl.Chain = view.Chain
+}
+
+// forwardTargets returns the servers this server must pass updates on to:
+// every backup if it is a primary, or the next server in a chain.
+func (pb *PBServer) forwardTargets() []string {
+	if pb.impl.Chain {
+		if next := pb.view().Successor(pb.me); next != "" {
+			return []string{next}
+		}
+		return nil
+	}
+	if pb.me == pb.impl.Primary {
+		return pb.impl.Backups
+	}
+	return nil
+}
+
+// servesReads reports whether this server may serve up-to-date reads in
+// realView, the view just fetched from the viewservice: the primary does, or
+// in a chain the tail does, once it has the chain's state.
+func (pb *PBServer) servesReads(realView viewservice.View) bool {
+	if realView.Chain {
+		return pb.me == realView.Tail() && (pb.me == realView.Primary || pb.impl.SyncedView == realView.Viewnum)
+	}
+	return pb.me == realView.Primary
+}
+
+// expired reports whether a request's deadline (if it has one) has passed.
+// deadlines are wall-clock times set by the client.
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// apply a Put, Append or Delete to the local copy of the database.
+// the database keeps value, which the caller must not change.
+func (pb *PBServer) apply(op string, key string, value []byte) {
+	curr, exists := pb.impl.kvMap[key]
+
+	if op == "Delete" {
+		if exists {
+			delete(pb.impl.kvMap, key)
+			pb.impl.digest.remove(key, curr)
+		}
+		pb.impl.Applied++
+		return
+	}
+
+	// if key does not exist, append should use an empty string for previous value.
+	// a stored value is clipped to its length, so the first Append to it copies
+	// it rather than writing into memory it may share; later Appends then grow it
+	// in place, past the end of what anyone else holds.
+	if op == "Put" || !exists {
+		pb.impl.kvMap[key] = value[:len(value):len(value)]
+	} else if op == "Append" {
+		pb.impl.kvMap[key] = append(curr, value...)
+	}
+	pb.impl.digest.set(key, curr, exists, pb.impl.kvMap[key])
+
+	pb.impl.Applied++
+}
+
+// forwardPut sends an update to every server in targets in parallel.
+// returns OK only if all of them applied it. otherwise some of them may
+// have applied an update that this server won't, so the backups will
+// all be sent the database again.
+func (pb *PBServer) forwardPut(targets []string, args *ForwardPutArgs) Err {
+	// a value too large for one message is uploaded ahead of the update
+	value := args.Value
+	large := len(value) > chunkSize
+	if large {
+		sent := *args
+		sent.Value = nil
+		sent.Uploaded = len(args.Value)
+		args = &sent
+	}
+
+	replies := make([]ForwardPutReply, len(targets))
+	var wg sync.WaitGroup
+	for i, backup := range targets {
+		wg.Add(1)
+		go func(i int, backup string) {
+			defer wg.Done()
+			if large {
+				if err := pb.upload(backup, args.ClientID, args.RequestID, value); err != OK {
+					replies[i].Err = err
+					return
+				}
+			}
+			pb.call(backup, "PBServer.ForwardPut", args, &replies[i])
+		}(i, backup)
+	}
+	wg.Wait()
+
+	now := pb.impl.clock.Now()
+	for i, reply := range replies {
+		if reply.Err == OK {
+			pb.impl.forwarded[targets[i]] = now
+		}
+	}
+	for _, reply := range replies {
+		if reply.Err != OK {
+			pb.impl.synced = make(map[string]uint)
+			// a backup that never replied leaves Err empty
+			if reply.Err == "" {
+				return ErrWrongServer
+			}
+			return reply.Err
+		}
+	}
+	return OK
 }
 
 // server Get() RPC handler.
 func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
-	pb.mu.Lock()
+	span := pb.startHandler(args.Impl.Trace, "PBServer.Get", "key", args.Key)
+	defer func() { endSpan(span, reply.Err) }()
+	pb.lock(span)
 	defer pb.mu.Unlock()
 
-	// log.Printf("[%s] Get RPC received with args: %+v\n", pb.me, args)
-
 	// Only primary can process Get() requests
 	// But the issue is that this server may think it is the primary, but it is not anymore in the real view
 	// So we need to check with the viewservice to see if we are still the primary
 
+	// the client has given up on requests past their deadline, so don't bother
+	if expired(args.Impl.Deadline) {
+		reply.Err = ErrExpired
+		return nil
+	}
+
 	// ping viewservice to find current view
-	realView, err := pb.vs.Ping(pb.impl.Viewnum)
+	realView, err := pb.pingTraced(span)
 
 	if err != nil {
 		return err
 	}
 
 	// if this server is the primary in the real view, then we can process the request
-	if pb.me != realView.Primary {
+	if !pb.servesReads(realView) {
+		// tell the client where to go instead, saving it a trip to the viewservice
+		pb.log().Debug("rejected request", "rpc", "Get", "client", args.Impl.ClientID, "err", ErrWrongServer, "primary", realView.Primary)
 		reply.Err = ErrWrongServer
-		return nil
-	}
-
-	// Check if the request is a duplicate and handle it
-	lastReq, exists := pb.impl.LastRequestProcessed[args.Impl.ClientID]
-	if exists && lastReq >= args.Impl.RequestID {
-		reply.Value = pb.impl.kvMap[args.Key] // Replying with value even for duplicate requests
-		reply.Err = OK
+		reply.Impl.Hint = realView
 		return nil
 	}
 
 	// Handle the actual Get() request
 	val, exists := pb.impl.kvMap[args.Key]
 	if exists {
-		reply.Value = val
 		reply.Err = OK
 	} else {
-		reply.Value = ""
-		reply.Err = ErrNoKey
+		reply.Err = ErrNoKey //if ErrNoKey, the value is empty
+	}
+	if args.Impl.Bytes {
+		reply.Impl.Data = val // shares the stored value, which is never changed
+	} else {
+		reply.Value = string(val)
 	}
 
-	// Update the LastRequestProcessed map since the request has been processed
-	pb.impl.LastRequestProcessed[args.Impl.ClientID] = args.Impl.RequestID
-
+	// a Get changes nothing, so a retried one is simply served again
 	return nil
 }
 
@@ -95,89 +353,101 @@ func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
 //
 // server PutAppend() RPC handler.
 func (pb *PBServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error {
-	pb.mu.Lock()
+	span := pb.startHandler(args.Impl.Trace, "PBServer.PutAppend", "key", args.Key, "op", args.Impl.Operation)
+	defer func() { endSpan(span, reply.Err) }()
+	pb.lock(span)
 	defer pb.mu.Unlock()
 
-	// log.Printf("[%s] PutAppend RPC received with args: %+v\n", pb.me, args)
-	// log.Printf("[%s} current primary is %s\n", pb.me, pb.impl.Primary)
-
 	// only the primary should be able to handle PutAppend requests
 	if pb.me != pb.impl.Primary {
+		pb.log().Debug("rejected request", "rpc", "PutAppend", "client", args.Impl.ClientID, "err", ErrWrongServer, "primary", pb.impl.Primary)
 		reply.Err = ErrWrongServer
+		reply.Impl.Hint = pb.view()
+		return nil
+	}
+
+	// the client has given up on requests past their deadline, so don't start
+	// one. (once forwarded to the backups, a request has to be seen through.)
+	if expired(args.Impl.Deadline) {
+		reply.Err = ErrExpired
 		return nil
 	}
 
 	// don't serve duplicate requests to ensure at most once semantics
 	//if the request is marked as processed, then the write already went through and we need not serve it again
-	if pb.impl.LastRequestProcessed[args.Impl.ClientID] == args.Impl.RequestID {
+	if pb.isDuplicate(args.Impl.ClientID, args.Impl.RequestID) {
 		// reply.Err = "Duplicate Request"
 		// for whatever reason, the originval OK reply we sent may not have reached the client, so send it again?
 		reply.Err = OK
 		return nil
 	}
 
-	if pb.impl.Backup != "" {
+	// values sent as bytes are stored (and forwarded) as they arrived,
+	// without a copy; a value sent as a string costs one
+	value := args.Impl.Data
+	if args.Impl.Uploaded > 0 {
+		var ok bool
+		if value, ok = pb.uploaded(args.Impl.ClientID, args.Impl.RequestID, args.Impl.Uploaded); !ok {
+			// the client has to upload it again
+			reply.Err = ErrOutOfOrder
+			return nil
+		}
+	} else if value == nil {
+		value = []byte(args.Value)
+	}
 
-		// forward the operation to the backup first, before making local changes
+	// a compare-and-swap is decided here, and if it goes ahead, is
+	// a plain Put (or Delete) from then on. one that doesn't go ahead
+	// changes nothing, so isn't recorded, and a retry is decided afresh.
+	op := args.Impl.Operation
+	if op == "CompareAndSwap" || op == "CompareAndDelete" {
+		if curr, exists := pb.impl.kvMap[args.Key]; !exists || !bytes.Equal(curr, args.Impl.Expect) {
+			reply.Err = ErrMismatch
+			return nil
+		}
+		if op == "CompareAndSwap" {
+			op = "Put"
+		} else {
+			op = "Delete"
+		}
+	}
+
+	if targets := pb.forwardTargets(); len(targets) > 0 {
+
+		// forward the operation to the backups (or down the chain) first, before making local changes
 
 		fwdArgs := &ForwardPutArgs{
 			ClientID:  args.Impl.ClientID,
 			RequestID: args.Impl.RequestID,
-			Operation: args.Impl.Operation,
+			Done:      args.Impl.Done,
+			Applied:   pb.impl.Applied,
+			Operation: op,
 			Key:       args.Key,
-			Value:     args.Value,
+			Value:     value,
 		}
-		var fpReply ForwardPutReply
-		call(pb.impl.Backup, "PBServer.ForwardPut", fwdArgs, &fpReply)
-
-		//check if the forward put was successful
-		if fpReply.Err == OK {
-
-			//only make the local update if the backup was successfuly updated
-			curr, exists := pb.impl.kvMap[args.Key]
-
-			// if key does not exist, append should use an empty string for previous value
-			if args.Impl.Operation == "Put" {
-				pb.impl.kvMap[args.Key] = args.Value
-			} else if args.Impl.Operation == "Append" {
-				if exists {
-					pb.impl.kvMap[args.Key] = curr + args.Value
-				} else {
-					pb.impl.kvMap[args.Key] = args.Value
-				}
-			}
-
-			pb.impl.LastRequestProcessed[args.Impl.ClientID] = args.Impl.RequestID
-
-			// we should only indicate to the client that the request was successful if the backup was also successfuly updated
-			reply.Err = OK
-			return nil
 
-		} else { //if the backup was not successfuly updated, we should not update the local state
-			reply.Err = fpReply.Err
+		//check if the forward put was successful on every backup
+		//if the backups were not all successfuly updated, we should not update the local state
+		if err := pb.forwardTraced(span, targets, fwdArgs); err != OK {
+			reply.Err = err
+			reply.Impl.Hint = pb.view()
 			return nil
 		}
 	} // END IF
 
-	// if we got to this point it means this server is the primary with NO BACKUP
-	// so don't need to worry about forwarding the put
-	// write the new value locally:
-	curr, exists := pb.impl.kvMap[args.Key]
+	// either there are no backups, or they have all been updated,
+	// so write the new value locally:
+	applying := span.Child("apply")
+	pb.apply(op, args.Key, value)
+	applying.End()
 
-	// if key does not exist, append should use an empty string for previous value
-	if args.Impl.Operation == "Put" {
-		pb.impl.kvMap[args.Key] = args.Value
-	} else if args.Impl.Operation == "Append" {
-		if exists {
-			pb.impl.kvMap[args.Key] = curr + args.Value
-		} else {
-			pb.impl.kvMap[args.Key] = args.Value
-		}
-	}
+	// learners get the update later, off the synchronous write path
+	pb.streamUpdate(op, args.Key, value)
 
 	// request served and return
-	pb.impl.LastRequestProcessed[args.Impl.ClientID] = args.Impl.RequestID
+	pb.recordRequest(args.Impl.ClientID, args.Impl.RequestID, args.Impl.Done)
 
+	// we should only indicate to the client that the request was successful if the backups were also successfuly updated
 	reply.Err = OK
 	return nil
 
@@ -191,89 +461,63 @@ func (pb *PBServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error
 func (pb *PBServer) tick() {
 	pb.mu.Lock()
 	defer pb.mu.Unlock()
-
-	// log.Printf("[%s] tick() pulse check 1 my current viewnum is %d\n", pb.me, pb.impl.Viewnum)
+	defer pb.updateGauges()
 
 	// ping viewservice to find current view
-	realView, err := pb.vs.Ping(pb.impl.Viewnum) // since "vs" is a viewservice CLERK, we can use the function Ping() which will in turn do the RPC correctly
+	realView, err := pb.ping() // since "vs" is a viewservice CLERK, we can use the function Ping() which will in turn do the RPC correctly
 
 	if err != nil {
 		return
 	}
 
-	if realView.Primary == pb.me && pb.impl.Viewnum < realView.Viewnum { // if this server is the primary in the new view, initiate view transition
-
-		//before transitioning to new view, sync up with backup (of the new view bc that is the one we will be transitioning to)
-		if realView.Backup != "" {
-
-			// log.Printf("[%s] tick() pulse check 2 bootstrap with backup %s\n", pb.me, realView.Backup)
+	// the list of learners changes without a new view
+	pb.impl.Learners = realView.Learners
 
-			//send the kv data to the backup
-			args := &ForwardDatabaseArgs{
-				Data: pb.impl.kvMap,
-			}
-			var fdbReply ForwardDatabaseReply
-			call(realView.Backup, "PBServer.ForwardDatabase", args, &fdbReply)
-
-			// log.Printf("[%s] tick() pulse check 3 result of db forward %s\n", pb.me, fdbReply.Err)
-
-			//check if the forward database was successful. only then do we update the state
-			if fdbReply.Err == OK {
-				//update the viewnum
-				pb.impl.Viewnum = realView.Viewnum
-				//update the primary and backup
-				pb.impl.Primary = realView.Primary
-				pb.impl.Backup = realView.Backup
-				//ACK the new view
-				pb.vs.Ping(pb.impl.Viewnum)
-			} else {
-				// ping with old view to indicate that view transition did not take place YET (NO ACK)
-				pb.vs.Ping(pb.impl.Viewnum)
-			}
-
-		} else { // if there is no backup, then we can just transition to the new view
+	if realView.Primary == pb.me && pb.impl.Viewnum < realView.Viewnum { // if this server is the primary in the new view, initiate view transition
 
-			//update the viewnum
-			pb.impl.Viewnum = realView.Viewnum
-			//update the primary and backup
-			pb.impl.Primary = realView.Primary
-			pb.impl.Backup = realView.Backup
+		//before transitioning to new view, sync up with the backups (of the new view bc that is the one we will be transitioning to)
+		//check if the forward database was successful on every backup. only then do we update the state
+		if pb.syncBackups(realView.Viewnum, realView.Backups) {
+			//update the viewnum, primary and backups
+			pb.setView(realView)
 			//ACK the new view
-			pb.vs.Ping(pb.impl.Viewnum)
-
+			pb.ping()
+		} else {
+			// ping with old view to indicate that view transition did not take place YET (NO ACK)
+			pb.ping()
 		}
 
 	} else if realView.Primary == pb.me && pb.impl.Viewnum >= realView.Viewnum { // this server is primary, but there is no new view to transition to
 
-		// we still have to sync database with the backup if there is one
-		if realView.Backup != "" {
-
-			//send the kv data to the backup
-			args := &ForwardDatabaseArgs{
-				Data: pb.impl.kvMap,
-			}
-			var fdbReply ForwardDatabaseReply
-			call(realView.Backup, "PBServer.ForwardDatabase", args, &fdbReply)
-
-			//check if the forward database was successful
-			if fdbReply.Err == OK {
-				//what to do here?
-			}
-
-		}
+		// we still have to sync database with the backups if there are any:
+		// those that have it just hear that they are up to date
+		pb.syncBackups(realView.Viewnum, realView.Backups)
 
 		//ping again because why not????
-		pb.vs.Ping(pb.impl.Viewnum)
+		pb.ping()
 
 	} else if realView.Primary != pb.me && pb.impl.Viewnum < realView.Viewnum { // otherwise this server is either an idle server or a backup server in the new view
+		// clients will upload to the new primary instead
+		if pb.impl.Primary == pb.me {
+			pb.dropUploads()
+		}
+
 		// backup or idle server has no responsibilities other than to stay up to date on the new view
-		pb.impl.Viewnum = realView.Viewnum
-		pb.impl.Primary = realView.Primary
-		pb.impl.Backup = realView.Backup
+		pb.setView(realView)
+
+		// and if it used to be the primary, it no longer feeds the learners
+		pb.impl.streams = make(map[string]*learnerStream)
 
 		//let the viewservice know of our change to the view state
-		pb.vs.Ping(pb.impl.Viewnum)
+		pb.ping()
+	}
+
+	// the primary keeps its learners fed, even if only with heartbeats
+	if pb.me == pb.impl.Primary {
+		pb.feedLearners()
 	}
+
+	pb.expireUploads()
 } //END TICK
 
 //
@@ -286,57 +530,140 @@ func (pb *PBServer) ForwardDatabase(args *ForwardDatabaseArgs, reply *ForwardDat
 	defer pb.mu.Unlock()
 
 	// Make sure the server recognizes it's a backup. It's a precautionary step.
-	if pb.me != pb.impl.Backup {
+	if !pb.isBackup() {
+		pb.log().Debug("rejected state transfer", "viewnum_sent", args.Viewnum, "err", ErrWrongServer)
 		reply.Err = ErrWrongServer
 		return nil
 	}
 
-	// log.Printf("[%s] ForwardDatabase RPC received with args: %+v\n", pb.me, args)
-
-	// Replace the backup's database with the incoming data from the primary.
-	pb.impl.kvMap = args.Data
-
-	// Acknowledge the receipt of the database.
-	reply.Err = OK
+	// Stage the chunk of the database; the last chunk replaces the
+	// backup's database with the incoming data from the primary.
+	pb.receiveChunk(args, reply)
 
 	return nil
 }
 
 // RPC Handler for the ForwardPut RPC.
 func (pb *PBServer) ForwardPut(args *ForwardPutArgs, reply *ForwardPutReply) error {
-	pb.mu.Lock()
+	span := pb.startHandler(args.Trace, "PBServer.ForwardPut", "key", args.Key, "op", args.Operation)
+	defer func() { endSpan(span, reply.Err) }()
+	pb.lock(span)
 	defer pb.mu.Unlock()
 
 	// Make sure the server recognizes it's a backup. It's a precautionary step.
-	if pb.me != pb.impl.Backup {
+	if !pb.isBackup() {
+		pb.log().Debug("rejected request", "rpc", "ForwardPut", "client", args.ClientID, "err", ErrWrongServer)
 		reply.Err = ErrWrongServer
 		return nil
 	}
 
+	// a backup that has never been sent the database (say, because it
+	// restarted) has nothing to apply updates to
+	if pb.impl.SyncedView == 0 {
+		pb.log().Debug("rejected request", "rpc", "ForwardPut", "client", args.ClientID, "err", ErrNotSynced)
+		reply.Err = ErrNotSynced
+		return nil
+	}
+
+	// updates have to arrive in the order the primary applies them. if this
+	// server applied an update that the primary then didn't (because some
+	// other backup failed, or our reply was lost), it is out of step until
+	// the primary sends it the database again.
+	n := uint64(1)
+	if args.Operation == "MultiPut" {
+		n = uint64(len(args.Puts))
+	}
+
 	// don't serve duplicate requests to ensure at most once semantics
-	if pb.impl.LastRequestProcessed[args.ClientID] == args.RequestID {
+	if pb.isDuplicate(args.ClientID, args.RequestID) {
 		//reply.Err = "Duplicate Request"
 		reply.Err = OK
+		if pb.impl.Applied != args.Applied+n {
+			reply.Err = ErrNotSynced
+		}
+		return nil
+	}
+	if pb.impl.Applied != args.Applied {
+		pb.log().Warn("out of step with the primary", "client", args.ClientID, "request", args.RequestID, "applied", pb.impl.Applied, "primary_applied", args.Applied)
+		reply.Err = ErrNotSynced
 		return nil
 	}
 
-	curr, exists := pb.impl.kvMap[args.Key]
+	if args.Uploaded > 0 {
+		var ok bool
+		if args.Value, ok = pb.uploaded(args.ClientID, args.RequestID, args.Uploaded); !ok {
+			reply.Err = ErrOutOfOrder
+			return nil
+		}
+	}
 
-	// if key does not exist, append should use an empty string for previous value
-	if args.Operation == "Put" {
-		pb.impl.kvMap[args.Key] = args.Value
-	} else if args.Operation == "Append" {
-		if exists {
-			pb.impl.kvMap[args.Key] = curr + args.Value
-		} else {
-			pb.impl.kvMap[args.Key] = args.Value
+	// in a chain, pass the update on down the chain before making local changes,
+	// so that an update reaches the tail (which serves reads) before anyone else
+	if targets := pb.forwardTargets(); len(targets) > 0 {
+		if err := pb.forwardTraced(span, targets, args); err != OK {
+			reply.Err = err
+			return nil
 		}
 	}
 
-	pb.impl.LastRequestProcessed[args.ClientID] = args.RequestID
+	applying := span.Child("apply")
+	if args.Operation == "MultiPut" {
+		pb.applyPuts(args.Puts)
+	} else {
+		pb.apply(args.Operation, args.Key, args.Value)
+	}
+	applying.End()
+	pb.impl.LastSync = pb.impl.clock.Now()
+
+	pb.recordRequest(args.ClientID, args.RequestID, args.Done)
 
 	//acknowledge receipt of the put
 	reply.Err = OK
 
 	return nil
 }
+
+// RPC Handler for the GetStale RPC.
+// a backup (or learner) serves the read from its own copy of the database if it heard
+// from the primary within args.MaxStaleness; the primary (or tail of a
+// chain, which is a backup too) always serves it, after checking with the
+// viewservice as Get does, since it is where clients fall back to.
+func (pb *PBServer) GetStale(args *GetStaleArgs, reply *GetStaleReply) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if expired(args.Deadline) {
+		reply.Err = ErrExpired
+		return nil
+	}
+
+	tail := pb.impl.Chain && pb.view().Tail() == pb.me
+	if (pb.isBackup() && !tail) || pb.isLearner() {
+		if pb.impl.clock.Now().Sub(pb.impl.LastSync) > args.MaxStaleness {
+			reply.Err = ErrStale
+			return nil
+		}
+	} else {
+		realView, err := pb.ping()
+		if err != nil {
+			return err
+		}
+		if !pb.servesReads(realView) {
+			pb.log().Debug("rejected request", "rpc", "GetStale", "err", ErrWrongServer, "primary", realView.Primary)
+			reply.Err = ErrWrongServer
+			return nil
+		}
+	}
+
+	val, exists := pb.impl.kvMap[args.Key]
+	if exists {
+		reply.Value = val // shares the stored value, which is never changed
+		reply.Err = OK
+	} else {
+		reply.Err = ErrNoKey
+	}
+	reply.Viewnum = pb.impl.Viewnum
+	reply.Applied = pb.impl.Applied
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package pbservice
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+// Status is what a server believes about itself and its view, as
+// served at /status.
+type Status struct {
+	Server     string   `json:"server"`
+	Role       string   `json:"role"` // primary, backup, learner or idle
+	Viewnum    uint     `json:"viewnum"`
+	Primary    string   `json:"primary"`
+	Backups    []string `json:"backups"`
+	Chain      bool     `json:"chain"`
+	Keys       int      `json:"keys"`
+	Applied    uint64   `json:"applied"`
+	Clients    int      `json:"dedup_clients"`  // clients in the table of applied requests
+	Requests   int      `json:"dedup_requests"` // requests in it, past each client's Done
+	SyncedView uint     `json:"synced_view"`    // the view in which the server last received the whole database
+
+	// how long since the server last heard from its primary (or
+	// predecessor) that it was up to date; absent if it never has
+	LastSyncAge *float64 `json:"last_sync_age_seconds,omitempty"`
+
+	// for each server this one forwards updates to, how long since one
+	// was last forwarded successfully; absent for those never forwarded to
+	LastForwardAge map[string]float64 `json:"last_forward_age_seconds"`
+
+	// the server's timing, and whether the viewservice's agreed with it
+	// as of the last ping
+	Config       viewservice.Config `json:"config"`
+	ConfigAgrees bool               `json:"config_agrees"`
+}
+
+// Status returns the server's status.
+func (pb *PBServer) Status() Status {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := pb.impl.clock.Now()
+	st := Status{
+		Server:         pb.me,
+		Role:           pb.role(),
+		Viewnum:        pb.impl.Viewnum,
+		Primary:        pb.impl.Primary,
+		Backups:        append([]string{}, pb.impl.Backups...),
+		Chain:          pb.impl.Chain,
+		Keys:           len(pb.impl.kvMap),
+		Applied:        pb.impl.Applied,
+		Clients:        len(pb.impl.Clients),
+		SyncedView:     pb.impl.SyncedView,
+		LastForwardAge: make(map[string]float64),
+		Config:         pb.impl.config,
+		ConfigAgrees:   pb.impl.configAgrees,
+	}
+	for _, record := range pb.impl.Clients {
+		st.Requests += len(record.Seen)
+	}
+	if !pb.impl.LastSync.IsZero() {
+		age := now.Sub(pb.impl.LastSync).Seconds()
+		st.LastSyncAge = &age
+	}
+	for _, target := range pb.forwardTargets() {
+		if at, ok := pb.impl.forwarded[target]; ok {
+			st.LastForwardAge[target] = now.Sub(at).Seconds()
+		}
+	}
+	return st
+}
+
+func (pb *PBServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(pb.Status())
+}
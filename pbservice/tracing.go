@@ -0,0 +1,53 @@
+package pbservice
+
+import (
+	"usc.edu/csci499/proj2/trace"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+// lock takes pb.mu, timing the wait as a child of span.
+func (pb *PBServer) lock(span *trace.Span) {
+	wait := span.Child("lock")
+	pb.mu.Lock()
+	wait.End()
+}
+
+// startHandler starts the span of an RPC handler, as a child of the
+// span the sender traced the RPC with, if any.
+func (pb *PBServer) startHandler(parent trace.SpanContext, rpcname string, kv ...interface{}) *trace.Span {
+	return pb.impl.tracer.StartRemote(parent, rpcname, append([]interface{}{"server", pb.me}, kv...)...)
+}
+
+// endSpan ends span with the answer it led to. answers other than OK
+// mark it as failed, but for ErrNoKey and ErrMismatch, which are answers
+// to the question asked rather than reasons it couldn't be.
+func endSpan(span *trace.Span, err Err) {
+	span.SetAttributes("reply", err)
+	if err != OK && err != ErrNoKey && err != ErrMismatch {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// forwardTraced is forwardPut, timed as a child of span, and with its
+// span sent along to the targets.
+func (pb *PBServer) forwardTraced(span *trace.Span, targets []string, args *ForwardPutArgs) Err {
+	fwd := span.Child("forward", "targets", len(targets))
+	fwd.SetKind(trace.Client)
+	args.Trace = fwd.Context()
+	err := pb.forwardPut(targets, args)
+	endSpan(fwd, err)
+	return err
+}
+
+// pingTraced is ping, timed as a child of span.
+func (pb *PBServer) pingTraced(span *trace.Span) (viewservice.View, error) {
+	vs := span.Child("viewservice.Ping")
+	vs.SetKind(trace.Client)
+	view, err := pb.ping()
+	if err != nil {
+		vs.SetError(err)
+	}
+	vs.End()
+	return view, err
+}
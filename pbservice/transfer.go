@@ -0,0 +1,308 @@
+package pbservice
+
+import (
+	"hash/crc32"
+	"sort"
+	"sync"
+)
+
+// the most value bytes a single state transfer or upload message carries.
+// values larger than this are split across messages.
+const chunkSize = 64 * 1024
+
+// how many times in a row the primary may fail to get a chunk to a backup
+// before it gives up on the transfer until the next tick.
+const maxChunkFailures = 3
+
+// a state transfer a backup is part-way through receiving. it is resumable
+// as long as the primary is sending the same database: same view, and
+// the same number of updates applied.
+type staging struct {
+	viewnum uint
+	applied uint64
+	data    map[string][]byte
+	next    int    // how many keys, in sorted order, have been received in full
+	partial []byte // what has been received of the next key's value
+}
+
+// chunkChecksum returns the checksum of a chunk's pieces.
+func chunkChecksum(pieces []TransferPiece) uint32 {
+	h := crc32.NewIEEE()
+	for _, piece := range pieces {
+		h.Write([]byte(piece.Key))
+		h.Write([]byte{0})
+		h.Write(piece.Data)
+		if piece.Last {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	}
+	return h.Sum32()
+}
+
+// nextChunk returns the chunk of the database that starts at the given key
+// (in the order of keys) and offset into its value. the caller must hold
+// pb.mu, and keys must be the sorted keys of the database.
+func (pb *PBServer) nextChunk(viewnum uint, keys []string, next int, offset int) *ForwardDatabaseArgs {
+	args := &ForwardDatabaseArgs{
+		Viewnum: viewnum,
+		Applied: pb.impl.Applied,
+		Next:    next,
+		Offset:  offset,
+	}
+
+	// always send at least one piece, however long the key
+	for size := 0; next < len(keys) && (size < chunkSize || len(args.Pieces) == 0); {
+		rest := pb.impl.kvMap[keys[next]][offset:]
+		if len(rest) > chunkSize-size {
+			rest = rest[:chunkSize-size]
+		}
+		piece := TransferPiece{
+			Key:  keys[next],
+			Data: rest, // shares the value's memory; gob copies it out
+			Last: offset+len(rest) == len(pb.impl.kvMap[keys[next]]),
+		}
+		args.Pieces = append(args.Pieces, piece)
+		size += len(piece.Key) + len(piece.Data)
+
+		if piece.Last {
+			next, offset = next+1, 0
+		} else {
+			offset += len(rest)
+		}
+	}
+
+	args.Checksum = chunkChecksum(args.Pieces)
+	if next == len(keys) {
+		args.Done = true
+		args.Clients = pb.impl.Clients
+		args.Root = pb.impl.digest.root()
+	}
+	return args
+}
+
+// validPosition reports whether a backup's answer to where a transfer
+// should carry on from is somewhere in the database. the caller must
+// hold pb.mu; keys are the database's sorted keys.
+func (pb *PBServer) validPosition(keys []string, next int, offset int) bool {
+	if next == len(keys) {
+		return offset == 0
+	}
+	return next >= 0 && next < len(keys) && offset >= 0 && offset <= len(pb.impl.kvMap[keys[next]])
+}
+
+// sendState sends the whole database to backup, a chunk at a time,
+// carrying on from wherever the backup got to if an earlier transfer
+// of the same database was interrupted. returns true if the backup
+// installed it. the caller must hold pb.mu, which keeps the database
+// still for the duration; keys are its sorted keys.
+func (pb *PBServer) sendState(backup string, viewnum uint, keys []string) bool {
+	// every chunk but the last carries a whole chunk's worth, or ends a
+	// value, and may take maxChunkFailures tries; a backup that takes
+	// more messages than that all told isn't getting anywhere
+	size := 0
+	for _, key := range keys {
+		size += len(key) + len(pb.impl.kvMap[key])
+	}
+	limit := maxChunkFailures * (len(keys) + size/chunkSize + 2)
+
+	// the first message carries nothing, and just finds out where the backup is
+	args := &ForwardDatabaseArgs{Viewnum: viewnum, Applied: pb.impl.Applied, Checksum: chunkChecksum(nil)}
+	failures := 0
+	start := pb.impl.clock.Now()
+	for sent := 0; ; sent++ {
+		if sent == limit {
+			pb.log().Warn("state transfer failed", "backup", backup, "reason", "no progress", "messages", sent)
+			return false
+		}
+		var reply ForwardDatabaseReply
+		ok := pb.call(backup, "PBServer.ForwardDatabase", args, &reply)
+		if ok && reply.Err == OK {
+			pb.impl.metrics.transferBytes.With("sent").Add(float64(transferSize(args.Pieces)))
+		}
+		switch {
+		case ok && reply.Err == OK && args.Done:
+			pb.impl.metrics.transferDuration.Observe(pb.impl.clock.Now().Sub(start).Seconds())
+			pb.log().Info("sent state", "backup", backup, "for_viewnum", viewnum, "keys", len(keys), "elapsed", pb.impl.clock.Now().Sub(start))
+			return true
+		case ok && reply.Err == OK:
+			failures = 0
+		case ok && (reply.Err == ErrOutOfOrder || reply.Err == ErrChecksum):
+			// after the first message, the backup should be where we think
+			failures++
+		case ok:
+			pb.log().Debug("state transfer refused", "backup", backup, "err", reply.Err)
+			return false // not (yet) a backup in this view
+		default:
+			// we don't know what the backup got; ask it next time
+			failures++
+			args = &ForwardDatabaseArgs{Viewnum: viewnum, Applied: pb.impl.Applied, Checksum: chunkChecksum(nil)}
+			if failures >= maxChunkFailures {
+				pb.log().Warn("state transfer failed", "backup", backup, "reason", "no reply")
+				return false
+			}
+			continue
+		}
+		if failures >= maxChunkFailures {
+			pb.log().Warn("state transfer failed", "backup", backup, "reason", reply.Err)
+			return false
+		}
+		if !pb.validPosition(keys, reply.Next, reply.Offset) {
+			pb.log().Warn("state transfer failed", "backup", backup, "reason", "bad position", "next", reply.Next, "offset", reply.Offset)
+			return false
+		}
+		args = pb.nextChunk(viewnum, keys, reply.Next, reply.Offset)
+	}
+}
+
+// syncBackups makes sure every one of backups has the database, in
+// parallel: backups that already have it in this view just get a
+// heartbeat, the rest get the whole database. returns true only if
+// all of them have it.
+// in a chain, the head syncs the whole chain, which is consistent
+// because every update passes through the head while it holds pb.mu.
+func (pb *PBServer) syncBackups(viewnum uint, backups []string) bool {
+	var keys []string
+	for _, backup := range backups {
+		if pb.impl.synced[backup] != viewnum {
+			keys = make([]string, 0, len(pb.impl.kvMap))
+			for key := range pb.impl.kvMap {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			break
+		}
+	}
+
+	replies := make([]Err, len(backups))
+	repaired := make([]int, len(backups)) // buckets repaired on each backup
+	var wg sync.WaitGroup
+	for i, backup := range backups {
+		wg.Add(1)
+		go func(i int, backup string) {
+			defer wg.Done()
+			if pb.impl.synced[backup] == viewnum {
+				args := &HeartbeatArgs{Viewnum: viewnum, Applied: pb.impl.Applied, Root: pb.impl.digest.root()}
+				var reply HeartbeatReply
+				pb.call(backup, "PBServer.Heartbeat", args, &reply)
+				replies[i] = reply.Err
+				if reply.Err == ErrDiverged {
+					// the backup applied the same updates, yet ended up different
+					replies[i], repaired[i] = pb.repair(backup, viewnum, reply.Buckets)
+				}
+			} else if pb.sendState(backup, viewnum, keys) {
+				replies[i] = OK
+			}
+		}(i, backup)
+	}
+	wg.Wait()
+
+	all := true
+	for i, backup := range backups {
+		if repaired[i] > 0 {
+			pb.impl.Diverged++
+			pb.impl.Repaired += uint64(repaired[i])
+			pb.impl.metrics.diverged.Inc()
+			pb.impl.metrics.repaired.Add(float64(repaired[i]))
+		}
+		if replies[i] == OK {
+			pb.impl.synced[backup] = viewnum
+		} else if replies[i] != "" {
+			// the backup has fallen out of step (or out of the view), so it
+			// is sent the database next tick. one that didn't answer at all
+			// probably still has it.
+			delete(pb.impl.synced, backup)
+		}
+		all = all && replies[i] == OK
+	}
+	return all
+}
+
+// receiveChunk adds a chunk of a state transfer to the staging area,
+// starting a new transfer if it is from a different one. once the
+// chunk that completes the transfer arrives, the database is replaced.
+// the caller must hold pb.mu.
+func (pb *PBServer) receiveChunk(args *ForwardDatabaseArgs, reply *ForwardDatabaseReply) {
+	st := pb.impl.staging
+	if st == nil || st.viewnum != args.Viewnum || st.applied != args.Applied {
+		st = &staging{viewnum: args.Viewnum, applied: args.Applied, data: make(map[string][]byte)}
+		pb.impl.staging = st
+	}
+
+	reply.Next, reply.Offset = st.next, len(st.partial)
+	if args.Next != st.next || args.Offset != len(st.partial) {
+		reply.Err = ErrOutOfOrder
+		return
+	}
+	if chunkChecksum(args.Pieces) != args.Checksum {
+		reply.Err = ErrChecksum
+		return
+	}
+	pb.impl.metrics.transferBytes.With("received").Add(float64(transferSize(args.Pieces)))
+
+	for _, piece := range args.Pieces {
+		if piece.Last && len(st.partial) == 0 {
+			st.data[piece.Key] = piece.Data
+		} else {
+			st.partial = append(st.partial, piece.Data...)
+			if piece.Last {
+				st.data[piece.Key] = st.partial
+				st.partial = nil
+			}
+		}
+		if piece.Last {
+			st.next++
+		}
+	}
+	reply.Next, reply.Offset = st.next, len(st.partial)
+
+	if args.Done {
+		// check that the backup ended up with the primary's database
+		d := digestOf(st.data)
+		if d.root() != args.Root {
+			pb.log().Warn("received state does not match the primary's; starting over", "from_viewnum", args.Viewnum)
+			pb.impl.staging = nil
+			reply.Next, reply.Offset = 0, 0
+			reply.Err = ErrChecksum
+			return
+		}
+		pb.impl.kvMap = st.data
+		pb.impl.digest = d
+		pb.impl.Applied = args.Applied
+		pb.impl.Clients = args.Clients
+		if pb.impl.Clients == nil {
+			pb.impl.Clients = make(map[int64]*ClientRecord)
+		}
+		pb.impl.SyncedView = args.Viewnum
+		pb.impl.LastSync = pb.impl.clock.Now()
+		pb.impl.staging = nil
+		pb.log().Info("received state", "keys", len(st.data), "applied", args.Applied)
+	}
+	reply.Err = OK
+}
+
+// RPC Handler for the Heartbeat RPC.
+// the primary checks in with a backup that already has the database.
+func (pb *PBServer) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if !pb.isBackup() {
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	if pb.impl.SyncedView != args.Viewnum || pb.impl.Applied != args.Applied {
+		reply.Err = ErrNotSynced
+		return nil
+	}
+	if pb.impl.digest.root() != args.Root {
+		reply.Err = ErrDiverged
+		reply.Buckets = pb.impl.digest[:]
+		return nil
+	}
+
+	pb.impl.LastSync = pb.impl.clock.Now()
+	reply.Err = OK
+	return nil
+}
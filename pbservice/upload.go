@@ -0,0 +1,212 @@
+package pbservice
+
+import (
+	"context"
+	"hash/crc32"
+	"time"
+)
+
+// the longest value that may be uploaded.
+const maxUploadSize = 64 << 20
+
+// the most bytes of uploads a server holds at once, for all its clients;
+// past that, it turns uploads away until some are used or expire.
+const maxUploadBytes = 256 << 20
+
+// how long an upload may go without a chunk arriving before the server
+// takes it that the client has given up on it, and throws it away.
+const uploadExpiry = time.Minute
+
+// identifies the request an upload is for.
+type uploadKey struct {
+	ClientID  int64
+	RequestID int64
+}
+
+// what has arrived of a value being uploaded, and when the last of it did.
+type upload struct {
+	data    []byte
+	touched time.Time
+}
+
+// RPC Handler for the Upload RPC.
+// a value too large for one message is sent ahead, a chunk at a time, to
+// the primary by the client, and to the backups by the primary. the Put
+// or Append that uses it then refers to it by the request's ID.
+func (pb *PBServer) Upload(args *UploadArgs, reply *UploadReply) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if args.Forwarded && !pb.isBackup() {
+		pb.log().Debug("rejected request", "rpc", "Upload", "client", args.ClientID, "err", ErrWrongServer)
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	if !args.Forwarded && pb.me != pb.impl.Primary {
+		pb.log().Debug("rejected request", "rpc", "Upload", "client", args.ClientID, "err", ErrWrongServer, "primary", pb.impl.Primary)
+		reply.Err = ErrWrongServer
+		reply.Hint = pb.view()
+		return nil
+	}
+
+	// the request was applied, and its upload thrown away; let the client
+	// finish, so that it finds that out
+	if pb.isDuplicate(args.ClientID, args.RequestID) {
+		reply.Received = args.Offset + len(args.Data)
+		reply.Err = OK
+		return nil
+	}
+
+	key := uploadKey{args.ClientID, args.RequestID}
+	up := pb.impl.uploads[key]
+	if up == nil {
+		up = &upload{}
+	}
+	reply.Received = len(up.data)
+	if args.Offset != len(up.data) {
+		reply.Err = ErrOutOfOrder
+		return nil
+	}
+	if crc32.ChecksumIEEE(args.Data) != args.Checksum {
+		reply.Err = ErrChecksum
+		return nil
+	}
+	if len(up.data)+len(args.Data) > maxUploadSize || pb.impl.uploadSize+len(args.Data) > maxUploadBytes {
+		pb.log().Debug("rejected request", "rpc", "Upload", "client", args.ClientID, "err", ErrTooLarge, "buffered", pb.impl.uploadSize)
+		reply.Err = ErrTooLarge
+		return nil
+	}
+
+	up.data = append(up.data, args.Data...)
+	up.touched = pb.impl.clock.Now()
+	pb.impl.uploads[key] = up
+	pb.impl.uploadSize += len(args.Data)
+	reply.Received = len(up.data)
+	reply.Err = OK
+	return nil
+}
+
+// uploaded returns the value uploaded for a request, or ok=false if
+// it hasn't all arrived. the caller must hold pb.mu.
+func (pb *PBServer) uploaded(clientID int64, requestID int64, length int) (value []byte, ok bool) {
+	up := pb.impl.uploads[uploadKey{clientID, requestID}]
+	if up == nil || len(up.data) != length {
+		return nil, false
+	}
+	return up.data, true
+}
+
+// forgetUploads throws away the uploads for a client's requests up to
+// and including done, and for requestID, which has been applied.
+// the caller must hold pb.mu.
+func (pb *PBServer) forgetUploads(clientID int64, requestID int64, done int64) {
+	for key := range pb.impl.uploads {
+		if key.ClientID == clientID && (key.RequestID <= done || key.RequestID == requestID) {
+			pb.forgetUpload(key)
+		}
+	}
+}
+
+// forgetUpload throws away one upload. the caller must hold pb.mu.
+func (pb *PBServer) forgetUpload(key uploadKey) {
+	if up := pb.impl.uploads[key]; up != nil {
+		pb.impl.uploadSize -= len(up.data)
+		delete(pb.impl.uploads, key)
+	}
+}
+
+// expireUploads throws away the uploads that their clients seem to have
+// given up on. the caller must hold pb.mu.
+func (pb *PBServer) expireUploads() {
+	now := pb.impl.clock.Now()
+	for key, up := range pb.impl.uploads {
+		if now.Sub(up.touched) > uploadExpiry {
+			pb.log().Debug("upload expired", "client", key.ClientID, "request", key.RequestID, "bytes", len(up.data))
+			pb.forgetUpload(key)
+		}
+	}
+}
+
+// dropUploads throws away every upload, for when this server stops being
+// primary. the caller must hold pb.mu.
+func (pb *PBServer) dropUploads() {
+	pb.impl.uploads = make(map[uploadKey]*upload)
+	pb.impl.uploadSize = 0
+}
+
+// upload sends value ahead to target, a chunk at a time, on behalf of a
+// client's request. the caller must hold pb.mu.
+func (pb *PBServer) upload(target string, clientID int64, requestID int64, value []byte) Err {
+	offset := 0
+	for failures := 0; failures < maxChunkFailures; {
+		end := offset + chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		args := &UploadArgs{
+			ClientID:  clientID,
+			RequestID: requestID,
+			Offset:    offset,
+			Data:      value[offset:end],
+			Forwarded: true,
+		}
+		args.Checksum = crc32.ChecksumIEEE(args.Data)
+
+		var reply UploadReply
+		if !pb.call(target, "PBServer.Upload", args, &reply) {
+			return ErrWrongServer
+		}
+		switch reply.Err {
+		case OK, ErrOutOfOrder:
+			if reply.Received >= len(value) {
+				return OK
+			}
+			offset = reply.Received
+		case ErrChecksum:
+			failures++
+		default:
+			return reply.Err
+		}
+	}
+	return ErrChecksum
+}
+
+// upload sends value ahead to the server srv, a chunk at a time, for the
+// given request. returns false if srv could not be reached; otherwise
+// srv's last reply says whether it has the whole value.
+func (ck *Clerk) upload(ctx context.Context, srv string, requestID int64, value []byte) (UploadReply, bool) {
+	offset := 0
+	for failures := 0; ; {
+		end := offset + chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		args := UploadArgs{
+			ClientID:  ck.impl.clientID,
+			RequestID: requestID,
+			Offset:    offset,
+			Data:      value[offset:end],
+			Checksum:  crc32.ChecksumIEEE(value[offset:end]),
+		}
+
+		var reply UploadReply
+		if !ck.call(ctx, srv, "PBServer.Upload", &args, &reply) {
+			return reply, false
+		}
+		switch reply.Err {
+		case OK, ErrOutOfOrder:
+			// carry on from wherever the server got to, even from an earlier attempt
+			if reply.Received >= len(value) {
+				reply.Err = OK
+				return reply, true
+			}
+			offset = reply.Received
+		case ErrChecksum:
+			if failures++; failures >= maxChunkFailures {
+				return reply, true
+			}
+		default:
+			return reply, true
+		}
+	}
+}
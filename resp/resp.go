@@ -0,0 +1,491 @@
+// Package resp serves the key/value service in the Redis protocol
+// (RESP), so that redis-cli and Redis client libraries can use it.
+//
+// Commands are sent on to the primary through a Clerk, which finds it
+// and retries as usual. The commands are
+//
+//	GET key
+//	SET key value
+//	APPEND key value    replies with the value's length afterwards
+//	DEL key [key ...]   replies with how many of the keys existed
+//	EXISTS key [key ...]
+//	MGET key [key ...]
+//	MSET key value [key value ...]
+//
+// along with PING, ECHO, QUIT and an empty COMMAND, which clients send
+// when they connect. SET takes no options. Unlike in Redis, DEL and
+// APPEND are not atomic with finding out what they reply with: another
+// client's update may come in between.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"usc.edu/csci499/proj2/pbservice"
+)
+
+// DefaultTimeout is how long a command may take, unless WithTimeout says otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// the longest bulk string, and the most arguments, a command may have.
+const (
+	maxBulk = 64 << 20
+	maxArgs = 1 << 20
+)
+
+// how many arguments, and bytes of a bulk string, room is made for on the
+// strength of a header alone; past that, buffers grow as the data arrives,
+// so a client can't make the server allocate much just by saying it will
+// send it.
+const (
+	headerArgs = 64
+	headerBulk = 64 << 10
+)
+
+// Server is a RESP front-end to the key/value service.
+type Server struct {
+	ck      *pbservice.Clerk
+	timeout time.Duration
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+}
+
+// an Option configures a Server when it is made.
+type Option func(s *Server)
+
+// WithTimeout sets how long a command keeps being retried before the
+// client is sent an error.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = d
+	}
+}
+
+// New returns a server that sends commands through ck.
+func New(ck *pbservice.Clerk, opts ...Option) *Server {
+	s := &Server{
+		ck:        ck,
+		timeout:   DefaultTimeout,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ErrClosed is returned by Serve once the server is closed.
+var ErrClosed = errors.New("resp: server closed")
+
+// Serve accepts connections on l and serves each of them, until l
+// fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.listeners, l)
+			if s.closed {
+				return ErrClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server's listeners and hangs up on its clients.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// track remembers conn, so that Close can hang up on it; returns
+// false if the server is already closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if perr, ok := err.(protocolError); ok {
+				// like Redis, say what was wrong before hanging up
+				writeError(w, "ERR Protocol error: "+string(perr))
+				w.Flush()
+			}
+			return
+		}
+		// an empty command does nothing, but may still end a pipeline
+		quit := len(args) > 0 && s.do(w, args)
+		// flush only once the pipeline of commands already sent is done
+		if r.Buffered() == 0 || quit {
+			if w.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// do carries out one command and writes its reply. returns true if
+// the client asked to hang up.
+func (s *Server) do(w *bufio.Writer, args [][]byte) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	arity := func(ok bool) bool {
+		if !ok {
+			writeError(w, "ERR wrong number of arguments for '"+strings.ToLower(name)+"' command")
+		}
+		return ok
+	}
+
+	switch name {
+	case "PING":
+		if !arity(len(args) <= 1) {
+			break
+		}
+		if len(args) == 1 {
+			writeBulk(w, args[0])
+		} else {
+			writeSimple(w, "PONG")
+		}
+
+	case "ECHO":
+		if arity(len(args) == 1) {
+			writeBulk(w, args[0])
+		}
+
+	case "QUIT":
+		writeSimple(w, "OK")
+		return true
+
+	case "COMMAND":
+		// clients ask what commands there are; they cope with not being told
+		writeArray(w, 0)
+
+	case "GET":
+		if !arity(len(args) == 1) {
+			break
+		}
+		value, exists, err := s.ck.LookupContext(ctx, string(args[0]))
+		if err != nil {
+			writeRequestError(w, err)
+		} else if !exists {
+			writeNull(w)
+		} else {
+			writeBulk(w, []byte(value))
+		}
+
+	case "SET":
+		if len(args) > 2 {
+			writeError(w, "ERR syntax error")
+			break
+		}
+		if !arity(len(args) == 2) {
+			break
+		}
+		if err := s.ck.PutBytesContext(ctx, string(args[0]), args[1]); err != nil {
+			writeRequestError(w, err)
+		} else {
+			writeSimple(w, "OK")
+		}
+
+	case "APPEND":
+		if !arity(len(args) == 2) {
+			break
+		}
+		key := string(args[0])
+		if err := s.ck.AppendBytesContext(ctx, key, args[1]); err != nil {
+			writeRequestError(w, err)
+			break
+		}
+		if value, _, err := s.ck.LookupContext(ctx, key); err != nil {
+			writeRequestError(w, err)
+		} else {
+			writeInt(w, len(value))
+		}
+
+	case "DEL":
+		if !arity(len(args) >= 1) {
+			break
+		}
+		// a key named twice is only deleted, and counted, once
+		var keys [][]byte
+		seen := make(map[string]bool)
+		for _, key := range args {
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				keys = append(keys, key)
+			}
+		}
+		n, err := s.exists(ctx, keys)
+		for _, key := range keys {
+			if err != nil {
+				break
+			}
+			err = s.ck.DeleteContext(ctx, string(key))
+		}
+		if err != nil {
+			writeRequestError(w, err)
+		} else {
+			writeInt(w, n)
+		}
+
+	case "EXISTS":
+		if !arity(len(args) >= 1) {
+			break
+		}
+		if n, err := s.exists(ctx, args); err != nil {
+			writeRequestError(w, err)
+		} else {
+			writeInt(w, n)
+		}
+
+	case "MGET":
+		if !arity(len(args) >= 1) {
+			break
+		}
+		values, err := s.ck.MultiLookupContext(ctx, keyStrings(args))
+		if err != nil {
+			writeRequestError(w, err)
+			break
+		}
+		writeArray(w, len(args))
+		for _, key := range args {
+			if value, exists := values[string(key)]; exists {
+				writeBulk(w, []byte(value))
+			} else {
+				writeNull(w)
+			}
+		}
+
+	case "MSET":
+		if !arity(len(args) >= 2 && len(args)%2 == 0) {
+			break
+		}
+		puts := make(map[string]string, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			puts[string(args[i])] = string(args[i+1]) // the last of a repeated key wins
+		}
+		if err := s.ck.MultiPutContext(ctx, puts); err != nil {
+			writeRequestError(w, err)
+		} else {
+			writeSimple(w, "OK")
+		}
+
+	default:
+		writeError(w, "ERR unknown command '"+strings.ToLower(name)+"'")
+	}
+	return false
+}
+
+// exists returns how many of keys exist, counting a repeated key each time.
+func (s *Server) exists(ctx context.Context, keys [][]byte) (int, error) {
+	values, err := s.ck.MultiLookupContext(ctx, keyStrings(keys))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, key := range keys {
+		if _, exists := values[string(key)]; exists {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func keyStrings(keys [][]byte) []string {
+	ss := make([]string, len(keys))
+	for i, key := range keys {
+		ss[i] = string(key)
+	}
+	return ss
+}
+
+// a request that isn't RESP.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "resp: protocol error: " + string(e)
+}
+
+// readCommand reads one command: an array of bulk strings, as clients
+// send, or a line of words, as people type at telnet.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = []byte(field)
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		// like Redis, take an empty or null array (*0, *-1) for no command
+		return nil, nil
+	}
+	capacity := n
+	if capacity > headerArgs {
+		capacity = headerArgs
+	}
+	args := make([][]byte, 0, capacity)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$', got '" + string(line) + "'")
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg, err := readBulk(r, size+2)
+		if err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, protocolError("bulk string not followed by CRLF")
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// readBulk reads n bytes, making room for them as they arrive.
+func readBulk(r *bufio.Reader, n int) ([]byte, error) {
+	have := n
+	if have > headerBulk {
+		have = headerBulk
+	}
+	buf := make([]byte, have)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	for len(buf) < n {
+		// double what there is, reading into the new half
+		more := len(buf)
+		if more > n-len(buf) {
+			more = n - len(buf)
+		}
+		buf = append(buf, make([]byte, more)...)
+		if _, err := io.ReadFull(r, buf[len(buf)-more:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// readLine reads a line ending in CRLF (or just LF), without the ending.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// writeRequestError tells the client about a command the Clerk gave up on.
+func writeRequestError(w *bufio.Writer, err error) {
+	if errors.Is(err, pbservice.ErrNoPrimary) {
+		writeError(w, "CLUSTERDOWN "+err.Error())
+	} else {
+		writeError(w, "TRYAGAIN "+err.Error())
+	}
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,215 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "resp-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send sends a command as an array of bulk strings, as clients do.
+func (c *client) send(args ...string) {
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		cmd += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, cmd); err != nil {
+		c.t.Fatalf("send %v: %v", args, err)
+	}
+}
+
+// reply reads a reply, and renders it as redis-cli would, more or less.
+func (c *client) reply() string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			c.t.Fatalf("reading bulk: %v", err)
+		}
+		return strconv.Quote(string(b[:n]))
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		elems := make([]string, n)
+		for i := range elems {
+			elems[i] = c.reply()
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	case '-':
+		return "(error) " + line[1:]
+	case ':':
+		return "(integer) " + line[1:]
+	}
+	return line[1:]
+}
+
+func (c *client) do(want string, args ...string) {
+	c.send(args...)
+	if got := c.reply(); got != want {
+		c.t.Fatalf("%v -> %v, expected %v", args, got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	vshost := port("v", 1)
+	vs := viewservice.StartServer(vshost)
+	defer vs.Kill()
+	time.Sleep(time.Second)
+
+	s1 := pbservice.StartServer(vshost, port("s", 1))
+	defer s1.Kill()
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings * 2)
+
+	addr := port("l", 1)
+	os.Remove(addr)
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := New(pbservice.MakeClerk(vshost, ""))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	c := &client{t, conn, bufio.NewReader(conn)}
+
+	c.do("PONG", "PING")
+	c.do(`(nil)`, "GET", "a")
+	c.do("OK", "SET", "a", "x")
+	c.do("(integer) 3", "APPEND", "a", "yz")
+	c.do(`"xyz"`, "get", "a")
+	c.do("OK", "SET", "bin", "\x00\r\n\xff")
+	c.do(`"\x00\r\n\xff"`, "GET", "bin")
+	c.do("OK", "MSET", "b", "1", "c", "2")
+	c.do(`["1" (nil) "2"]`, "MGET", "b", "missing", "c")
+	c.do("(integer) 2", "EXISTS", "a", "missing", "b")
+	c.do("(integer) 2", "DEL", "a", "a", "b", "missing")
+	c.do("(integer) 0", "EXISTS", "a", "b")
+	c.do(`"2"`, "GET", "c")
+	c.do("(error) ERR wrong number of arguments for 'get' command", "GET")
+	c.do("(error) ERR syntax error", "SET", "a", "x", "NX")
+	c.do("(error) ERR unknown command 'flushall'", "FLUSHALL")
+
+	// pipelined, and inline as typed at telnet
+	io.WriteString(conn, "SET p q\r\nGET p\r\n")
+	for _, want := range []string{"OK", `"q"`} {
+		if got := c.reply(); got != want {
+			t.Fatalf("pipelined inline command -> %v, expected %v", got, want)
+		}
+	}
+
+	// like Redis, an empty or null array is no command at all, even at the
+	// end of a pipeline
+	io.WriteString(conn, "*-1\r\n*0\r\n")
+	c.do(`"q"`, "GET", "p")
+	io.WriteString(conn, "GET p\r\n*-1\r\n")
+	if got := c.reply(); got != `"q"` {
+		t.Fatalf("GET before a null array -> %v, expected \"q\"", got)
+	}
+	c.do("PONG", "PING")
+
+	// a nonsense request gets an error, and the connection closed
+	io.WriteString(conn, "*1\r\n+GET\r\n")
+	if got := c.reply(); !strings.HasPrefix(got, "(error) ERR Protocol error") {
+		t.Fatalf("bad request -> %v, expected a protocol error", got)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after a protocol error")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	vshost := port("tv", 1)
+	vs := viewservice.StartServer(vshost)
+	defer vs.Kill()
+	time.Sleep(time.Second)
+
+	addr := port("tl", 1)
+	os.Remove(addr)
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := New(pbservice.MakeClerk(vshost, ""), WithTimeout(500*time.Millisecond))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	c := &client{t, conn, bufio.NewReader(conn)}
+
+	c.send("SET", "a", "x")
+	if got := c.reply(); !strings.HasPrefix(got, "(error) CLUSTERDOWN") {
+		t.Fatalf("SET with no primary -> %v, expected CLUSTERDOWN", got)
+	}
+}
+
+// a header alone doesn't make the server allocate much: buffers grow only
+// as the data they promise arrives.
+func TestHeaders(t *testing.T) {
+	for _, header := range []string{
+		"*1048576\r\n",
+		"*1\r\n$67108863\r\nab",
+		"*1048576\r\n$67108863\r\nab",
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < 10; i++ {
+			if _, err := readCommand(bufio.NewReader(strings.NewReader(header))); err == nil {
+				t.Fatalf("a truncated command %q was read", header)
+			}
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 10<<20 {
+			t.Fatalf("reading %q ten times allocated %v bytes", header, allocated)
+		}
+	}
+
+	// a long bulk string still arrives whole
+	value := strings.Repeat("0123456789", 100000)
+	args, err := readCommand(bufio.NewReader(strings.NewReader(
+		"*2\r\n$3\r\nSET\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")))
+	if err != nil || len(args) != 2 || string(args[1]) != value {
+		t.Fatalf("reading a long bulk string: %v", err)
+	}
+}
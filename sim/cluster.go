@@ -0,0 +1,114 @@
+package sim
+
+import (
+	"fmt"
+
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/pbservice"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+// Cluster is a viewservice and pbservice servers, running in a Sim on a
+// Network. Servers are numbered from 0, and named "pb-0", "pb-1" and so
+// on; the viewservice is named "vs".
+type Cluster struct {
+	Sim     *Sim
+	Net     *Network
+	VS      *viewservice.ViewServer
+	Servers []*pbservice.PBServer // nil for a server that is down
+
+	logger *logging.Logger
+	clerks int
+}
+
+// the viewservice's name.
+const vsName = "vs"
+
+// NewCluster starts a viewservice, and n servers, in a new Sim seeded with
+// seed. The servers log to logger, or nowhere if it is nil.
+func NewCluster(seed int64, n int, logger *logging.Logger, opts ...viewservice.Option) *Cluster {
+	if logger == nil {
+		logger = logging.Discard()
+	}
+	s := New(seed)
+	c := &Cluster{
+		Sim:     s,
+		Net:     NewNetwork(s),
+		Servers: make([]*pbservice.PBServer, n),
+		logger:  logger,
+	}
+	opts = append([]viewservice.Option{
+		viewservice.WithClock(s),
+		viewservice.WithNetwork(c.Net.Node(vsName)),
+		viewservice.WithLogger(logger),
+	}, opts...)
+	c.VS = viewservice.StartServer(vsName, opts...)
+	for i := range c.Servers {
+		c.Start(i)
+	}
+	return c
+}
+
+// Name returns the name of server i.
+func (c *Cluster) Name(i int) string {
+	return fmt.Sprintf("pb-%d", i)
+}
+
+// Start starts server i, afresh, if it is down.
+func (c *Cluster) Start(i int, opts ...pbservice.Option) {
+	if c.Servers[i] != nil {
+		return
+	}
+	opts = append([]pbservice.Option{
+		pbservice.WithClock(c.Sim),
+		pbservice.WithNetwork(c.Net.Node(c.Name(i))),
+		pbservice.WithLogger(c.logger),
+	}, opts...)
+	c.Servers[i] = pbservice.StartServer(vsName, c.Name(i), opts...)
+}
+
+// Kill crashes server i, losing its state.
+func (c *Cluster) Kill(i int) {
+	if c.Servers[i] != nil {
+		c.Servers[i].Kill()
+		c.Servers[i] = nil
+	}
+}
+
+// Clerk returns a new Clerk on the network, named "clerk-0", "clerk-1" and
+// so on. Its requests must be made from processes, such as with Sim.Run.
+func (c *Cluster) Clerk(opts ...pbservice.ClerkOption) *pbservice.Clerk {
+	name := fmt.Sprintf("clerk-%d", c.clerks)
+	c.clerks++
+	opts = append([]pbservice.ClerkOption{
+		pbservice.WithClerkClock(c.Sim),
+		pbservice.WithClerkTransport(c.Net.Node(name)),
+	}, opts...)
+	return pbservice.MakeClerk(vsName, name, opts...)
+}
+
+// View returns the viewservice's current view, without sending it a message.
+func (c *Cluster) View() viewservice.View {
+	st := c.VS.Status()
+	view := viewservice.View{
+		Viewnum:  st.Viewnum,
+		Primary:  st.Primary,
+		Backups:  st.Backups,
+		Chain:    st.Chain,
+		Learners: st.Learners,
+	}
+	if len(view.Backups) > 0 {
+		view.Backup = view.Backups[0]
+	}
+	return view
+}
+
+// Shutdown kills the viewservice and every server, and lets their
+// processes finish.
+func (c *Cluster) Shutdown() {
+	for i := range c.Servers {
+		c.Kill(i)
+	}
+	c.VS.Kill()
+	c.Sim.RunFor(c.VS.Config().PingInterval * 2)
+}
@@ -0,0 +1,219 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"usc.edu/csci499/proj2/wire"
+)
+
+// Network carries RPCs between the members of a simulated cluster. An
+// RPC is handled in the caller's goroutine, at once, by wire.Deliver.
+//
+// Each member reaches the network through a Node of its own, so that the
+// network knows who is calling whom: links can be cut, and each link
+// drops messages by a random number generator of its own, seeded from
+// the Sim's seed and the link's ends, so that what a link drops doesn't
+// depend on the order in which messages on other links were sent.
+type Network struct {
+	sim *Sim
+
+	mu       sync.Mutex
+	servers  map[string]*rpc.Server
+	links    map[link]*linkState
+	cut      map[link]bool
+	isolated map[string]bool
+	dropRate float64
+	log      []message
+}
+
+type link struct {
+	from, to string
+}
+
+type linkState struct {
+	rand *rand.Rand
+	sent int // messages sent on the link
+}
+
+// a message, as recorded for Trace.
+type message struct {
+	at      time.Time
+	link    link
+	seq     int
+	method  string
+	outcome string
+}
+
+// NewNetwork returns a network whose drops follow from s's seed.
+func NewNetwork(s *Sim) *Network {
+	return &Network{
+		sim:      s,
+		servers:  make(map[string]*rpc.Server),
+		links:    make(map[link]*linkState),
+		cut:      make(map[link]bool),
+		isolated: make(map[string]bool),
+	}
+}
+
+// SetDropRate makes the network lose each request, and each reply, with
+// probability p, as an unreliable server does. A lost reply is lost after
+// the server has handled the request.
+func (n *Network) SetDropRate(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate = p
+}
+
+// Cut stops messages between a and b, both ways.
+func (n *Network) Cut(a string, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut[link{a, b}] = true
+	n.cut[link{b, a}] = true
+}
+
+// Isolate stops messages between name and everyone else.
+func (n *Network) Isolate(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated[name] = true
+}
+
+// Heal undoes every Cut and Isolate.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut = make(map[link]bool)
+	n.isolated = make(map[string]bool)
+}
+
+// Node returns the member of the network called name, for a server to be
+// started on (it is a wire.Network) or a Clerk to send RPCs over.
+func (n *Network) Node(name string) *Node {
+	return &Node{network: n, name: name}
+}
+
+// Trace returns every message sent so far, one per line, with when it was
+// sent and what became of it. Two runs with the same seed and the same test
+// have the same trace.
+func (n *Network) Trace() string {
+	n.mu.Lock()
+	log := append([]message(nil), n.log...)
+	n.mu.Unlock()
+
+	// messages sent at the same virtual time, on different links, may be
+	// recorded in any order, so they are put in order of link.
+	sort.SliceStable(log, func(i, j int) bool {
+		a, b := log[i], log[j]
+		if !a.at.Equal(b.at) {
+			return a.at.Before(b.at)
+		}
+		if a.link != b.link {
+			return a.link.from < b.link.from || a.link.from == b.link.from && a.link.to < b.link.to
+		}
+		return a.seq < b.seq
+	})
+	var buf bytes.Buffer
+	for _, m := range log {
+		fmt.Fprintf(&buf, "%v %v->%v #%v %v %v\n", m.at.Sub(Epoch), m.link.from, m.link.to, m.seq, m.method, m.outcome)
+	}
+	return buf.String()
+}
+
+// Node is one member of a Network.
+type Node struct {
+	network *Network
+	name    string
+}
+
+// Serve makes rcvr's RPC methods callable at addr, until the returned
+// io.Closer is closed, as a server does when it is killed.
+func (node *Node) Serve(addr string, rcvr interface{}) (io.Closer, error) {
+	server := rpc.NewServer()
+	if err := server.Register(rcvr); err != nil {
+		return nil, err
+	}
+	n := node.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.servers[addr] != nil {
+		return nil, fmt.Errorf("sim: %v is already serving", addr)
+	}
+	n.servers[addr] = server
+	return closer(func() error {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.servers[addr] == server {
+			delete(n.servers, addr)
+		}
+		return nil
+	}), nil
+}
+
+type closer func() error
+
+func (c closer) Close() error { return c() }
+
+// Call sends an RPC from the node to srv.
+func (node *Node) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	n := node.network
+	l := link{node.name, srv}
+
+	n.mu.Lock()
+	state := n.links[l]
+	if state == nil {
+		h := fnv.New64a()
+		io.WriteString(h, l.from+"\x00"+l.to)
+		state = &linkState{rand: rand.New(rand.NewSource(n.sim.seed ^ int64(h.Sum64())))}
+		n.links[l] = state
+	}
+	state.sent++
+	// always draw both, so that a link's drops depend only on how many
+	// messages it has carried
+	dropRequest := state.rand.Float64() < n.dropRate
+	dropReply := state.rand.Float64() < n.dropRate
+	server := n.servers[srv]
+	connected := !n.cut[l] && !n.isolated[l.from] && !n.isolated[l.to]
+	m := message{at: n.sim.Now(), link: l, seq: state.sent, method: rpcname}
+	n.mu.Unlock()
+
+	ok := false
+	switch {
+	case server == nil:
+		m.outcome = "unreachable"
+	case !connected:
+		m.outcome = "cut"
+	case dropRequest:
+		m.outcome = "request lost"
+	default:
+		into := reply
+		if dropReply {
+			into = nil
+		}
+		err := wire.Deliver(server, rpcname, args, into)
+		switch {
+		case err != nil:
+			m.outcome = "failed: " + err.Error()
+		case dropReply:
+			m.outcome = "reply lost"
+		default:
+			m.outcome = "ok"
+			ok = true
+		}
+	}
+
+	n.mu.Lock()
+	n.log = append(n.log, m)
+	n.mu.Unlock()
+	return ok
+}
+
+var _ wire.Network = (*Node)(nil)
@@ -0,0 +1,188 @@
+// Package sim runs a whole cluster (a viewservice, pbservice servers and
+// Clerks) in one process, in virtual time, deterministically: the same
+// seed gives the same run, message for message, so a failure found with
+// a seed can be reproduced exactly with it.
+//
+// A Sim is a clock.Clock that runs one goroutine at a time. Each goroutine
+// started with Go is a process; the Sim runs the process that is due
+// soonest until it sleeps or returns, then the next, advancing virtual time
+// as it goes, and breaking ties between processes due at the same time
+// with its seeded random numbers. A Network carries RPCs between the
+// cluster's members in the caller's goroutine, dropping and cutting them
+// off as the Sim's seed and the test say. A Cluster puts the two together.
+//
+// The servers run unchanged, on the clock and network they are given,
+// which is what makes this work: nothing they do waits except through
+// the clock, and they never wait while holding a lock.
+package sim
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Epoch is when every simulation starts.
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Sim is a deterministic scheduler and virtual clock.
+type Sim struct {
+	seed  int64
+	yield chan struct{} // a running process sends when it sleeps or returns
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	now     time.Time
+	queue   wakeups
+	running bool // whether a process is running
+}
+
+// New returns a simulation whose choices all follow from seed.
+func New(seed int64) *Sim {
+	return &Sim{
+		seed:  seed,
+		yield: make(chan struct{}),
+		rand:  rand.New(rand.NewSource(seed)),
+		now:   Epoch,
+	}
+}
+
+// Seed returns the seed the simulation was made with.
+func (s *Sim) Seed() int64 {
+	return s.seed
+}
+
+// Now returns the virtual time.
+func (s *Sim) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Go starts f as a process, due to run now.
+func (s *Sim) Go(f func()) {
+	wake := make(chan struct{})
+	s.mu.Lock()
+	s.schedule(s.now, wake)
+	s.mu.Unlock()
+	go func() {
+		<-wake
+		f()
+		s.yield <- struct{}{}
+	}()
+}
+
+// Sleep lets the other processes run for d of virtual time. It must be
+// called from a process. A context ends in real time, not virtual, so
+// Sleep returns at once for one that has ended, and otherwise sleeps
+// for all of d.
+func (s *Sim) Sleep(ctx context.Context, d time.Duration) {
+	if ctx.Err() != nil {
+		return
+	}
+	wake := make(chan struct{})
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		panic("sim: Sleep called outside a process")
+	}
+	s.schedule(s.now.Add(d), wake)
+	s.mu.Unlock()
+
+	s.yield <- struct{}{}
+	<-wake
+}
+
+// schedule queues a wakeup. the caller must hold s.mu.
+func (s *Sim) schedule(at time.Time, wake chan struct{}) {
+	heap.Push(&s.queue, wakeup{at: at, tiebreak: s.rand.Int63(), wake: wake})
+}
+
+// RunFor runs processes for d of virtual time.
+func (s *Sim) RunFor(d time.Duration) {
+	s.RunUntil(s.Now().Add(d), nil)
+}
+
+// RunUntil runs processes until virtual time t, or until done (if not
+// nil) returns true, whichever is first; done is checked whenever a
+// process sleeps or returns. It reports whether done did. It must not be
+// called from a process.
+func (s *Sim) RunUntil(t time.Time, done func() bool) bool {
+	for {
+		if done != nil && done() {
+			return true
+		}
+
+		s.mu.Lock()
+		if len(s.queue) == 0 || s.queue[0].at.After(t) {
+			if s.now.Before(t) {
+				s.now = t
+			}
+			s.mu.Unlock()
+			return false
+		}
+		next := heap.Pop(&s.queue).(wakeup)
+		if next.at.After(s.now) {
+			s.now = next.at
+		}
+		s.running = true
+		s.mu.Unlock()
+
+		close(next.wake)
+		<-s.yield
+
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}
+}
+
+// Run runs f as a process, and the others alongside it, until f returns
+// or limit of virtual time has passed. It reports whether f returned.
+func (s *Sim) Run(f func(), limit time.Duration) bool {
+	var mu sync.Mutex
+	returned := false
+	s.Go(func() {
+		f()
+		mu.Lock()
+		returned = true
+		mu.Unlock()
+	})
+	return s.RunUntil(s.Now().Add(limit), func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return returned
+	})
+}
+
+// a process waiting to run.
+type wakeup struct {
+	at       time.Time
+	tiebreak int64 // between processes due at the same time
+	wake     chan struct{}
+}
+
+// wakeups is a heap of wakeups, soonest first.
+type wakeups []wakeup
+
+func (q wakeups) Len() int { return len(q) }
+
+func (q wakeups) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].tiebreak < q[j].tiebreak
+}
+
+func (q wakeups) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *wakeups) Push(x interface{}) { *q = append(*q, x.(wakeup)) }
+
+func (q *wakeups) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
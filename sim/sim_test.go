@@ -0,0 +1,284 @@
+package sim
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"usc.edu/csci499/proj2/linearizability"
+	"usc.edu/csci499/proj2/viewservice"
+)
+
+// go test ./sim -seed N reruns a failing test exactly.
+var seed = flag.Int64("seed", 1, "the seed to run the simulations with")
+
+// the longest a view change should take: the dead timeout, and a few
+// pings to be sure.
+const settle = viewservice.PingInterval * (viewservice.DeadPings + 5)
+
+func TestScheduler(t *testing.T) {
+	fmt.Printf("Test: Scheduler ...\n")
+
+	order := func(seed int64) []string {
+		s := New(seed)
+		var mu sync.Mutex
+		var got []string
+		record := func(what string) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, what+"@"+s.Now().Sub(Epoch).String())
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			name := name
+			s.Go(func() {
+				for i := 0; i < 3; i++ {
+					record(name)
+					s.Sleep(context.Background(), time.Hour)
+				}
+			})
+		}
+		start := time.Now()
+		s.RunFor(10 * time.Hour)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("ten virtual hours took %v", elapsed)
+		}
+		if !s.Now().Equal(Epoch.Add(10 * time.Hour)) {
+			t.Fatalf("ran until %v, expected 10h", s.Now().Sub(Epoch))
+		}
+		return got
+	}
+
+	got := order(*seed)
+	if len(got) != 9 {
+		t.Fatalf("processes ran %v times, expected 9: %v", len(got), got)
+	}
+	for i, what := range got {
+		if at := (time.Duration(i/3) * time.Hour).String(); what[2:] != at {
+			t.Fatalf("run %v was %v, expected at %v", i, what, at)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if again := order(*seed); fmt.Sprint(again) != fmt.Sprint(got) {
+			t.Fatalf("seed %v ran %v, then %v", *seed, got, again)
+		}
+	}
+
+	s := New(*seed)
+	if s.Run(func() { s.Sleep(context.Background(), time.Minute) }, time.Second) {
+		t.Fatalf("a process that sleeps for a minute returned within a second")
+	}
+	if !s.Run(func() {}, time.Second) {
+		t.Fatalf("a process that returns at once didn't")
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBasic(t *testing.T) {
+	fmt.Printf("Test: Simulated Put and Get ...\n")
+
+	c := NewCluster(*seed, 3, nil)
+	defer c.Shutdown()
+	c.Sim.RunFor(settle)
+
+	view := c.View()
+	if view.Primary == "" || len(view.Backups) != 1 {
+		t.Fatalf("seed %v: bad view %+v", *seed, view)
+	}
+
+	ck := c.Clerk()
+	var got string
+	if !c.Sim.Run(func() {
+		ck.Put("a", "x")
+		ck.Append("a", "y")
+		got = ck.Get("a")
+	}, time.Minute) {
+		t.Fatalf("seed %v: requests didn't finish", *seed)
+	}
+	if got != "xy" {
+		t.Fatalf("seed %v: got %q, expected xy", *seed, got)
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestFailover(t *testing.T) {
+	fmt.Printf("Test: Simulated failover ...\n")
+
+	c := NewCluster(*seed, 3, nil)
+	defer c.Shutdown()
+	c.Sim.RunFor(settle)
+
+	ck := c.Clerk()
+	c.Sim.Run(func() { ck.Put("a", "x") }, time.Minute)
+
+	for round := 0; round < 3; round++ {
+		primary := c.View().Primary
+		for i := range c.Servers {
+			if c.Name(i) == primary {
+				c.Kill(i)
+				c.Sim.RunFor(settle)
+				c.Start(i)
+			}
+		}
+		if view := c.View(); view.Primary == primary || view.Primary == "" {
+			t.Fatalf("seed %v: %v still primary after it died: %+v", *seed, primary, view)
+		}
+
+		var got string
+		if !c.Sim.Run(func() {
+			got = ck.Get("a")
+			ck.Append("a", strconv.Itoa(round))
+		}, time.Minute) {
+			t.Fatalf("seed %v: requests didn't finish after %v died", *seed, primary)
+		}
+		if want := "x" + "012"[:round]; got != want {
+			t.Fatalf("seed %v: got %q after %v died, expected %q", *seed, got, primary, want)
+		}
+		c.Sim.RunFor(settle) // for the restarted server to be brought up to date
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPartition(t *testing.T) {
+	fmt.Printf("Test: Simulated partition from the viewservice ...\n")
+
+	c := NewCluster(*seed, 3, nil)
+	defer c.Shutdown()
+	c.Sim.RunFor(settle)
+
+	history := linearizability.NewHistory(c.Sim)
+	ck := history.Client(c.Clerk())
+	c.Sim.Run(func() { ck.Put("a", "x") }, time.Minute)
+
+	// the primary can still reach the others, but not the viewservice,
+	// which moves on without it
+	old := c.View()
+	c.Net.Cut(old.Primary, vsName)
+	c.Sim.RunFor(settle)
+	view := c.View()
+	if view.Primary == old.Primary || view.Viewnum <= old.Viewnum {
+		t.Fatalf("seed %v: no new view without %v: %+v", *seed, old.Primary, view)
+	}
+
+	// a Clerk that still thinks the old primary is primary must not be
+	// served by it, since it can't know it still is
+	var got string
+	if !c.Sim.Run(func() {
+		ck.Put("a", "y")
+		got = ck.Get("a")
+	}, time.Minute) {
+		t.Fatalf("seed %v: requests didn't finish", *seed)
+	}
+	if got != "y" {
+		t.Fatalf("seed %v: got %q, expected y", *seed, got)
+	}
+
+	c.Net.Heal()
+	c.Sim.RunFor(settle)
+	if !c.Sim.Run(func() { got = ck.Get("a") }, time.Minute) || got != "y" {
+		t.Fatalf("seed %v: got %q after healing, expected y", *seed, got)
+	}
+	if err := linearizability.Check(history.Operations()); err != nil {
+		t.Fatalf("seed %v: %v", *seed, err)
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// run runs a workload of concurrent clerks on an unreliable network, with
+// servers crashing and coming back, checks that what the clerks saw was
+// linearizable, and returns the network's trace and what they read.
+func run(t *testing.T, seed int64) (string, string) {
+	c := NewCluster(seed, 3, nil)
+	defer c.Shutdown()
+	c.Net.SetDropRate(0.1)
+	c.Sim.RunFor(settle)
+
+	history := linearizability.NewHistory(c.Sim)
+	var mu sync.Mutex
+	var reads []string
+	done := 0
+	for i := 0; i < 3; i++ {
+		i := i
+		ck := history.Client(c.Clerk())
+		c.Sim.Go(func() {
+			for j := 0; j < 10; j++ {
+				ck.Append("k", strconv.Itoa(i))
+				v := ck.Get("k")
+				mu.Lock()
+				reads = append(reads, fmt.Sprintf("%v:%v", i, v))
+				mu.Unlock()
+			}
+			mu.Lock()
+			done++
+			mu.Unlock()
+		})
+	}
+	for round := 0; round < 4; round++ {
+		c.Sim.RunFor(300 * time.Millisecond)
+		c.Kill(round % 3)
+		c.Sim.RunFor(settle)
+		c.Start(round % 3)
+	}
+	finished := c.Sim.RunUntil(c.Sim.Now().Add(time.Hour), func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return done == 3
+	})
+	if !finished {
+		t.Fatalf("seed %v: the clerks didn't finish", seed)
+	}
+	if err := linearizability.Check(history.Operations()); err != nil {
+		t.Fatalf("seed %v: %v", seed, err)
+	}
+	return c.Net.Trace(), fmt.Sprint(reads)
+}
+
+func TestDeterminism(t *testing.T) {
+	fmt.Printf("Test: Same seed, same run ...\n")
+
+	trace1, reads1 := run(t, *seed)
+	for _, want := range []string{"ok", "request lost", "reply lost", "unreachable"} {
+		if !strings.Contains(trace1, " "+want+"\n") {
+			t.Fatalf("seed %v: no message was %v", *seed, want)
+		}
+	}
+	trace2, reads2 := run(t, *seed)
+	if reads1 != reads2 {
+		t.Fatalf("seed %v read\n%v\nthen\n%v", *seed, reads1, reads2)
+	}
+	if trace1 != trace2 {
+		t.Fatalf("seed %v sent different messages:\n%v", *seed, firstDifference(trace1, trace2))
+	}
+
+	trace3, _ := run(t, *seed+1)
+	if trace3 == trace1 {
+		t.Fatalf("seeds %v and %v sent the same messages", *seed, *seed+1)
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// firstDifference returns the first line on which two traces differ.
+func firstDifference(a string, b string) string {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			start := i
+			for start > 0 && a[start-1] != '\n' {
+				start--
+			}
+			end := func(s string) string {
+				for j := i; j < len(s); j++ {
+					if s[j] == '\n' {
+						return s[start:j]
+					}
+				}
+				return s[start:]
+			}
+			return end(a) + "\nrather than\n" + end(b)
+		}
+	}
+	return "one trace is longer than the other"
+}
@@ -0,0 +1,185 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// JSONExporter writes spans in the OTLP JSON format, one
+// ExportTraceServiceRequest per line, as the OpenTelemetry Collector's
+// file exporter does; the collector's file receiver (or otel-tui,
+// Jaeger's importer, and so on) can read them back.
+//
+// Each span is written as it ends, unbuffered, so that a process that
+// is killed loses none.
+type JSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer // the file, if the exporter opened one
+}
+
+// NewJSONExporter returns an exporter that writes to w.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// CreateFile returns an exporter that writes to the named file,
+// truncating it if it exists.
+func CreateFile(name string) (*JSONExporter, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJSONExporter(f)
+	e.c = f
+	return e, nil
+}
+
+// ExportSpan writes span as a line of its own.
+func (e *JSONExporter) ExportSpan(span SpanData) {
+	line, err := json.Marshal(otlpRequest(span))
+	if err != nil {
+		return // every part of the request marshals
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(line, '\n'))
+}
+
+// Close closes the file, if the exporter opened one.
+func (e *JSONExporter) Close() error {
+	if e.c == nil {
+		return nil
+	}
+	return e.c.Close()
+}
+
+// Recorder keeps the spans exported to it, for tests to look at.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *Recorder) ExportSpan(span SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
+
+// the parts of the OTLP JSON encoding that spans use. IDs are hex, and
+// 64-bit integers are strings, as the protobuf JSON mapping has them.
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 for an error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpRequest wraps span in a request of its own.
+func otlpRequest(span SpanData) otlpTraceRequest {
+	s := otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if span.Parent != (SpanID{}) {
+		s.ParentSpanID = span.Parent.String()
+	}
+	for _, attr := range span.Attributes {
+		s.Attributes = append(s.Attributes, otlpKeyValue{attr.Key, otlpValue(attr.Value)})
+	}
+	if span.Error != "" {
+		s.Status = otlpStatus{Code: 2, Message: span.Error}
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{{"service.name", otlpValue(span.Service)}}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "usc.edu/csci499/proj2/trace"
+	ss.Spans = []otlpSpan{s}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// otlpValue encodes an attribute's value by its kind; anything that
+// isn't a string, bool or number (or that says how to print itself,
+// such as a time.Duration) is recorded as it prints.
+func otlpValue(v interface{}) otlpAnyValue {
+	if _, ok := v.(fmt.Stringer); !ok && v != nil {
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.String:
+			s := rv.String()
+			return otlpAnyValue{StringValue: &s}
+		case reflect.Bool:
+			b := rv.Bool()
+			return otlpAnyValue{BoolValue: &b}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s := strconv.FormatInt(rv.Int(), 10)
+			return otlpAnyValue{IntValue: &s}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			s := strconv.FormatUint(rv.Uint(), 10)
+			return otlpAnyValue{IntValue: &s}
+		case reflect.Float32, reflect.Float64:
+			f := rv.Float()
+			return otlpAnyValue{DoubleValue: &f}
+		}
+	}
+	s := fmt.Sprint(v)
+	return otlpAnyValue{StringValue: &s}
+}
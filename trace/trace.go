@@ -0,0 +1,245 @@
+// Package trace follows a request from the Clerk that sends it, through
+// the primary, to the backups it is forwarded to, as a tree of timed
+// spans: each retry, viewservice call, lock wait, forward and apply.
+//
+// A span's context (its trace and span IDs) travels in RPC arguments, so
+// that the server handling a request can start its spans as children of
+// the client's. Finished spans go to an Exporter, such as a JSONExporter,
+// which writes them in the OpenTelemetry (OTLP) JSON format.
+//
+// A nil *Tracer traces nothing, and the nil *Span it starts ignores
+// everything done to it, so code can be instrumented unconditionally.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace: every span of one request.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within its trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is what a span's children need to know about it, and is
+// what RPC arguments carry. The zero SpanContext means "no span".
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether sc names a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Kind is the part a span plays in an RPC, as in OpenTelemetry.
+type Kind int
+
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+// Attr is a key and value recorded on a span.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData is a finished span, as exporters see it.
+type SpanData struct {
+	Service    string
+	Name       string
+	Kind       Kind
+	Context    SpanContext
+	Parent     SpanID // zero for the root of a trace
+	Start      time.Time
+	End        time.Time
+	Attributes []Attr
+	Error      string // why the span failed, or "" if it didn't
+}
+
+// Exporter is where a tracer sends its finished spans. ExportSpan may be
+// called from many goroutines at once.
+type Exporter interface {
+	ExportSpan(span SpanData)
+}
+
+// Tracer starts spans for one service, and sends them to an exporter
+// when they end.
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// NewTracer returns a tracer whose spans are of service (such as
+// "pbservice"), and go to exporter.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+// Span is an operation being timed. Its methods may be called on a nil
+// span, and then do nothing.
+type Span struct {
+	tracer *Tracer
+
+	mu   sync.Mutex
+	data SpanData
+	done bool
+}
+
+// Start starts a span: a child of the span in ctx, if there is one, or
+// else the root of a new trace. It returns ctx with the new span in it.
+// kv are attributes, alternating keys and values.
+func (t *Tracer) Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	var parent SpanContext
+	if s := FromContext(ctx); s != nil {
+		parent = s.Context()
+	}
+	s := t.start(parent, name, Internal, kv)
+	return NewContext(ctx, s), s
+}
+
+// StartRemote starts the span of a server handling an RPC: a child of
+// parent, the span context the RPC carried, or else the root of a new
+// trace if it carried none.
+func (t *Tracer) StartRemote(parent SpanContext, name string, kv ...interface{}) *Span {
+	if t == nil {
+		return nil
+	}
+	return t.start(parent, name, Server, kv)
+}
+
+func (t *Tracer) start(parent SpanContext, name string, kind Kind, kv []interface{}) *Span {
+	s := &Span{tracer: t}
+	s.data = SpanData{
+		Service: t.service,
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+	}
+	if parent.IsValid() {
+		s.data.Context.TraceID = parent.TraceID
+		s.data.Parent = parent.SpanID
+	} else {
+		rand.Read(s.data.Context.TraceID[:])
+	}
+	rand.Read(s.data.Context.SpanID[:])
+	s.data.Attributes = appendAttrs(nil, kv)
+	return s
+}
+
+// Child starts a span within s, for a part of the work s is timing.
+func (s *Span) Child(name string, kv ...interface{}) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.start(s.Context(), name, Internal, kv)
+}
+
+// Context returns the span's context, to send along with an RPC, or
+// the zero SpanContext if s is nil.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context // never changes, so needs no lock
+}
+
+// SetKind marks the span as playing kind's part in an RPC, such as
+// Client for a span around a call to a server.
+func (s *Span) SetKind(kind Kind) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Kind = kind
+}
+
+// SetAttributes records attributes, alternating keys and values.
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = appendAttrs(s.data.Attributes, kv)
+}
+
+// SetError marks the span as failed, for the reason given.
+func (s *Span) SetError(reason interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = fmt.Sprint(reason)
+}
+
+// End finishes the span and exports it. Ending it again does nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+// appendAttrs adds kv, alternating keys and values, to attrs. a key
+// without a value gets the value "(missing)".
+func appendAttrs(attrs []Attr, kv []interface{}) []Attr {
+	for i := 0; i < len(kv); i += 2 {
+		attr := Attr{Key: fmt.Sprint(kv[i]), Value: "(missing)"}
+		if i+1 < len(kv) {
+			attr.Value = kv[i+1]
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx with s in it, for Start to make children of.
+func NewContext(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the span in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(contextKey{}).(*Span)
+	return s
+}
@@ -0,0 +1,134 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpans(t *testing.T) {
+	var rec Recorder
+	tr := NewTracer("test", &rec)
+
+	ctx, root := tr.Start(context.Background(), "request", "key", "a")
+	_, child := tr.Start(ctx, "attempt")
+	remote := tr.StartRemote(child.Context(), "handler")
+	grandchild := remote.Child("apply")
+	grandchild.End()
+	remote.SetError("failed")
+	remote.End()
+	child.End()
+	root.SetAttributes("n", 1)
+	root.End()
+	root.End() // only exported once
+
+	spans := rec.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("got %v spans, expected 4", len(spans))
+	}
+	byName := make(map[string]SpanData)
+	for _, s := range spans {
+		if s.Context.TraceID != root.Context().TraceID {
+			t.Fatalf("%v is in trace %v, not %v", s.Name, s.Context.TraceID, root.Context().TraceID)
+		}
+		if s.Service != "test" || s.End.Before(s.Start) {
+			t.Fatalf("bad span %+v", s)
+		}
+		byName[s.Name] = s
+	}
+	for child, parent := range map[string]string{"attempt": "request", "handler": "attempt", "apply": "handler"} {
+		if byName[child].Parent != byName[parent].Context.SpanID {
+			t.Fatalf("%v's parent is %v, not %v", child, byName[child].Parent, parent)
+		}
+	}
+	if byName["request"].Parent != (SpanID{}) {
+		t.Fatalf("the root has a parent")
+	}
+	if byName["handler"].Kind != Server || byName["handler"].Error != "failed" {
+		t.Fatalf("bad handler span %+v", byName["handler"])
+	}
+	if attrs := byName["request"].Attributes; len(attrs) != 2 || attrs[0] != (Attr{"key", "a"}) || attrs[1] != (Attr{"n", 1}) {
+		t.Fatalf("bad attributes %v", attrs)
+	}
+
+	// a remote span without a parent starts a trace of its own
+	other := tr.StartRemote(SpanContext{}, "handler")
+	if !other.Context().IsValid() || other.Context().TraceID == root.Context().TraceID {
+		t.Fatalf("bad new trace %v", other.Context())
+	}
+}
+
+func TestNil(t *testing.T) {
+	var tr *Tracer
+	ctx, s := tr.Start(context.Background(), "request")
+	if s != nil || FromContext(ctx) != nil {
+		t.Fatalf("nil tracer started a span")
+	}
+	s.SetAttributes("a", 1)
+	s.SetError(errors.New("x"))
+	s.SetKind(Client)
+	s.Child("child").End()
+	s.End()
+	if s.Context().IsValid() || tr.StartRemote(SpanContext{}, "handler") != nil {
+		t.Fatalf("nil tracer made a span")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer("pbservice", NewJSONExporter(&buf))
+	parent := tr.StartRemote(SpanContext{}, "PBServer.PutAppend", "key", "a", "applied", uint64(3), "ok", true, "elapsed", time.Second)
+	child := parent.Child("apply")
+	child.End()
+	parent.SetError("ErrWrongServer")
+	parent.End()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %v lines, expected 2:\n%s", len(lines), buf.String())
+	}
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]interface{}
+			}
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &req); err != nil {
+		t.Fatalf("bad JSON %v: %s", err, lines[1])
+	}
+	resource := req.ResourceSpans[0].Resource.Attributes[0]
+	if resource["key"] != "service.name" || resource["value"].(map[string]interface{})["stringValue"] != "pbservice" {
+		t.Fatalf("bad resource %v", resource)
+	}
+	span := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span["traceId"] != parent.Context().TraceID.String() || span["spanId"] != parent.Context().SpanID.String() || span["parentSpanId"] != nil {
+		t.Fatalf("bad IDs %v", span)
+	}
+	if len(span["traceId"].(string)) != 32 || len(span["spanId"].(string)) != 16 {
+		t.Fatalf("bad ID lengths %v", span)
+	}
+	if span["name"] != "PBServer.PutAppend" || span["kind"] != float64(Server) {
+		t.Fatalf("bad name or kind %v", span)
+	}
+	if _, ok := span["startTimeUnixNano"].(string); !ok {
+		t.Fatalf("times aren't strings %v", span)
+	}
+	if status := span["status"].(map[string]interface{}); status["code"] != float64(2) || status["message"] != "ErrWrongServer" {
+		t.Fatalf("bad status %v", status)
+	}
+	want := `"attributes":[{"key":"key","value":{"stringValue":"a"}},{"key":"applied","value":{"intValue":"3"}},{"key":"ok","value":{"boolValue":true}},{"key":"elapsed","value":{"stringValue":"1s"}}]`
+	if !strings.Contains(lines[1], want) {
+		t.Fatalf("attributes aren't %s:\n%s", want, lines[1])
+	}
+	if !strings.Contains(lines[0], `"parentSpanId":"`+parent.Context().SpanID.String()+`"`) {
+		t.Fatalf("child has no parent: %s", lines[0])
+	}
+}
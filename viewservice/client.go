@@ -1,8 +1,10 @@
 package viewservice
 
 import (
+	"context"
 	"fmt"
-	"net/rpc"
+
+	"usc.edu/csci499/proj2/wire"
 )
 
 //
@@ -10,14 +12,30 @@ import (
 // and maintains a little state.
 //
 type Clerk struct {
-	me     string // client's name (host:port)
-	server string // viewservice's host:port
+	me        string // client's name (host:port)
+	server    string // viewservice's host:port
+	transport wire.Transport
+}
+
+// a ClerkOption configures a Clerk when it is made.
+type ClerkOption func(ck *Clerk)
+
+// WithClerkTransport sends the Clerk's RPCs over t, rather than
+// dialing the viewservice's Unix socket for each.
+func WithClerkTransport(t wire.Transport) ClerkOption {
+	return func(ck *Clerk) {
+		ck.transport = t
+	}
 }
 
-func MakeClerk(me string, server string) *Clerk {
+func MakeClerk(me string, server string, opts ...ClerkOption) *Clerk {
 	ck := new(Clerk)
 	ck.me = me
 	ck.server = server
+	ck.transport = wire.TransportFunc(call)
+	for _, opt := range opts {
+		opt(ck)
+	}
 	return ck
 }
 
@@ -37,7 +55,7 @@ func MakeClerk(me string, server string) *Clerk {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	c, errx := wire.Dial("unix", srv)
 	if errx != nil {
 		return false
 	}
@@ -54,30 +72,79 @@ func call(srv string, rpcname string,
 
 func (ck *Clerk) Ping(viewnum uint) (View, error) {
 	// prepare the arguments.
-	args := &PingArgs{}
-	args.Me = ck.me
+	args := PingArgs{}
 	args.Viewnum = viewnum
+	return ck.PingWith(args)
+}
+
+//
+// like Ping(), but lets the caller fill in the rest of
+// the arguments. args.Me is always set to the clerk's name.
+//
+func (ck *Clerk) PingWith(args PingArgs) (View, error) {
+	reply, err := ck.PingReply(args)
+	return reply.View, err
+}
+
+//
+// like PingWith(), but returns the whole reply.
+//
+func (ck *Clerk) PingReply(args PingArgs) (PingReply, error) {
+	args.Me = ck.me
 	var reply PingReply
 
 	// send an RPC request, wait for the reply.
-	ok := call(ck.server, "ViewServer.Ping", args, &reply)
+	ok := ck.transport.Call(ck.server, "ViewServer.Ping", &args, &reply)
 	if ok == false {
-		return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
+		return PingReply{}, fmt.Errorf("Ping(%v) failed", args.Viewnum)
 	}
 
-	return reply.View, nil
+	return reply, nil
 }
 
 func (ck *Clerk) Get() (View, bool) {
 	args := &GetArgs{}
 	var reply GetReply
-	ok := call(ck.server, "ViewServer.Get", args, &reply)
+	ok := ck.transport.Call(ck.server, "ViewServer.Get", args, &reply)
 	if ok == false {
 		return View{}, false
 	}
 	return reply.View, true
 }
 
+//
+// like Get(), but gives up, returning ctx.Err(), when ctx is
+// cancelled or its deadline passes; the RPC may still finish later,
+// and its reply is then thrown away.
+//
+func (ck *Clerk) GetContext(ctx context.Context) (View, error) {
+	if ctx.Done() == nil {
+		if view, ok := ck.Get(); ok {
+			return view, nil
+		}
+		return View{}, fmt.Errorf("Get() failed")
+	}
+
+	type result struct {
+		view View
+		ok   bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		view, ok := ck.Get()
+		done <- result{view, ok}
+	}()
+	select {
+	case r := <-done:
+		if !r.ok {
+			return View{}, fmt.Errorf("Get() failed")
+		}
+		return r.view, nil
+	case <-ctx.Done():
+		return View{}, ctx.Err()
+	}
+}
+
 func (ck *Clerk) Primary() string {
 	v, ok := ck.Get()
 	if ok {
@@ -85,3 +152,51 @@ func (ck *Clerk) Primary() string {
 	}
 	return ""
 }
+
+//
+// ask the view service to hand the primary role off to the
+// current backup. returns the resulting view.
+//
+func (ck *Clerk) Handoff() (View, error) {
+	args := &HandoffArgs{}
+	var reply HandoffReply
+	ok := ck.transport.Call(ck.server, "ViewServer.Handoff", args, &reply)
+	if ok == false {
+		return View{}, fmt.Errorf("Handoff() failed")
+	}
+	if reply.Err != OK {
+		return reply.View, fmt.Errorf("Handoff(): %v", reply.Err)
+	}
+	return reply.View, nil
+}
+
+//
+// ask the view service to take server out of the view and
+// stop scheduling it. returns the resulting view.
+//
+func (ck *Clerk) Drain(server string) (View, error) {
+	args := &DrainArgs{Server: server}
+	var reply DrainReply
+	ok := ck.transport.Call(ck.server, "ViewServer.Drain", args, &reply)
+	if ok == false {
+		return View{}, fmt.Errorf("Drain(%v) failed", server)
+	}
+	if reply.Err != OK {
+		return reply.View, fmt.Errorf("Drain(%v): %v", server, reply.Err)
+	}
+	return reply.View, nil
+}
+
+//
+// mark server as unschedulable (or schedulable again), so the
+// view service won't pick it as a new primary or backup.
+//
+func (ck *Clerk) Cordon(server string, unschedulable bool) error {
+	args := &CordonArgs{Server: server, Unschedulable: unschedulable}
+	var reply CordonReply
+	ok := ck.transport.Call(ck.server, "ViewServer.Cordon", args, &reply)
+	if ok == false {
+		return fmt.Errorf("Cordon(%v) failed", server)
+	}
+	return nil
+}
@@ -22,6 +22,22 @@ import "time"
 // view; and inform the view server of the most recent view
 // that the p/b server knows about.
 //
+// In chain replication mode the view is an ordered chain
+// instead: the primary is the head of the chain and the
+// backups follow it in order. Writes enter at the head
+// and flow down the chain; reads are served by the tail.
+// When a server in the chain fails the view server drops
+// it and keeps the rest in order; new servers join at the
+// tail.
+//
+// Learners are extra servers outside the view proper: they
+// receive a stream of updates from the primary asynchronously,
+// to serve reads that may be stale and to act as warm standbys.
+// The view server only picks a learner as a backup if there is
+// no idle server. A server asks to be a learner in its Pings.
+// The list of learners changes without a new view number, and
+// needs no acknowledgement from the primary.
+//
 // The view server proceeds to a new view when either it hasn't
 // received a ping from the primary or backup for a while, or
 // if there was no backup and a new server starts Pinging.
@@ -34,17 +50,66 @@ import "time"
 //
 
 type View struct {
-	Viewnum uint
-	Primary string
-	Backup  string
+	Viewnum  uint
+	Primary  string
+	Backup   string   // the first of Backups, or "" if there are none
+	Backups  []string // all the backups, in the order they joined the view
+	Chain    bool     // whether Primary and Backups form a replication chain
+	Learners []string // live learners that are not in the view, sorted
+}
+
+// Tail returns the last server in the chain: the last backup,
+// or the primary if there are no backups.
+func (v View) Tail() string {
+	if len(v.Backups) == 0 {
+		return v.Primary
+	}
+	return v.Backups[len(v.Backups)-1]
+}
+
+// Successor returns the server that follows server in the chain,
+// or "" if server is the tail or not in the view.
+func (v View) Successor(server string) string {
+	if server == "" {
+		return ""
+	}
+	if server == v.Primary {
+		if len(v.Backups) == 0 {
+			return ""
+		}
+		return v.Backups[0]
+	}
+	for i, backup := range v.Backups {
+		if backup == server && i+1 < len(v.Backups) {
+			return v.Backups[i+1]
+		}
+	}
+	return ""
+}
+
+// IsBackup reports whether server is one of the view's backups.
+func (v View) IsBackup(server string) bool {
+	for _, backup := range v.Backups {
+		if backup == server {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMember reports whether server is the view's primary or one of its backups.
+func (v View) IsMember(server string) bool {
+	return server != "" && (server == v.Primary || v.IsBackup(server))
 }
 
 // clients should send a Ping RPC this often,
 // to tell the viewservice that the client is alive.
+// this is the default; see Config.
 const PingInterval = time.Millisecond * 100
 
 // the viewserver will declare a client dead if it misses
 // this many Ping RPCs in a row.
+// this is the default; see Config.
 const DeadPings = 5
 
 //
@@ -53,17 +118,32 @@ const DeadPings = 5
 // has seen the latest view, and for p/b server to learn
 // the latest view.
 //
+// Config is the caller's failure-detection timing. Until
+// the two agree, the view server gives the caller whichever
+// of its own dead timeout and the caller's is longer.
+//
 // If Viewnum is zero, the caller is signalling that it is
 // alive and could become backup if needed.
 //
+// Applied tells the view server how many updates the caller
+// has applied, so that when the primary fails it can promote
+// the most up-to-date backup.
+//
+// Learner asks the view server to treat the caller as a
+// learner rather than an idle server.
+//
 
 type PingArgs struct {
 	Me      string // "host:port"
 	Viewnum uint   // caller's notion of current view #
+	Applied uint64 // number of updates the caller has applied
+	Learner bool   // caller wants to be a learner
+	Config  Config // caller's timing, for the view server to check; zero if unknown
 }
 
 type PingReply struct {
-	View View
+	View   View
+	Config Config // the view server's timing
 }
 
 //
@@ -78,3 +158,55 @@ type GetArgs struct {
 type GetReply struct {
 	View View
 }
+
+//
+// administrative RPCs, for planned maintenance.
+//
+// Handoff(): move the primary role to the current backup
+// without waiting for the primary to time out. the view
+// service only hands off once the primary has acknowledged
+// the current view, which it does only after it has brought
+// the backup up to date, and the backup has seen that view.
+//
+// Drain(): take a server out of the view (handing off first
+// if it is the primary) and mark it unschedulable.
+//
+// Cordon()/Uncordon(): mark a server as (un)schedulable.
+// the view service never picks an unschedulable server as
+// a new primary or backup, but leaves it in place if it is
+// already serving.
+//
+
+const (
+	OK          = "OK"
+	ErrNotReady = "ErrNotReady" // view not yet acknowledged, or backup not caught up
+	ErrNoBackup = "ErrNoBackup" // no backup to hand off to
+)
+
+type Err string
+
+type HandoffArgs struct {
+}
+
+type HandoffReply struct {
+	Err  Err
+	View View
+}
+
+type DrainArgs struct {
+	Server string
+}
+
+type DrainReply struct {
+	Err  Err
+	View View
+}
+
+type CordonArgs struct {
+	Server        string
+	Unschedulable bool
+}
+
+type CordonReply struct {
+	Err Err
+}
@@ -0,0 +1,201 @@
+package viewservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Config is a deployment's failure-detection timing. Servers ping the
+// viewservice every PingInterval, and the viewservice declares a server
+// dead once it has gone about DeadPings intervals without a ping, so the
+// viewservice and the servers must agree on both; a server's pings
+// carry its Config, and the viewservice warns about one that disagrees.
+//
+// PhiThreshold is how suspicious of a server the viewservice's failure
+// detector must be to declare it dead; see detector. Raising it gives
+// servers whose pings are irregular longer before they are. It must be
+// at least 1: at log10(2) or below, a server is as suspected the moment
+// a ping is due as it ever is, and the detector can't tell anything.
+//
+// The retry backoffs are how long a Clerk waits before trying a request
+// again: RetryBackoff at first, doubling after each failure in a row up
+// to MaxRetryBackoff.
+type Config struct {
+	PingInterval    time.Duration
+	DeadPings       int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	PhiThreshold    float64
+}
+
+// DefaultConfig returns the timing used unless a server is told otherwise:
+// PingInterval and DeadPings, a fixed backoff of 100ms, and a phi
+// threshold of 8.
+func DefaultConfig() Config {
+	return Config{
+		PingInterval:    PingInterval,
+		DeadPings:       DeadPings,
+		RetryBackoff:    100 * time.Millisecond,
+		MaxRetryBackoff: 100 * time.Millisecond,
+		PhiThreshold:    8,
+	}
+}
+
+// Validate returns an error describing what is wrong with c, if anything.
+func (c Config) Validate() error {
+	switch {
+	case c.PingInterval <= 0:
+		return fmt.Errorf("viewservice: ping interval %v is not positive", c.PingInterval)
+	case c.DeadPings < 1:
+		return fmt.Errorf("viewservice: dead pings %v is less than one", c.DeadPings)
+	case c.RetryBackoff <= 0:
+		return fmt.Errorf("viewservice: retry backoff %v is not positive", c.RetryBackoff)
+	case c.MaxRetryBackoff < c.RetryBackoff:
+		return fmt.Errorf("viewservice: max retry backoff %v is less than retry backoff %v", c.MaxRetryBackoff, c.RetryBackoff)
+	case !(c.PhiThreshold >= 1 && c.PhiThreshold <= 300):
+		return fmt.Errorf("viewservice: phi threshold %v is not between 1 and 300", c.PhiThreshold)
+	}
+	return nil
+}
+
+// DeadTimeout is how long a server whose pings are regular may go
+// without pinging before it is declared dead.
+func (c Config) DeadTimeout() time.Duration {
+	return time.Duration(c.DeadPings) * c.PingInterval
+}
+
+// Agrees reports whether c and other detect failures the same way. The
+// retry backoffs are up to each client, and the phi threshold to the
+// viewservice, so they may differ.
+func (c Config) Agrees(other Config) bool {
+	return c.PingInterval == other.PingInterval && c.DeadPings == other.DeadPings
+}
+
+// Backoff returns how long to wait before retrying a request that has
+// failed failures times in a row.
+func (c Config) Backoff(failures int) time.Duration {
+	d := c.RetryBackoff
+	for i := 1; i < failures && d < c.MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxRetryBackoff {
+		d = c.MaxRetryBackoff
+	}
+	return d
+}
+
+// Config returns the viewservice's timing.
+func (vs *ViewServer) Config() Config {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+	return vs.impl.config
+}
+
+// SetConfig changes the viewservice's timing while it runs, if c is
+// valid. The servers should be changed to match; until they are, they
+// are warned about, and each is given whichever dead timeout is longer.
+func (vs *ViewServer) SetConfig(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+	vs.impl.config = c
+	vs.impl.logger.Info("timing changed", "ping_interval", c.PingInterval, "dead_pings", c.DeadPings, "phi_threshold", c.PhiThreshold)
+	for server, state := range vs.impl.servers {
+		if state.config != (Config{}) && !state.config.Agrees(c) {
+			vs.impl.logger.Warn("server's timing disagrees", "peer", server,
+				"ping_interval", state.config.PingInterval, "dead_pings", state.config.DeadPings,
+				"want_ping_interval", c.PingInterval, "want_dead_pings", c.DeadPings)
+		}
+	}
+	return nil
+}
+
+// Config in JSON, with durations as strings such as "100ms".
+type configJSON struct {
+	PingInterval    string  `json:"ping_interval,omitempty"`
+	DeadPings       int     `json:"dead_pings,omitempty"`
+	RetryBackoff    string  `json:"retry_backoff,omitempty"`
+	MaxRetryBackoff string  `json:"max_retry_backoff,omitempty"`
+	PhiThreshold    float64 `json:"phi_threshold,omitempty"`
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(configJSON{
+		PingInterval:    c.PingInterval.String(),
+		DeadPings:       c.DeadPings,
+		RetryBackoff:    c.RetryBackoff.String(),
+		MaxRetryBackoff: c.MaxRetryBackoff.String(),
+		PhiThreshold:    c.PhiThreshold,
+	})
+}
+
+// UnmarshalJSON sets the fields that data has, and leaves the rest alone,
+// so that a change to one field can be sent on its own.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	var j configJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{
+		{j.PingInterval, &c.PingInterval},
+		{j.RetryBackoff, &c.RetryBackoff},
+		{j.MaxRetryBackoff, &c.MaxRetryBackoff},
+	} {
+		if d.s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.s)
+		if err != nil {
+			return err
+		}
+		*d.d = v
+	}
+	if j.DeadPings != 0 {
+		c.DeadPings = j.DeadPings
+	}
+	if j.PhiThreshold != 0 {
+		c.PhiThreshold = j.PhiThreshold
+	}
+	return nil
+}
+
+// ConfigHandler serves a config: GET returns it as JSON, and PUT changes
+// the fields given in the JSON request body, with set, which may refuse
+// the change.
+func ConfigHandler(get func() Config, set func(Config) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c := get()
+			if err := json.Unmarshal(body, &c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := set(c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(get())
+	})
+}
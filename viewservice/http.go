@@ -0,0 +1,40 @@
+package viewservice
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"usc.edu/csci499/proj2/logging"
+)
+
+// Handler returns the handler for the viewservice's HTTP endpoints, for
+// serving them somewhere other than WithHTTPAddr's address.
+func (vs *ViewServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", vs.impl.metrics.registry)
+	mux.Handle("/loglevel", logging.LevelHandler(vs.impl.logger))
+	mux.HandleFunc("/status", vs.serveStatus)
+	mux.Handle("/config", ConfigHandler(vs.Config, vs.SetConfig))
+	return mux
+}
+
+// HTTPAddr returns the address the viewservice serves HTTP on, or "" if
+// it wasn't started WithHTTPAddr.
+func (vs *ViewServer) HTTPAddr() string {
+	if vs.impl.httpListener == nil {
+		return ""
+	}
+	return vs.impl.httpListener.Addr().String()
+}
+
+// startHTTP starts serving HTTP at vs.impl.httpAddr, until the viewservice is killed.
+func (vs *ViewServer) startHTTP() {
+	l, e := net.Listen("tcp", vs.impl.httpAddr)
+	if e != nil {
+		log.Fatal("listen error: ", e)
+	}
+	vs.impl.httpListener = l
+	vs.impl.httpServer = &http.Server{Handler: vs.Handler()}
+	go vs.impl.httpServer.Serve(l)
+}
@@ -0,0 +1,66 @@
+package viewservice
+
+import (
+	"time"
+
+	"usc.edu/csci499/proj2/metrics"
+)
+
+// the metrics the viewservice keeps, served at /metrics.
+type vsMetrics struct {
+	registry *metrics.Registry
+	calls    *metrics.CounterVec
+	failed   *metrics.CounterVec
+	latency  *metrics.HistogramVec
+}
+
+func (vs *ViewServer) newMetrics() *vsMetrics {
+	r := metrics.NewRegistry()
+	m := &vsMetrics{
+		registry: r,
+		calls:    r.NewCounterVec("viewservice_rpc_requests_total", "RPCs served, by method.", "method"),
+		failed:   r.NewCounterVec("viewservice_rpc_failures_total", "RPCs whose handler returned an error, by method.", "method"),
+		latency:  r.NewHistogramVec("viewservice_rpc_duration_seconds", "How long RPCs took to serve, by method.", nil, "method"),
+	}
+
+	// the rest are read from the viewservice's state when they're served
+	r.NewGaugeFunc("viewservice_view_number", "The current view.", func(set func(float64, ...string)) {
+		vs.impl.mu.Lock()
+		defer vs.impl.mu.Unlock()
+		set(float64(vs.impl.currentView.Viewnum))
+	})
+	r.NewGaugeFunc("viewservice_view_acknowledged", "1 if the primary has acknowledged the current view, else 0.", func(set func(float64, ...string)) {
+		vs.impl.mu.Lock()
+		defer vs.impl.mu.Unlock()
+		if vs.impl.acknowledged {
+			set(1)
+		} else {
+			set(0)
+		}
+	})
+	r.NewGaugeFunc("viewservice_last_ping_age_seconds", "How long since each server last pinged.", func(set func(float64, ...string)) {
+		vs.impl.mu.Lock()
+		defer vs.impl.mu.Unlock()
+		now := vs.impl.clock.Now()
+		for server, state := range vs.impl.servers {
+			set(now.Sub(state.lastPing).Seconds(), server)
+		}
+	}, "server")
+	r.NewGaugeFunc("viewservice_suspicion", "The failure detector's phi for each server: how strongly it is suspected of having failed.", func(set func(float64, ...string)) {
+		vs.impl.mu.Lock()
+		defer vs.impl.mu.Unlock()
+		for server, state := range vs.impl.servers {
+			set(vs.suspicion(state), server)
+		}
+	}, "server")
+	return m
+}
+
+// observe is a wire.Observer that counts and times RPCs.
+func (m *vsMetrics) observe(method string, elapsed time.Duration, failed bool) {
+	m.calls.With(method).Inc()
+	m.latency.With(method).Observe(elapsed.Seconds())
+	if failed {
+		m.failed.With(method).Inc()
+	}
+}
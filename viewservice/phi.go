@@ -0,0 +1,120 @@
+package viewservice
+
+import (
+	"math"
+	"time"
+)
+
+// how many of a server's most recent intervals between pings the failure
+// detector remembers.
+const phiSamples = 100
+
+// detector is a phi-accrual failure detector (Hayashibara et al.), for one
+// server. rather than calling a server dead after a fixed time without a
+// ping, it learns how far apart the server's pings usually are, and how
+// much that varies, and judges a silence by how unlikely it is: phi is
+// -log10 of the probability that a ping this late is still to come, so a
+// phi of 8 means one chance in 10^8 that the server is merely slow.
+//
+// a server whose pings arrive like clockwork is suspected after about
+// the dead timeout, as before; one whose pings are jittery (from GC
+// pauses, or a loaded network) is given longer, in proportion.
+type detector struct {
+	last      time.Time       // when the last ping arrived
+	intervals []time.Duration // between the recent pings, oldest first
+	sum       float64         // of intervals, in seconds
+	sumSq     float64         // of their squares
+}
+
+// heartbeat records a ping that arrived at now.
+func (d *detector) heartbeat(now time.Time) {
+	if !d.last.IsZero() {
+		interval := now.Sub(d.last)
+		if len(d.intervals) == phiSamples {
+			oldest := d.intervals[0].Seconds()
+			d.sum -= oldest
+			d.sumSq -= oldest * oldest
+			d.intervals = d.intervals[1:]
+		}
+		d.intervals = append(d.intervals, interval)
+		d.sum += interval.Seconds()
+		d.sumSq += interval.Seconds() * interval.Seconds()
+	}
+	d.last = now
+}
+
+// reset forgets the server's history, for when it comes back after being
+// declared dead: the silence was a failure, not jitter to allow for.
+func (d *detector) reset() {
+	*d = detector{}
+}
+
+// phi returns how strongly the server is suspected of having failed, as of
+// now, judged with timing c.
+//
+// the pings are expected every PingInterval, or further apart if they have
+// been: a server that pings more often (as pbservice servers do while they
+// serve requests) shouldn't be expected to keep it up. the spread is at
+// least enough that perfectly regular pings reach c.PhiThreshold after the
+// dead timeout, so a quiet network behaves as it did with a fixed timeout.
+func (d *detector) phi(now time.Time, c Config) float64 {
+	if d.last.IsZero() {
+		return 0
+	}
+	mean := c.PingInterval.Seconds()
+	variance := 0.0
+	if n := float64(len(d.intervals)); n > 0 {
+		if m := d.sum / n; m > mean {
+			mean = m
+		}
+		variance = d.sumSq/n - (d.sum/n)*(d.sum/n)
+	}
+	stddev := math.Sqrt(math.Max(variance, 0))
+	if min := c.minStddev(); stddev < min {
+		stddev = min
+	}
+	return phi(now.Sub(d.last).Seconds(), mean, stddev)
+}
+
+// minStddev is the least spread the detector assumes: enough that pings
+// every PingInterval reach the threshold after DeadTimeout().
+func (c Config) minStddev() float64 {
+	slack := c.DeadTimeout() - c.PingInterval
+	if slack <= 0 {
+		slack = c.PingInterval / 2
+	}
+	return slack.Seconds() / phiDeviations(c.PhiThreshold)
+}
+
+// phiDeviations returns how many standard deviations past the mean a ping
+// must be late for phi to reach threshold.
+func phiDeviations(threshold float64) float64 {
+	return math.Sqrt2 * math.Erfcinv(2*math.Pow(10, -threshold))
+}
+
+// finitePhi returns phi, or 0 if it is NaN, or the largest float64 if it is
+// infinite, so that it can be exported (JSON has neither), and so that a
+// detector that can't judge a server doesn't declare it dead.
+func finitePhi(phi float64) float64 {
+	switch {
+	case math.IsNaN(phi):
+		return 0
+	case math.IsInf(phi, 0):
+		return math.Copysign(math.MaxFloat64, phi)
+	}
+	return phi
+}
+
+// phi returns -log10 of the probability that a ping from a server whose
+// pings are normally distributed, with the given mean and standard
+// deviation, arrives more than elapsed after the last.
+func phi(elapsed, mean, stddev float64) float64 {
+	y := (elapsed - mean) / stddev
+	if p := 0.5 * math.Erfc(y/math.Sqrt2); p > 0 {
+		return -math.Log10(p)
+	}
+	// p underflowed; use the tail's asymptote, which is as close by now,
+	// so that phi keeps growing rather than becoming infinite
+	x := y / math.Sqrt2
+	return x*x/math.Ln10 + math.Log10(2*x*math.Sqrt(math.Pi))
+}
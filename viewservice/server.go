@@ -1,6 +1,7 @@
 package viewservice
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -8,7 +9,10 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
-	"time"
+
+	"usc.edu/csci499/proj2/clock"
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/wire"
 )
 
 type ViewServer struct {
@@ -27,7 +31,15 @@ type ViewServer struct {
 //
 func (vs *ViewServer) Kill() {
 	atomic.StoreInt32(&vs.dead, 1)
-	vs.l.Close()
+	if vs.l != nil {
+		vs.l.Close()
+	}
+	if vs.impl.left != nil {
+		vs.impl.left.Close()
+	}
+	if vs.impl.httpServer != nil {
+		vs.impl.httpServer.Close()
+	}
 }
 
 //
@@ -41,10 +53,81 @@ func (vs *ViewServer) GetRPCCount() int32 {
 	return atomic.LoadInt32(&vs.rpccount)
 }
 
-func StartServer(me string) *ViewServer {
+// an Option configures a ViewServer when it is started.
+type Option func(vs *ViewServer)
+
+// WithBackups sets how many backups each view should have
+// (the replication factor, less one). the default is one.
+func WithBackups(n int) Option {
+	return func(vs *ViewServer) {
+		vs.impl.nbackups = n
+	}
+}
+
+// WithChain makes the views replication chains rather than
+// a primary with a star of backups.
+func WithChain() Option {
+	return func(vs *ViewServer) {
+		vs.impl.chain = true
+	}
+}
+
+// WithHTTPAddr serves the viewservice's metrics over HTTP, at /metrics
+// on addr, a TCP address such as ":9100", its log level at /loglevel,
+// its state at /status, and its timing at /config.
+func WithHTTPAddr(addr string) Option {
+	return func(vs *ViewServer) {
+		vs.impl.httpAddr = addr
+	}
+}
+
+// WithConfig sets the viewservice's timing, rather than DefaultConfig().
+// StartServer fails if it isn't valid.
+func WithConfig(c Config) Option {
+	return func(vs *ViewServer) {
+		vs.impl.config = c
+	}
+}
+
+// WithClock runs the viewservice on c, rather than on clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(vs *ViewServer) {
+		vs.impl.clock = c
+	}
+}
+
+// WithNetwork serves the viewservice on n, under its name, rather than
+// on a Unix socket.
+func WithNetwork(n wire.Network) Option {
+	return func(vs *ViewServer) {
+		vs.impl.network = n
+	}
+}
+
+// WithLogger sends the viewservice's logs to l, rather than to standard
+// error at level warn.
+func WithLogger(l *logging.Logger) Option {
+	return func(vs *ViewServer) {
+		vs.impl.logger = l
+	}
+}
+
+func StartServer(me string, opts ...Option) *ViewServer {
 	vs := new(ViewServer)
 	vs.me = me
 	vs.initImpl()
+	for _, opt := range opts {
+		opt(vs)
+	}
+	vs.impl.logger = vs.impl.logger.With("component", "viewservice", "server", me)
+	if err := vs.impl.config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if vs.impl.network != nil {
+		vs.joinNetwork()
+		return vs
+	}
 
 	// tell net/rpc about our RPC server and handlers.
 	rpcs := rpc.NewServer()
@@ -59,13 +142,17 @@ func StartServer(me string) *ViewServer {
 	}
 	vs.l = l
 
+	if vs.impl.httpAddr != "" {
+		vs.startHTTP()
+	}
+
 	// create a thread to accept RPC connections from clients.
 	go func() {
 		for vs.isdead() == false {
 			conn, err := vs.l.Accept()
 			if err == nil && vs.isdead() == false {
 				atomic.AddInt32(&vs.rpccount, 1)
-				go rpcs.ServeConn(conn)
+				go wire.ServeConnObserved(rpcs, conn, vs.impl.metrics.observe)
 			} else if err == nil {
 				conn.Close()
 			}
@@ -76,13 +163,30 @@ func StartServer(me string) *ViewServer {
 		}
 	}()
 
-	// create a thread to call tick() periodically.
-	go func() {
+	vs.startTicking()
+
+	return vs
+}
+
+// create a thread to call tick() periodically.
+func (vs *ViewServer) startTicking() {
+	vs.impl.clock.Go(func() {
 		for vs.isdead() == false {
 			vs.tick()
-			time.Sleep(PingInterval)
+			vs.impl.clock.Sleep(context.Background(), vs.Config().PingInterval)
 		}
-	}()
+	})
+}
 
-	return vs
+// joinNetwork serves the viewservice on vs.impl.network, and starts it ticking.
+func (vs *ViewServer) joinNetwork() {
+	left, err := vs.impl.network.Serve(vs.me, vs)
+	if err != nil {
+		log.Fatal("serve error: ", err)
+	}
+	vs.impl.left = left
+	if vs.impl.httpAddr != "" {
+		vs.startHTTP()
+	}
+	vs.startTicking()
 }
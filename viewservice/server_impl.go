@@ -1,16 +1,28 @@
 package viewservice
 
 import (
-	// "fmt"
-
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"usc.edu/csci499/proj2/clock"
+	"usc.edu/csci499/proj2/logging"
+	"usc.edu/csci499/proj2/wire"
 )
 
 // the state of each key-value server, whether primary or backup or idle
 type serverState struct {
 	lastPing time.Time // last time we received a ping from it
 	viewNum  uint      // the view number it is on
+	applied  uint64    // how many updates it has applied, as of its last ping
+	learner  bool      // whether it asked to be a learner
+	config   Config    // the timing it said it has, as of its last ping
+	detector detector  // how suspicious its silences are
 }
 
 // additions to ViewServer state.
@@ -19,6 +31,18 @@ type ViewServerImpl struct {
 	currentView  View
 	servers      map[string]*serverState // map of the key-value server -> it's state
 	acknowledged bool                    // whether the primary has acknowledged the current view
+	cordoned     map[string]bool         // servers that must not be picked as a new primary or backup
+	nbackups     int                     // how many backups each view should have, if there are enough servers
+	chain        bool                    // whether views are replication chains
+	metrics      *vsMetrics              // served at /metrics
+	httpAddr     string                  // where to serve HTTP, or "" not to
+	httpListener net.Listener
+	httpServer   *http.Server
+	logger       *logging.Logger // with the component and server fields
+	config       Config
+	clock        clock.Clock
+	network      wire.Network // served on instead of a Unix socket, if not nil
+	left         io.Closer    // leaves network
 }
 
 // your vs.impl.* initializations here.
@@ -28,7 +52,202 @@ func (vs *ViewServer) initImpl() {
 		currentView:  View{Viewnum: 0},
 		servers:      make(map[string]*serverState),
 		acknowledged: true,
+		cordoned:     make(map[string]bool),
+		nbackups:     1,
+		logger:       logging.New(os.Stderr, logging.Warn),
+		config:       DefaultConfig(),
+		clock:        clock.Real,
+	}
+	vs.impl.metrics = vs.newMetrics()
+}
+
+// timing returns the timing to judge a server by. while a new timing is being
+// rolled out, a server whose timing disagrees with ours is judged by whichever
+// has the longer dead timeout, so that it isn't declared dead just for pinging
+// at the rate it was told to.
+func (vs *ViewServer) timing(state *serverState) Config {
+	c := vs.impl.config
+	if state.config.DeadTimeout() > c.DeadTimeout() {
+		c.PingInterval = state.config.PingInterval
+		c.DeadPings = state.config.DeadPings
+	}
+	return c
+}
+
+// suspicion returns the failure detector's phi for a server: how strongly it
+// is suspected of having failed. it is always finite.
+func (vs *ViewServer) suspicion(state *serverState) float64 {
+	return finitePhi(state.detector.phi(vs.impl.clock.Now(), vs.timing(state)))
+}
+
+// alive reports whether a server has pinged recently enough to be considered up,
+// which Ping and tick both decide by the failure detector.
+func (vs *ViewServer) alive(state *serverState) bool {
+	return vs.suspicion(state) <= vs.impl.config.PhiThreshold
+}
+
+// idleServer returns a live, schedulable server that is neither the primary nor
+// a backup of view, nor a learner, or "" if there is none. if initialized is
+// set, the server must also have seen a view (viewNum > 0).
+func (vs *ViewServer) idleServer(view View, initialized bool) string {
+	// in order of name, so that the choice is the same every time
+	servers := make([]string, 0, len(vs.impl.servers))
+	for server := range vs.impl.servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		serverState := vs.impl.servers[server]
+		if view.IsMember(server) || serverState.learner {
+			continue
+		}
+		if vs.impl.cordoned[server] || !vs.alive(serverState) {
+			continue
+		}
+		if initialized && serverState.viewNum == 0 {
+			continue
+		}
+		return server
 	}
+	return ""
+}
+
+// standbyLearner returns a live, schedulable learner that is not in view,
+// or "" if there is none.
+func (vs *ViewServer) standbyLearner(view View) string {
+	for _, learner := range vs.impl.currentView.Learners {
+		if !view.IsMember(learner) && !vs.impl.cordoned[learner] && vs.alive(vs.impl.servers[learner]) {
+			return learner
+		}
+	}
+	return ""
+}
+
+// fillBackups adds idle servers to view until it has as many backups as
+// configured, or there are no idle servers left. learners already have
+// most of the state, so they stand in when there are no idle servers.
+func (vs *ViewServer) fillBackups(view *View) {
+	for len(view.Backups) < vs.impl.nbackups {
+		idle := vs.idleServer(*view, false)
+		if idle == "" {
+			idle = vs.standbyLearner(*view)
+		}
+		if idle == "" {
+			break
+		}
+		view.Backups = append(view.Backups, idle)
+	}
+}
+
+// updateLearners recomputes the list of live learners that are not in the
+// current view. this does not need a new view.
+func (vs *ViewServer) updateLearners() {
+	learners := []string{}
+	for server, serverState := range vs.impl.servers {
+		if serverState.learner && vs.alive(serverState) && !vs.impl.currentView.IsMember(server) {
+			learners = append(learners, server)
+		}
+	}
+	sort.Strings(learners)
+	vs.impl.currentView.Learners = learners
+}
+
+// changeView moves to the next view with the given primary and backups.
+// the new view must be acknowledged by its primary before it can change again.
+func (vs *ViewServer) changeView(primary string, backups []string) {
+	vs.impl.currentView = View{
+		Viewnum:  vs.impl.currentView.Viewnum + 1,
+		Primary:  primary,
+		Backups:  backups,
+		Chain:    vs.impl.chain,
+		Learners: vs.impl.currentView.Learners,
+	}
+	if len(backups) > 0 {
+		vs.impl.currentView.Backup = backups[0]
+	}
+	vs.impl.acknowledged = false
+	vs.impl.logger.Info("view changed", "viewnum", vs.impl.currentView.Viewnum, "primary", primary, "backups", strings.Join(backups, ","))
+}
+
+// updateView moves to a new view if the primary or any of the backups
+// have died, or if there is room in the view for another backup. it does
+// nothing until the primary has acknowledged the current view.
+func (vs *ViewServer) updateView() {
+	if !vs.impl.acknowledged {
+		return
+	}
+
+	view := vs.impl.currentView
+	primary, exists := vs.impl.servers[view.Primary]
+	if !exists {
+		return
+	}
+
+	// drop the backups that have died
+	next := View{Viewnum: view.Viewnum, Primary: view.Primary}
+	var dead []string
+	for _, backup := range view.Backups {
+		if vs.alive(vs.impl.servers[backup]) {
+			next.Backups = append(next.Backups, backup)
+		} else {
+			dead = append(dead, backup)
+		}
+	}
+
+	// If primary is dead or restarted
+	if !vs.alive(primary) || primary.viewNum == 0 {
+		//only promote a backup to primary if it is initialized (viewNum > 0),
+		//and prefer the one that has applied the most updates. on ties, prefer
+		//the earliest, which in a chain keeps the new head closest to the old one
+		best := -1
+		for i, backup := range next.Backups {
+			state := vs.impl.servers[backup]
+			if state.viewNum == 0 {
+				continue
+			}
+			if best < 0 || state.applied > vs.impl.servers[next.Backups[best]].applied {
+				best = i
+			}
+		}
+
+		if best >= 0 {
+			next.Primary = next.Backups[best]
+			next.Backups = append(next.Backups[:best:best], next.Backups[best+1:]...)
+		} else if len(view.Backups) > 0 && len(next.Backups) == 0 {
+			//if the primary and all the backups failed, an initialized idle server (if any) takes over
+			next.Primary = vs.idleServer(next, true)
+			if next.Primary == "" {
+				return
+			}
+		} else {
+			// nobody can take over yet
+			return
+		}
+	}
+
+	vs.fillBackups(&next)
+
+	if next.Primary != view.Primary || !sameServers(next.Backups, view.Backups) {
+		if next.Primary != view.Primary {
+			vs.impl.logger.Warn("replacing primary", "viewnum", view.Viewnum, "primary", view.Primary, "restarted", vs.alive(primary))
+		}
+		if len(dead) > 0 {
+			vs.impl.logger.Warn("dropping dead backups", "viewnum", view.Viewnum, "backups", strings.Join(dead, ","))
+		}
+		vs.changeView(next.Primary, next.Backups)
+	}
+}
+
+func sameServers(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // server Ping() RPC handler.
@@ -36,121 +255,62 @@ func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
 	vs.impl.mu.Lock()
 	defer vs.impl.mu.Unlock()
 
-	//track whether we have incremented the view yet to ensure it only happens once in a ping
-	incrementedView := false
-
 	// the key-value server that sent this ping
 	server := args.Me
 	// state of this key-value server
 	state, exists := vs.impl.servers[server]
 
-	// fmt.Printf("Received ping from %s", server)
-	if exists {
-		// fmt.Printf(" with state, last ping %s and view number %d \n", state.lastPing.String(), state.viewNum)
-	}
-
 	//if the server isn't tracked, make a state for it and add it to the map of servers
 	if !exists {
 		state = &serverState{}
 		vs.impl.servers[server] = state
-		// fmt.Print(" with no state, so making new one \n")
+		vs.impl.logger.Debug("new server", "peer", server, "learner", args.Learner)
 	}
 
-	// set the new ping time and view number
-	state.lastPing = time.Now()
-	state.viewNum = args.Viewnum
+	// a server that was declared dead starts its history afresh
+	if exists && !vs.alive(state) {
+		state.detector.reset()
+	}
 
-	// set the state of the server in impl.servers with the updated values
-	vs.impl.servers[server] = state
+	// set the new ping time, view number and progress
+	state.lastPing = vs.impl.clock.Now()
+	state.detector.heartbeat(state.lastPing)
+	state.viewNum = args.Viewnum
+	state.applied = args.Applied
+	state.learner = args.Learner
+	if args.Config != state.config && args.Config != (Config{}) && !args.Config.Agrees(vs.impl.config) {
+		vs.impl.logger.Warn("server's timing disagrees", "peer", server,
+			"ping_interval", args.Config.PingInterval, "dead_pings", args.Config.DeadPings,
+			"want_ping_interval", vs.impl.config.PingInterval, "want_dead_pings", vs.impl.config.DeadPings)
+	}
+	state.config = args.Config
 
 	// if the viewNum of the key-value server is 0, it restarted or is unititialized
-	if args.Viewnum == 0 {
-		//add it again to the server list with the new state (viewNum of 0, but will be updated)
-		vs.impl.servers[server] = state
-
-		//this is the case for the very first ping from the very first server (ACK is initialized to true)
-		if len(vs.impl.servers) == 1 && vs.impl.acknowledged {
-			vs.impl.currentView.Primary = server
-			if !incrementedView {
-				vs.impl.currentView.Viewnum++
-				incrementedView = true
-			}
-			vs.impl.acknowledged = false
-		}
+	//this is the case for the very first ping from the very first server (ACK is initialized to true)
+	if args.Viewnum == 0 && len(vs.impl.servers) == 1 && vs.impl.acknowledged && !vs.impl.cordoned[server] {
+		vs.changeView(server, nil)
 	}
 
 	// If this ping is the primary server acknowledging the current view
 	if server == vs.impl.currentView.Primary && args.Viewnum == vs.impl.currentView.Viewnum {
+		if !vs.impl.acknowledged {
+			vs.impl.logger.Debug("view acknowledged", "viewnum", args.Viewnum, "primary", server)
+		}
 		vs.impl.acknowledged = true
 	}
 
 	// only progress the view if the current view is acknowledged
-	if vs.impl.acknowledged {
-		curr := vs.impl.currentView.Primary
-		// proper way to use the map
-		if primary, existed := vs.impl.servers[curr]; existed { // body only runs if the exist is true
-			prevPing := primary.lastPing
-
-			// If primary is dead or restarted
-			if time.Since(prevPing) > DeadPings*PingInterval || primary.viewNum == 0 {
-
-				// fmt.Print("pulse check 1\n")
-
-				//only promote backup to primary if backup is initialized (viewNum > 0)
-				if vs.impl.currentView.Backup != "" {
-					if vs.impl.servers[vs.impl.currentView.Backup].viewNum > 0 {
-						vs.impl.currentView.Primary = vs.impl.currentView.Backup
-						vs.impl.currentView.Backup = ""
-						if !incrementedView {
-							vs.impl.currentView.Viewnum++
-							incrementedView = true
-						}
-						vs.impl.acknowledged = false
-					}
-				}
-			}
-
-			// If backup is dead
-			if vs.impl.currentView.Backup != "" && time.Since(vs.impl.servers[vs.impl.currentView.Backup].lastPing) > DeadPings*PingInterval {
-				// fmt.Print("pulse check 2\n")
-				vs.impl.currentView.Backup = ""
-				if !incrementedView {
-					vs.impl.currentView.Viewnum++
-					incrementedView = true
-				}
-				vs.impl.acknowledged = false
-
-				// If there's no backup, select one
-			} else if vs.impl.currentView.Backup == "" {
-				for s, sState := range vs.impl.servers {
-
-					// fmt.Printf("Checking server %s with the state time %s viewNum %d \n", s, sState.lastPing.String(), sState.viewNum)
-
-					if s != vs.impl.currentView.Primary && time.Since(sState.lastPing) <= DeadPings*PingInterval {
-						vs.impl.currentView.Backup = s
-						if !incrementedView {
-							vs.impl.currentView.Viewnum++
-							incrementedView = true
-						}
-						vs.impl.acknowledged = false
-						break
-					}
-				}
-			}
-
-		}
-
-	}
-
-	// fmt.Printf("[ping] Current view is %d with primary %s and backup %s\n", vs.impl.currentView.Viewnum, vs.impl.currentView.Primary, vs.impl.currentView.Backup)
+	vs.updateView()
+	vs.updateLearners()
 	reply.View = vs.impl.currentView
+	reply.Config = vs.impl.config
 	return nil
 }
 
 // server Get() RPC handler.
 func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
-	vs.mu.Lock()
-	defer vs.mu.Unlock()
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
 
 	reply.View = vs.impl.currentView
 
@@ -161,107 +321,107 @@ func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
 // if servers have died or recovered, and change the view
 // accordingly.
 func (vs *ViewServer) tick() {
-	vs.mu.Lock()
-	defer vs.mu.Unlock()
-	// log.Printf("[viewservice] pulse check 1. the current viewnum is %d and the primary and backups are %s and %s \n", vs.impl.currentView.Viewnum, vs.impl.currentView.Primary, vs.impl.currentView.Backup)
-
-	//track whether we have incremented the view yet to ensure it only happens once in a tick
-	incrementedView := false
-
-	curr := vs.impl.currentView.Primary
-	if primary, existed := vs.impl.servers[curr]; existed {
-
-		next := vs.impl.currentView.Backup
-		if backup, exists := vs.impl.servers[next]; exists {
-
-			if vs.impl.acknowledged {
-				//for all the following test cases, we make sure server is not primary or backup (so "server" is an idle server)
-				//then we check the state of primary and backup to see how we should update the view
-
-				// log.Printf("pulse check 2\n")
-
-				//if ONLY the primary failed, the backup should become the primary and an idle server (if any) should become the backup
-				if time.Since(primary.lastPing) > DeadPings*PingInterval &&
-					time.Since(backup.lastPing) <= DeadPings*PingInterval {
-
-					idleServer := ""
-
-					for server, serverState := range vs.impl.servers {
-						//we need to make sure the server is not the primary or backup and that it is alive, otherwise it is not a valid idle server
-						if server != vs.impl.currentView.Primary && server != vs.impl.currentView.Backup && time.Since(serverState.lastPing) <= DeadPings*PingInterval {
-							idleServer = server
-							break
-						}
-					}
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
 
-					// log.Printf("backup and primary are %s, %s\n", vs.impl.currentView.Backup, vs.impl.currentView.Primary)
-					// log.Printf("backup's viewnum is %d\n", backup.viewNum)
+	vs.updateView()
+	vs.updateLearners()
+}
 
-					//only promote backup to primary if backup is initialized (viewNum > 0)
-					if backup.viewNum > 0 {
-						vs.impl.currentView.Primary = vs.impl.currentView.Backup
-						vs.impl.currentView.Backup = idleServer
+// server Handoff() RPC handler.
+// promotes a backup to primary once the primary has acknowledged the
+// current view (and so has brought the backups up to date) and the
+// backup has seen that view. the old primary stays on as a backup
+// unless it is cordoned.
+func (vs *ViewServer) Handoff(args *HandoffArgs, reply *HandoffReply) error {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
 
-						if !incrementedView {
-							vs.impl.currentView.Viewnum++
-							incrementedView = true
-						}
-						vs.impl.acknowledged = false
-					}
-				}
+	reply.Err = vs.handoff()
+	reply.View = vs.impl.currentView
+	return nil
+}
 
-				//if ONLY the backup failed but the primary did not, we remove the backup and an idle server (if any) should become the backup
-				if time.Since(backup.lastPing) > DeadPings*PingInterval &&
-					time.Since(primary.lastPing) <= DeadPings*PingInterval {
+// handoff does the work of Handoff(); the caller must hold vs.impl.mu.
+func (vs *ViewServer) handoff() Err {
+	view := vs.impl.currentView
+	if len(view.Backups) == 0 {
+		return ErrNoBackup
+	}
+	if !vs.impl.acknowledged {
+		return ErrNotReady
+	}
 
-					idleServer := ""
+	// the primary only acknowledges a view after its state transfer to the
+	// backups succeeded, so a backup that has seen the acknowledged view is
+	// caught up.
+	next := View{Viewnum: view.Viewnum}
+	for _, backup := range view.Backups {
+		state := vs.impl.servers[backup]
+		if next.Primary == "" && vs.alive(state) && state.viewNum == view.Viewnum {
+			next.Primary = backup
+		} else {
+			next.Backups = append(next.Backups, backup)
+		}
+	}
+	if next.Primary == "" {
+		return ErrNotReady
+	}
 
-					for server, serverState := range vs.impl.servers {
-						//we need to make sure the server is not the primary or backup and that it is alive, otherwise it is not a valid idle server
-						if server != vs.impl.currentView.Primary && server != vs.impl.currentView.Backup && time.Since(serverState.lastPing) <= DeadPings*PingInterval {
-							idleServer = server
-							break
-						}
-					}
+	// keep the old primary around as a backup if we may
+	if primary, exists := vs.impl.servers[view.Primary]; exists && vs.alive(primary) && primary.viewNum != 0 && !vs.impl.cordoned[view.Primary] {
+		next.Backups = append(next.Backups, view.Primary)
+	}
+	vs.fillBackups(&next)
 
-					vs.impl.currentView.Backup = idleServer
+	vs.changeView(next.Primary, next.Backups)
+	return OK
+}
 
-					if !incrementedView {
-						vs.impl.currentView.Viewnum++
-						incrementedView = true
-					}
-					vs.impl.acknowledged = false
-				}
+// server Drain() RPC handler.
+// cordons the server and then takes it out of the view: a backup is
+// replaced by an idle server (if any), a primary hands off to a backup.
+func (vs *ViewServer) Drain(args *DrainArgs, reply *DrainReply) error {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
 
-				//if both the primary and backup failed, an idle server (if any) should become the primary and the backup should be empty
-				if time.Since(backup.lastPing) > DeadPings*PingInterval &&
-					time.Since(primary.lastPing) > DeadPings*PingInterval {
-
-					idleServer := ""
-
-					for server, serverState := range vs.impl.servers {
-						//we need to make sure the server is not the primary or backup and that it is alive, otherwise it is not a valid idle server
-						//here we also need to verify the idle server is initialized (viewNum > 0)
-						if server != vs.impl.currentView.Primary && server != vs.impl.currentView.Backup && time.Since(serverState.lastPing) <= DeadPings*PingInterval && serverState.viewNum > 0 {
-							idleServer = server
-							break
-						}
-					}
-
-					vs.impl.currentView.Primary = idleServer
-					vs.impl.currentView.Backup = ""
-
-					if !incrementedView {
-						vs.impl.currentView.Viewnum++
-						incrementedView = true
-					}
-					vs.impl.acknowledged = false
+	vs.impl.cordoned[args.Server] = true
+
+	reply.Err = OK
+	view := vs.impl.currentView
+	if args.Server == view.Primary {
+		reply.Err = vs.handoff()
+	} else if view.IsBackup(args.Server) {
+		if !vs.impl.acknowledged {
+			reply.Err = ErrNotReady
+		} else {
+			next := View{Viewnum: view.Viewnum, Primary: view.Primary}
+			for _, backup := range view.Backups {
+				if backup != args.Server {
+					next.Backups = append(next.Backups, backup)
 				}
 			}
+			vs.fillBackups(&next)
+			vs.changeView(next.Primary, next.Backups)
 		}
-
 	}
 
-	// fmt.Printf("[tick] Current view is %d with primary %s and backup %s\n", vs.impl.currentView.Viewnum, vs.impl.currentView.Primary, vs.impl.currentView.Backup)
+	reply.View = vs.impl.currentView
+	return nil
+}
+
+// server Cordon() RPC handler.
+// marks a server as (un)schedulable; does not change the current view.
+func (vs *ViewServer) Cordon(args *CordonArgs, reply *CordonReply) error {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
 
+	if args.Unschedulable {
+		vs.impl.cordoned[args.Server] = true
+	} else {
+		delete(vs.impl.cordoned, args.Server)
+	}
+
+	reply.Err = OK
+	return nil
 }
@@ -0,0 +1,77 @@
+package viewservice
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Status is the viewservice's state, as served at /status.
+type Status struct {
+	Server       string                  `json:"server"`
+	Viewnum      uint                    `json:"viewnum"`
+	Primary      string                  `json:"primary"`
+	Backups      []string                `json:"backups"`
+	Chain        bool                    `json:"chain"`
+	Learners     []string                `json:"learners"`
+	Acknowledged bool                    `json:"acknowledged"` // whether the primary has acknowledged the view
+	Config       Config                  `json:"config"`
+	Servers      map[string]ServerStatus `json:"servers"`
+}
+
+// ServerStatus is what the viewservice knows of a key/value server.
+type ServerStatus struct {
+	LastPingAge float64 `json:"last_ping_age_seconds"`
+	Viewnum     uint    `json:"viewnum"` // the view it last said it was in
+	Applied     uint64  `json:"applied"` // how many updates it had applied, as of its last ping
+	Alive       bool    `json:"alive"`
+	Suspicion   float64 `json:"suspicion"` // the failure detector's phi; dead past the config's phi_threshold
+	Learner     bool    `json:"learner"`
+	Cordoned    bool    `json:"cordoned"`
+	Config      *Config `json:"config,omitempty"` // the timing it said it has, if it did
+	Agrees      bool    `json:"config_agrees"`    // whether that timing agrees with the viewservice's
+}
+
+// Status returns the viewservice's state.
+func (vs *ViewServer) Status() Status {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+
+	view := vs.impl.currentView
+	st := Status{
+		Server:       vs.me,
+		Viewnum:      view.Viewnum,
+		Primary:      view.Primary,
+		Backups:      append([]string{}, view.Backups...),
+		Chain:        view.Chain,
+		Learners:     append([]string{}, view.Learners...),
+		Acknowledged: vs.impl.acknowledged,
+		Config:       vs.impl.config,
+		Servers:      make(map[string]ServerStatus, len(vs.impl.servers)),
+	}
+	now := vs.impl.clock.Now()
+	for server, state := range vs.impl.servers {
+		ss := ServerStatus{
+			LastPingAge: now.Sub(state.lastPing).Seconds(),
+			Viewnum:     state.viewNum,
+			Applied:     state.applied,
+			Alive:       vs.alive(state),
+			Suspicion:   vs.suspicion(state),
+			Learner:     state.learner,
+			Cordoned:    vs.impl.cordoned[server],
+			Agrees:      state.config == (Config{}) || state.config.Agrees(vs.impl.config),
+		}
+		if state.config != (Config{}) {
+			config := state.config
+			ss.Config = &config
+		}
+		st.Servers[server] = ss
+	}
+	return st
+}
+
+func (vs *ViewServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(vs.Status())
+}
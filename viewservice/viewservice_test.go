@@ -1,12 +1,21 @@
 package viewservice
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"usc.edu/csci499/proj2/logging"
 )
 
 func compareViews(view View, p string, b string, n uint) {
@@ -201,3 +210,413 @@ func Test1(t *testing.T) {
 
 	vs.Kill()
 }
+
+func TestAdmin(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("admin-v")
+	vs := StartServer(vshost)
+
+	ck1 := MakeClerk(port("admin-1"), vshost)
+	ck2 := MakeClerk(port("admin-2"), vshost)
+	ck3 := MakeClerk(port("admin-3"), vshost)
+	admin := MakeClerk("", vshost)
+
+	ck1.Ping(0)
+	ck1.Ping(1)
+	ck2.Ping(0)
+	check(t, ck1, ck1.me, ck2.me, 2)
+
+	fmt.Printf("Test: Handoff waits for primary to ack ...\n")
+
+	{
+		if _, err := admin.Handoff(); err == nil {
+			t.Fatalf("Handoff succeeded before primary acked the view")
+		}
+		check(t, ck1, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Handoff promotes backup ...\n")
+
+	{
+		ck1.Ping(2)
+		ck2.Ping(2)
+		v, err := admin.Handoff()
+		if err != nil {
+			t.Fatalf("Handoff failed: %v", err)
+		}
+		if v.Primary != ck2.me || v.Backup != ck1.me || v.Viewnum != 3 {
+			t.Fatalf("wrong view after Handoff: %v", v)
+		}
+		check(t, ck2, ck2.me, ck1.me, 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Drained and cordoned servers are not scheduled ...\n")
+
+	{
+		if err := admin.Cordon(ck3.me, true); err != nil {
+			t.Fatalf("Cordon failed: %v", err)
+		}
+		ck3.Ping(0)
+		ck2.Ping(3)
+		ck1.Ping(3)
+		v, err := admin.Drain(ck1.me)
+		if err != nil {
+			t.Fatalf("Drain failed: %v", err)
+		}
+		if v.Primary != ck2.me || v.Backup != "" {
+			t.Fatalf("wrong view after Drain: %v", v)
+		}
+
+		ck2.Ping(4)
+		ck1.Ping(4)
+		ck3.Ping(0)
+		check(t, ck2, ck2.me, "", 4)
+
+		admin.Cordon(ck3.me, false)
+		ck3.Ping(0)
+		check(t, ck2, ck2.me, ck3.me, 5)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill()
+}
+
+func TestMetrics(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("metrics-v")
+	vs := StartServer(vshost, WithHTTPAddr("127.0.0.1:0"))
+
+	ck1 := MakeClerk(port("metrics-1"), vshost)
+	ck2 := MakeClerk(port("metrics-2"), vshost)
+
+	fmt.Printf("Test: Metrics ...\n")
+
+	ck1.Ping(0)
+	ck1.Ping(1)
+	ck2.Ping(0)
+	check(t, ck1, ck1.me, ck2.me, 2)
+
+	resp, err := http.Get("http://" + vs.HTTPAddr() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, want := range []string{
+		"viewservice_view_number 2\n",
+		`viewservice_rpc_requests_total{method="ViewServer.Ping"} 3` + "\n",
+		`viewservice_rpc_duration_seconds_count{method="ViewServer.Get"} `,
+		`viewservice_last_ping_age_seconds{server="` + ck1.me + `"} `,
+		`viewservice_last_ping_age_seconds{server="` + ck2.me + `"} `,
+		`viewservice_suspicion{server="` + ck1.me + `"} `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill()
+	if _, err := http.Get("http://" + vs.HTTPAddr() + "/metrics"); err == nil {
+		t.Fatalf("still serving HTTP after Kill")
+	}
+}
+
+// a buffer the viewservice can log to while a test reads it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogging(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	var log logBuffer
+	vshost := port("logging-v")
+	vs := StartServer(vshost, WithLogger(logging.New(&log, logging.Info)))
+
+	ck1 := MakeClerk(port("logging-1"), vshost)
+	ck2 := MakeClerk(port("logging-2"), vshost)
+
+	fmt.Printf("Test: Logging ...\n")
+
+	ck1.Ping(0)
+	ck1.Ping(1)
+	ck2.Ping(0)
+	check(t, ck1, ck1.me, ck2.me, 2)
+	ck1.Ping(2)
+
+	// the primary dies, and the backup takes over
+	for i := 0; i < DeadPings*2; i++ {
+		ck2.Ping(2)
+		time.Sleep(PingInterval)
+	}
+	check(t, ck2, ck2.me, "", 3)
+
+	for _, want := range []string{
+		`level=info msg="view changed" component=viewservice server=` + vshost + ` viewnum=1 primary=` + ck1.me + ` backups=""`,
+		`level=info msg="view changed" component=viewservice server=` + vshost + ` viewnum=2 primary=` + ck1.me + ` backups=` + ck2.me,
+		`level=warn msg="replacing primary" component=viewservice server=` + vshost + ` viewnum=2 primary=` + ck1.me + ` restarted=false`,
+		`level=info msg="view changed" component=viewservice server=` + vshost + ` viewnum=3 primary=` + ck2.me,
+	} {
+		if !strings.Contains(log.String(), want) {
+			t.Fatalf("log is missing %q:\n%s", want, log.String())
+		}
+	}
+	if strings.Contains(log.String(), "level=debug") {
+		t.Fatalf("logged at debug while at info:\n%s", log.String())
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill()
+}
+
+func TestStatus(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("status-v")
+	vs := StartServer(vshost, WithHTTPAddr("127.0.0.1:0"))
+
+	ck1 := MakeClerk(port("status-1"), vshost)
+	ck2 := MakeClerk(port("status-2"), vshost)
+
+	fmt.Printf("Test: Status ...\n")
+
+	ck1.Ping(0)
+	ck1.Ping(1)
+	ck2.Ping(0)
+	check(t, ck1, ck1.me, ck2.me, 2)
+
+	resp, err := http.Get("http://" + vs.HTTPAddr() + "/status")
+	if err != nil {
+		t.Fatalf("GET /status: %v", err)
+	}
+	var st Status
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("bad status: %v", err)
+	}
+
+	if st.Server != vshost || st.Viewnum != 2 || st.Primary != ck1.me || len(st.Backups) != 1 || st.Backups[0] != ck2.me {
+		t.Fatalf("bad view in status %+v", st)
+	}
+	if st.Acknowledged {
+		t.Fatalf("view 2 acknowledged before the primary saw it")
+	}
+	if len(st.Servers) != 2 {
+		t.Fatalf("status has %v servers, expected 2", len(st.Servers))
+	}
+	s1, s2 := st.Servers[ck1.me], st.Servers[ck2.me]
+	if s1.Viewnum != 1 || !s1.Alive || s1.LastPingAge < 0 || s1.LastPingAge > 1 {
+		t.Fatalf("bad status of %v: %+v", ck1.me, s1)
+	}
+	if s2.Viewnum != 0 || !s2.Alive {
+		t.Fatalf("bad status of %v: %+v", ck2.me, s2)
+	}
+
+	ck1.Ping(2)
+	if st := vs.Status(); !st.Acknowledged {
+		t.Fatalf("view 2 not acknowledged once the primary saw it")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill()
+}
+
+func TestConfig(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Config validation and backoff ...\n")
+
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	for _, c := range []Config{
+		{PingInterval: 0, DeadPings: 5, RetryBackoff: time.Millisecond, MaxRetryBackoff: time.Millisecond},
+		{PingInterval: PingInterval, DeadPings: 0, RetryBackoff: time.Millisecond, MaxRetryBackoff: time.Millisecond},
+		{PingInterval: PingInterval, DeadPings: 5, RetryBackoff: 0, MaxRetryBackoff: time.Millisecond},
+		{PingInterval: PingInterval, DeadPings: 5, RetryBackoff: time.Second, MaxRetryBackoff: time.Millisecond},
+		{PingInterval: PingInterval, DeadPings: 5, RetryBackoff: time.Millisecond, MaxRetryBackoff: time.Millisecond, PhiThreshold: 0.3},
+		{PingInterval: PingInterval, DeadPings: 5, RetryBackoff: time.Millisecond, MaxRetryBackoff: time.Millisecond, PhiThreshold: 0.9},
+	} {
+		if c.Validate() == nil {
+			t.Fatalf("%+v is valid", c)
+		}
+	}
+
+	c := Config{PingInterval: PingInterval, DeadPings: 5, RetryBackoff: 10 * time.Millisecond, MaxRetryBackoff: 50 * time.Millisecond}
+	for failures, want := range []time.Duration{10, 10, 20, 40, 50, 50} {
+		if got := c.Backoff(failures); got != want*time.Millisecond {
+			t.Fatalf("backoff after %v failures is %v, expected %v", failures, got, want*time.Millisecond)
+		}
+	}
+	if !c.Agrees(DefaultConfig()) {
+		t.Fatalf("configs differing only in backoff disagree")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Config hot reload ...\n")
+
+	vshost := port("config-v")
+	slow := DefaultConfig()
+	slow.DeadPings = 20
+	vs := StartServer(vshost, WithConfig(slow), WithHTTPAddr("127.0.0.1:0"))
+
+	ck1 := MakeClerk(port("config-1"), vshost)
+	ck2 := MakeClerk(port("config-2"), vshost)
+	ck3 := MakeClerk(port("config-3"), vshost)
+
+	ck1.Ping(0)
+	ck1.Ping(1)
+	ck2.Ping(0)
+	check(t, ck1, ck1.me, ck2.me, 2)
+	ck1.Ping(2)
+
+	put := func(body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, "http://"+vs.HTTPAddr()+"/config", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT /config: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := put(`{"dead_pings": 0, "ping_interval": "-1s"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT of an invalid config: %v", resp.Status)
+	}
+	if resp := put(`{"dead_pings": 2}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT /config: %v", resp.Status)
+	}
+	fast := slow
+	fast.DeadPings = 2
+	if vs.Config() != fast {
+		t.Fatalf("config is %+v after PUT, expected %+v", vs.Config(), fast)
+	}
+
+	// ck3 still has the old timing, so it is given the old dead timeout.
+	ck3.PingWith(PingArgs{Viewnum: 0, Config: slow})
+	if st := vs.Status().Servers[ck3.me]; st.Agrees || st.Config == nil || *st.Config != slow {
+		t.Fatalf("bad status of a server that disagrees: %+v", st)
+	}
+
+	// the primary stops pinging; the backup takes over in far less
+	// than the 2s it would have taken before the change.
+	for i := 0; i < 10; i++ {
+		ck2.Ping(2)
+		time.Sleep(PingInterval)
+	}
+	check(t, ck2, ck2.me, ck3.me, 3)
+
+	st := vs.Status()
+	if st.Servers[ck1.me].Alive || !st.Servers[ck3.me].Alive {
+		t.Fatalf("bad liveness after the change: %+v", st.Servers)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill()
+}
+
+func TestFailureDetector(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Failure detector ...\n")
+
+	c := DefaultConfig()
+	start := time.Now()
+
+	// regular pings are suspected after about the dead timeout
+	var regular detector
+	for i := 0; i < 50; i++ {
+		regular.heartbeat(start.Add(time.Duration(i) * PingInterval))
+	}
+	last := start.Add(49 * PingInterval)
+	if phi := regular.phi(last.Add(PingInterval), c); phi > 1 {
+		t.Fatalf("phi %v a ping interval after the last ping", phi)
+	}
+	if phi := regular.phi(last.Add(c.DeadTimeout()), c); phi < c.PhiThreshold-0.01 || phi > c.PhiThreshold+0.01 {
+		t.Fatalf("phi %v at the dead timeout, expected %v", phi, c.PhiThreshold)
+	}
+	prev := 0.0
+	for _, after := range []time.Duration{time.Second, time.Minute, time.Hour} {
+		phi := regular.phi(last.Add(after), c)
+		if math.IsInf(phi, 0) || math.IsNaN(phi) || phi <= prev {
+			t.Fatalf("phi %v after %v, following %v", phi, after, prev)
+		}
+		prev = phi
+	}
+
+	// a threshold too low to judge by (which Validate refuses) makes phi
+	// meaningless, but what the viewservice uses and exports stays finite
+	low := c
+	low.PhiThreshold = 0.2
+	for _, phi := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), regular.phi(last.Add(PingInterval), low)} {
+		clamped := finitePhi(phi)
+		if math.IsNaN(clamped) || math.IsInf(clamped, 0) || (math.IsNaN(phi) && clamped > low.PhiThreshold) {
+			t.Fatalf("phi %v clamped to %v", phi, clamped)
+		}
+	}
+	if _, err := json.Marshal(ServerStatus{Suspicion: finitePhi(math.Inf(1))}); err != nil {
+		t.Fatalf("can't encode the status of a server that is surely dead: %v", err)
+	}
+
+	// jittery pings are given longer
+	var jittery detector
+	at := start
+	for i := 0; i < 50; i++ {
+		jittery.heartbeat(at)
+		if i%2 == 0 {
+			at = at.Add(50 * time.Millisecond)
+		} else {
+			at = at.Add(350 * time.Millisecond)
+		}
+	}
+	if phi := jittery.phi(jittery.last.Add(c.DeadTimeout()), c); phi > c.PhiThreshold/2 {
+		t.Fatalf("jittery server has phi %v at the dead timeout", phi)
+	}
+
+	// the viewservice judges servers by it, and shows how suspicious it is
+	vshost := port("detector-v")
+	vs := StartServer(vshost)
+	ck1 := MakeClerk(port("detector-1"), vshost)
+	for i := 0; i < 5; i++ {
+		ck1.Ping(0)
+		time.Sleep(PingInterval)
+	}
+	if st := vs.Status().Servers[ck1.me]; !st.Alive || st.Suspicion > 1 {
+		t.Fatalf("bad status of a server that is pinging: %+v", st)
+	}
+	time.Sleep(PingInterval * DeadPings * 2)
+	if st := vs.Status().Servers[ck1.me]; st.Alive || st.Suspicion <= c.PhiThreshold {
+		t.Fatalf("bad status of a server that has stopped: %+v", st)
+	}
+
+	// once back, it is judged afresh, rather than given longer for its silence
+	ck1.Ping(0)
+	vs.impl.mu.Lock()
+	n := len(vs.impl.servers[ck1.me].detector.intervals)
+	vs.impl.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("detector kept %v intervals across a failure", n)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill()
+}
@@ -0,0 +1,172 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sort"
+	"sync"
+)
+
+// A Codec is an encoding that RPCs can be sent in. The same handlers
+// are served in every registered codec.
+type Codec struct {
+	Name           string
+	NewClientCodec func(conn io.ReadWriteCloser) rpc.ClientCodec
+	NewServerCodec func(conn io.ReadWriteCloser) rpc.ServerCodec
+}
+
+var (
+	mu     sync.Mutex
+	codecs = map[string]*Codec{}
+	chosen = "gob" // the codec clients ask for
+)
+
+// JSON strings can only hold UTF-8, and encoding/json turns anything else
+// into U+FFFD, so binary data must travel in byte slices, which it sends in
+// base64; pbservice sends values that way. What travels in strings, such
+// as keys, must be UTF-8 in a cluster that uses json.
+func init() {
+	Register(&Codec{Name: "gob", NewClientCodec: newGobClientCodec, NewServerCodec: newGobServerCodec})
+	Register(&Codec{Name: "json", NewClientCodec: jsonrpc.NewClientCodec, NewServerCodec: jsonrpc.NewServerCodec})
+}
+
+// Register makes a codec available to clients and servers, replacing
+// any codec of the same name. Names must not contain spaces.
+func Register(codec *Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	codecs[codec.Name] = codec
+}
+
+// Lookup returns the codec with the given name, or nil if there is none.
+func Lookup(name string) *Codec {
+	mu.Lock()
+	defer mu.Unlock()
+	return codecs[name]
+}
+
+// Codecs returns the names of the registered codecs.
+func Codecs() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetCodec sets the codec that clients ask servers to use from now on.
+// A server that doesn't know it answers in gob.
+func SetCodec(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if codecs[name] == nil {
+		return &UnknownCodecError{name}
+	}
+	chosen = name
+	return nil
+}
+
+// ClientCodec returns the name of the codec clients ask for.
+func ClientCodec() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return chosen
+}
+
+// UnknownCodecError is returned for a codec that isn't registered.
+type UnknownCodecError struct {
+	Name string
+}
+
+func (e *UnknownCodecError) Error() string {
+	return "wire: unknown codec " + e.Name
+}
+
+// gob, as net/rpc speaks it; legacy peers speak nothing else.
+
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(encBuf), encBuf}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &gobServerCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(encBuf), encBuf: encBuf}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the gob couldn't be encoded; don't send half of it
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// only close the connection once
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -0,0 +1,31 @@
+package wire
+
+import (
+	"io"
+)
+
+// A Transport carries RPCs from clerks to servers and between servers.
+// Call sends an RPC to the rpcname handler on srv, waits for the reply
+// and leaves it in reply; it returns false if srv couldn't be reached,
+// in which case reply means nothing.
+type Transport interface {
+	Call(srv string, rpcname string, args interface{}, reply interface{}) bool
+}
+
+// TransportFunc makes a Transport of an ordinary function, such as the
+// call() each package has for dialing a Unix socket per RPC.
+type TransportFunc func(srv string, rpcname string, args interface{}, reply interface{}) bool
+
+func (f TransportFunc) Call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return f(srv, rpcname, args, reply)
+}
+
+// A Network is a Transport that servers join by name, rather than by
+// listening on a socket of their own, such as a simulated one. A server
+// started on a Network calls Serve instead of listening: rcvr's methods
+// are then served at addr, as rpc.Register would serve them, until the
+// server closes the io.Closer Serve returned.
+type Network interface {
+	Transport
+	Serve(addr string, rcvr interface{}) (io.Closer, error)
+}
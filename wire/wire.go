@@ -0,0 +1,283 @@
+// Package wire carries the RPCs of the viewservice and pbservice in
+// any of several codecs.
+//
+// A client opens each connection with a hello naming the newest
+// protocol version it speaks and the codec it would like; the server
+// answers with the version and codec they will use. Peers from before
+// the hello existed speak plain gob: a server that sees no hello serves
+// the connection in gob, and a client whose hello is refused (a legacy
+// server can't decode it, and hangs up) dials again and speaks gob,
+// so mixed-version clusters keep working during an upgrade.
+package wire
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the newest version of the protocol this package speaks.
+// Version 0 is plain gob with no hello.
+const Version = 1
+
+// a hello starts with magic, which reads to a gob decoder as the byte
+// count of an impossibly large message, so a legacy server rejects it
+// straight away. a legacy client's first byte is never 0xf8.
+const magic = "\xf8PBWIRE\x00\x00"
+
+// how long a client remembers that a server only speaks gob, before
+// trying a hello again, in case it has been upgraded.
+const legacyMemory = 10 * time.Second
+
+var (
+	legacyMu sync.Mutex
+	legacy   = map[string]time.Time{} // address -> when it last refused a hello
+)
+
+// Dial connects to an RPC server at the given address, and negotiates
+// the version and codec to speak.
+func Dial(network string, address string) (*rpc.Client, error) {
+	return DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial, but gives up when ctx ends.
+func DialContext(ctx context.Context, network string, address string) (*rpc.Client, error) {
+	var d net.Dialer
+
+	legacyMu.Lock()
+	refused, isLegacy := legacy[address]
+	legacyMu.Unlock()
+
+	if !isLegacy || time.Since(refused) > legacyMemory {
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewClient(ctx, conn)
+		if err == nil {
+			legacyMu.Lock()
+			delete(legacy, address)
+			legacyMu.Unlock()
+			return client, nil
+		}
+		if _, refusal := err.(*helloError); !refusal {
+			return nil, err
+		}
+		legacyMu.Lock()
+		legacy[address] = time.Now()
+		legacyMu.Unlock()
+	}
+
+	// a legacy server
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClientWithCodec(newGobClientCodec(conn)), nil
+}
+
+// helloError means the server didn't answer a hello, as a legacy server won't.
+type helloError struct {
+	err error
+}
+
+func (e *helloError) Error() string {
+	return fmt.Sprintf("wire: no answer to hello: %v", e.err)
+}
+
+// NewClient says hello over conn and returns a client that speaks
+// whatever the server agrees to. If the server doesn't answer, conn is
+// closed and the error is one that DialContext takes to mean a legacy server.
+func NewClient(ctx context.Context, conn net.Conn) (*rpc.Client, error) {
+	// a legacy server hangs up on a hello straight away, so there's
+	// no need for a deadline of our own
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	codec := ClientCodec()
+	if _, err := fmt.Fprintf(conn, "%s%d %s\n", magic, Version, codec); err != nil {
+		conn.Close()
+		return nil, &helloError{err}
+	}
+
+	// read the answer a byte at a time, so as not to read past it
+	var answer []byte
+	var b [1]byte
+	for len(answer) < 64 && (len(answer) == 0 || answer[len(answer)-1] != '\n') {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			conn.Close()
+			return nil, &helloError{err}
+		}
+		answer = append(answer, b[0])
+	}
+	version, name, err := parseHello(string(answer))
+	if err != nil || version < 1 || version > Version {
+		conn.Close()
+		return nil, fmt.Errorf("wire: bad answer to hello %q", answer)
+	}
+	agreed := Lookup(name)
+	if agreed == nil {
+		conn.Close()
+		return nil, &UnknownCodecError{name}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClientWithCodec(agreed.NewClientCodec(conn)), nil
+}
+
+// parseHello parses the "<version> <codec>\n" part of a hello, or its answer.
+func parseHello(line string) (version int, codec string, err error) {
+	if !strings.HasSuffix(line, "\n") {
+		return 0, "", fmt.Errorf("wire: hello %q too long", line)
+	}
+	if _, err := fmt.Sscanf(line, "%d %s\n", &version, &codec); err != nil {
+		return 0, "", err
+	}
+	return version, codec, nil
+}
+
+// ServeConn serves the connection with server, in the codec the client
+// asks for, or in gob for a legacy client. It blocks until the client
+// hangs up.
+func ServeConn(server *rpc.Server, conn net.Conn) {
+	ServeConnObserved(server, conn, nil)
+}
+
+// An Observer is told about each call a server answers: the method, how
+// long it took, and whether the handler returned an error. A call of a
+// method the server doesn't have is reported as "unknown", so that clients
+// can't make up a new method name, and so a new metric series, per call.
+type Observer func(method string, elapsed time.Duration, failed bool)
+
+// the method an Observer is told of for a call of one that doesn't exist.
+const unknownMethod = "unknown"
+
+// ServeConnObserved is like ServeConn, but tells observe (if not nil)
+// about each call.
+func ServeConnObserved(server *rpc.Server, conn net.Conn, observe Observer) {
+	r := bufio.NewReader(conn)
+	rwc := &bufferedConn{r, conn}
+
+	first, err := r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if first[0] != magic[0] {
+		// a legacy client
+		server.ServeCodec(observed(newGobServerCodec(rwc), observe))
+		return
+	}
+
+	// the hello is magic, then "<version> <codec>\n"
+	hello := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, hello); err != nil || string(hello) != magic {
+		conn.Close()
+		return
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || len(line) > 64 {
+		conn.Close()
+		return
+	}
+	version, name, err := parseHello(line)
+	if err != nil || version < 1 {
+		conn.Close()
+		return
+	}
+	if version > Version {
+		version = Version
+	}
+	codec := Lookup(name)
+	if codec == nil {
+		codec = Lookup("gob")
+	}
+
+	// even if the answer can't be written, serve the requests (the
+	// client will see the connection fail)
+	fmt.Fprintf(conn, "%d %s\n", version, codec.Name)
+	server.ServeCodec(observed(codec.NewServerCodec(rwc), observe))
+}
+
+// observed returns codec, wrapped so that observe hears about each call.
+func observed(codec rpc.ServerCodec, observe Observer) rpc.ServerCodec {
+	if observe == nil {
+		return codec
+	}
+	return &observedCodec{ServerCodec: codec, observe: observe, calls: make(map[uint64]call)}
+}
+
+type observedCodec struct {
+	rpc.ServerCodec
+	observe Observer
+	mu      sync.Mutex
+	calls   map[uint64]call // by sequence number
+	last    uint64          // the sequence number of the request being read
+}
+
+type call struct {
+	method string
+	start  time.Time
+}
+
+func (c *observedCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	if err == nil {
+		c.mu.Lock()
+		c.calls[r.Seq] = call{r.ServiceMethod, time.Now()}
+		c.last = r.Seq
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// net/rpc reads a request's body into nil, to discard it, when it
+// doesn't have the method the header named.
+func (c *observedCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		c.mu.Lock()
+		if started, ok := c.calls[c.last]; ok {
+			started.method = unknownMethod
+			c.calls[c.last] = started
+		}
+		c.mu.Unlock()
+	}
+	return c.ServerCodec.ReadRequestBody(body)
+}
+
+func (c *observedCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	started, ok := c.calls[r.Seq]
+	delete(c.calls, r.Seq)
+	c.mu.Unlock()
+	if ok {
+		c.observe(started.method, time.Since(started.start), r.Error != "")
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// a connection whose reads go through a buffer, so that nothing peeked
+// at while looking for a hello is lost.
+type bufferedConn struct {
+	r    *bufio.Reader
+	conn net.Conn
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *bufferedConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,231 @@
+package wire
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Add(args *Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func port(tag string) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "wire-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag
+	return s
+}
+
+// serve starts an Arith server; a legacy one serves plain gob.
+func serve(t *testing.T, tag string, legacy bool) (string, net.Listener) {
+	rpcs := rpc.NewServer()
+	rpcs.Register(new(Arith))
+
+	me := port(tag)
+	os.Remove(me)
+	l, err := net.Listen("unix", me)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if legacy {
+				go rpcs.ServeConn(conn)
+			} else {
+				go ServeConn(rpcs, conn)
+			}
+		}
+	}()
+	return me, l
+}
+
+func add(t *testing.T, c *rpc.Client) {
+	var reply Reply
+	if err := c.Call("Arith.Add", &Args{7, 8}, &reply); err != nil || reply.C != 15 {
+		t.Fatalf("Add returned %v, %v", reply.C, err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	fmt.Printf("Test: Every codec ...\n")
+
+	me, l := serve(t, "codecs", false)
+	defer l.Close()
+	defer SetCodec("gob")
+
+	for _, name := range Codecs() {
+		if err := SetCodec(name); err != nil {
+			t.Fatalf("SetCodec(%v): %v", name, err)
+		}
+		c, err := Dial("unix", me)
+		if err != nil {
+			t.Fatalf("Dial with %v: %v", name, err)
+		}
+		add(t, c)
+		c.Close()
+	}
+
+	if err := SetCodec("nosuch"); err == nil {
+		t.Fatalf("SetCodec accepted an unknown codec")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestNegotiation(t *testing.T) {
+	fmt.Printf("Test: Version and codec negotiation ...\n")
+
+	me, l := serve(t, "negotiate", false)
+	defer l.Close()
+
+	hello := func(line string) string {
+		conn, err := net.Dial("unix", me)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "%s%s", magic, line)
+		answer, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("no answer to hello %q: %v", line, err)
+		}
+		return answer
+	}
+
+	if answer := hello("1 json\n"); answer != "1 json\n" {
+		t.Fatalf("answer %q to json", answer)
+	}
+	// a newer client is answered with our version
+	if answer := hello("7 json\n"); answer != fmt.Sprintf("%d json\n", Version) {
+		t.Fatalf("answer %q to a newer client", answer)
+	}
+	// and a codec we don't know with gob
+	if answer := hello("1 nosuch\n"); answer != "1 gob\n" {
+		t.Fatalf("answer %q to an unknown codec", answer)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLegacy(t *testing.T) {
+	fmt.Printf("Test: Legacy gob peers ...\n")
+
+	// a legacy client of a new server
+	me, l := serve(t, "newserver", false)
+	defer l.Close()
+	c, err := rpc.Dial("unix", me)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	add(t, c)
+	c.Close()
+
+	// a new client of a legacy server
+	defer SetCodec("gob")
+	SetCodec("json")
+	old, lold := serve(t, "oldserver", true)
+	defer lold.Close()
+	for i := 0; i < 2; i++ {
+		c, err := Dial("unix", old)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		add(t, c)
+		c.Close()
+	}
+	legacyMu.Lock()
+	_, remembered := legacy[old]
+	legacyMu.Unlock()
+	if !remembered {
+		t.Fatalf("legacy server not remembered")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestObserved(t *testing.T) {
+	fmt.Printf("Test: Observed calls, and calls of unknown methods ...\n")
+
+	rpcs := rpc.NewServer()
+	rpcs.Register(new(Arith))
+	var mu sync.Mutex
+	var methods []string
+	observe := func(method string, elapsed time.Duration, failed bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		methods = append(methods, fmt.Sprintf("%v %v", method, failed))
+	}
+
+	me := port("observed")
+	os.Remove(me)
+	l, err := net.Listen("unix", me)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ServeConnObserved(rpcs, conn, observe)
+		}
+	}()
+
+	defer SetCodec("gob")
+	for _, name := range Codecs() {
+		SetCodec(name)
+		c, err := Dial("unix", me)
+		if err != nil {
+			t.Fatalf("Dial with %v: %v", name, err)
+		}
+		add(t, c)
+		var reply Reply
+		for _, method := range []string{"Arith.Made-up-1", "Nosuch.Add", "ill-formed"} {
+			if err := c.Call(method, &Args{1, 2}, &reply); err == nil {
+				t.Fatalf("call of %v with %v succeeded", method, name)
+			}
+		}
+		// the connection still works
+		add(t, c)
+		c.Close()
+
+		mu.Lock()
+		got := strings.Join(methods, ", ")
+		methods = nil
+		mu.Unlock()
+		want := "Arith.Add false, unknown true, unknown true, unknown true, Arith.Add false"
+		if got != want {
+			t.Fatalf("observed %q with %v; want %q", got, name, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}